@@ -35,6 +35,56 @@ def _expand_and_quote(*, ctx, attr, string, targets):
     else:
         return shell.quote(expanded)
 
+_READY_CHECK_KEYS = ["command", "tcp", "http", "interval_ms", "timeout_seconds"]
+
+def _ready_check(ready_check):
+    check = {}
+    for key, value in ready_check.items():
+        if key not in _READY_CHECK_KEYS:
+            fail("unknown ready_check key %r (want one of %s)" % (key, ", ".join(_READY_CHECK_KEYS)), attr = "ready_check")
+        if key in ("interval_ms", "timeout_seconds"):
+            if not value.isdigit():
+                fail("ready_check %s must be a number, got %r" % (key, value), attr = "ready_check")
+            value = int(value)
+        check[key] = value
+    return check
+
+def _umask(umask):
+    if not all([c in "01234567" for c in umask.elems()]):
+        fail("umask must be an octal number such as \"022\", got %r" % umask, attr = "umask")
+    return int(umask, 8)
+
+def _settings(ctx):
+    settings = {
+        "allow_exit_codes": ctx.attr.allow_exit_codes,
+        "cpu_affinity": ctx.attr.cpu_affinity,
+        "cpu_quota_percent": ctx.attr.cpu_quota_percent,
+        "delay_start_seconds": ctx.attr.delay_start_seconds,
+        "disabled": ctx.attr.disabled,
+        "group": ctx.attr.group,
+        "idle_timeout_seconds": ctx.attr.idle_timeout_seconds,
+        "memory_limit_mb": ctx.attr.memory_limit_mb,
+        "needs": ctx.attr.needs,
+        "nice": ctx.attr.nice,
+        "output_sink": ctx.attr.output_sink,
+        "retries": ctx.attr.retries,
+        "retry_on_exit_codes": ctx.attr.retry_on_exit_codes,
+        "timeout_kill_grace_ms": ctx.attr.timeout_kill_grace_ms,
+        "timeout_kill_signal": ctx.attr.timeout_kill_signal,
+    }
+
+    # Like the Go side, leave out what is not set
+    settings = {k: v for k, v in settings.items() if v}
+    for name in ["env_file", "fingerprint_file", "stdin_file"]:
+        file = getattr(ctx.file, name)
+        if file:
+            settings[name] = file.short_path
+    if ctx.attr.umask:
+        settings["umask"] = _umask(ctx.attr.umask)
+    if ctx.attr.ready_check:
+        settings["ready_check"] = _ready_check(ctx.attr.ready_check)
+    return settings
+
 def _command_impl(ctx):
     runfiles = ctx.runfiles().merge(ctx.attr._bash_runfiles[DefaultInfo].default_runfiles)
 
@@ -43,6 +93,19 @@ def _command_impl(ctx):
         if default_runfiles != None:
             runfiles = runfiles.merge(default_runfiles)
 
+    settings = _settings(ctx)
+    if ctx.attr.on_failure:
+        on_failure = ctx.attr.on_failure if type(ctx.attr.on_failure) == "Target" else ctx.attr.on_failure[0]
+        on_failure_info = on_failure[DefaultInfo]
+        on_failure_exe = on_failure_info.files_to_run.executable
+        settings["on_failure"] = struct(
+            tag = str(on_failure.label),
+            path = on_failure_exe.short_path,
+        )
+        runfiles = runfiles.merge(ctx.runfiles(files = [on_failure_exe]))
+        if on_failure_info.default_runfiles != None:
+            runfiles = runfiles.merge(on_failure_info.default_runfiles)
+
     command = ctx.attr.command if type(ctx.attr.command) == "Target" else ctx.attr.command[0]
     default_info = command[DefaultInfo]
     executable = default_info.files_to_run.executable
@@ -84,18 +147,15 @@ def _command_impl(ctx):
     providers = [
         DefaultInfo(
             files = depset([out_file]),
-            runfiles = runfiles.merge(ctx.runfiles(files = ctx.files.data + [executable])),
+            runfiles = runfiles.merge(ctx.runfiles(files = ctx.files.data + ctx.files.env_file + ctx.files.fingerprint_file + ctx.files.stdin_file + [executable])),
             executable = out_file,
         ),
+        CommandInfo(
+            description = ctx.attr.description,
+            settings = settings,
+        ),
     ]
 
-    if ctx.attr.description:
-        providers.append(
-            CommandInfo(
-                description = ctx.attr.description,
-            ),
-        )
-
     return providers
 
 def command_with_transition(cfg, allowlist = None, doc = None):
@@ -135,6 +195,83 @@ def command_with_transition(cfg, allowlist = None, doc = None):
             default = False,
             doc = "If true, the command will be run from the workspace root instead of the execution root",
         ),
+        "needs": attr.string_list(
+            doc = "Tags of the commands of the same multirun that must succeed, or with a `ready_check` be ready, before this one starts. A command's tag is its `description`, or `Running <label>` without one.",
+        ),
+        "group": attr.string(
+            doc = "A resource this command shares with others. At most the multirun's `group_limits` entry for it (1 by default) of the commands of a group run at the same time.",
+        ),
+        "allow_exit_codes": attr.int_list(
+            doc = "Non-zero exit codes that still count as success.",
+        ),
+        "retries": attr.int(
+            default = 0,
+            doc = "How many more times to run the command when it fails.",
+        ),
+        "retry_on_exit_codes": attr.int_list(
+            doc = "Only retry the command when it fails with one of these exit codes. Empty retries any failure.",
+        ),
+        "on_failure": attr.label(
+            executable = True,
+            allow_files = True,
+            doc = "Target to run once this command has failed, with MULTIRUN_FAILED_TAG and MULTIRUN_FAILED_CODE set.",
+            cfg = cfg,
+        ),
+        "env_file": attr.label(
+            allow_single_file = True,
+            doc = "A file of KEY=VALUE lines added to the command's environment. Entries of `environment` win.",
+        ),
+        "stdin_file": attr.label(
+            allow_single_file = True,
+            doc = "A file fed to the command's stdin.",
+        ),
+        "fingerprint_file": attr.label(
+            allow_single_file = True,
+            doc = "A file hashed before the command runs. With the multirun's `state_dir` set, the command is skipped while the hash matches the one from its last successful run.",
+        ),
+        "nice": attr.int(
+            default = 0,
+            doc = "Lowers (or, with privileges, raises) the command's scheduling priority, from -20 to 19. Unix only.",
+        ),
+        "idle_timeout_seconds": attr.int(
+            default = 0,
+            doc = "Kill the command, as a failure, once it has written nothing for this many seconds.",
+        ),
+        "delay_start_seconds": attr.int(
+            default = 0,
+            doc = "Hold the command back for this many seconds after the run begins, without holding back other commands.",
+        ),
+        "disabled": attr.bool(
+            default = False,
+            doc = "Leave the command out of the run unless multirun is given --run-disabled.",
+        ),
+        "output_sink": attr.string(
+            doc = "Send the command's output to `unix://path` (a Unix socket) or `pipe://path` (a named pipe) instead of stdout.",
+        ),
+        "umask": attr.string(
+            doc = "The command's file mode creation mask as an octal string, such as \"002\". Unix only.",
+        ),
+        "memory_limit_mb": attr.int(
+            default = 0,
+            doc = "Cap the command's memory through a cgroup of its own. To create it, multirun moves itself into a `multirun` cgroup below its own, which is left behind for later runs. Linux with cgroup v2 only.",
+        ),
+        "cpu_quota_percent": attr.int(
+            default = 0,
+            doc = "Cap the command's CPU time, 100 being one full CPU, through a cgroup of its own, as with `memory_limit_mb`. Linux with cgroup v2 only.",
+        ),
+        "cpu_affinity": attr.int_list(
+            doc = "Pin the command to these CPUs, numbered from 0. Linux only.",
+        ),
+        "ready_check": attr.string_dict(
+            doc = "Probe for a long-running command, such as a server, that lets the commands that need it start once it is ready rather than once it has exited. Set one of `command` (a shell snippet), `tcp` (host:port) or `http` (a URL), and optionally `interval_ms` and `timeout_seconds`. Once no command that needs it is left, the run stops the command as a success. Parallel runs only.",
+        ),
+        "timeout_kill_signal": attr.string(
+            doc = "Overrides the multirun's `timeout_kill_signal` for this command.",
+        ),
+        "timeout_kill_grace_ms": attr.int(
+            default = 0,
+            doc = "Overrides the multirun's `timeout_kill_grace_ms` for this command.",
+        ),
         "_bash_runfiles": attr.label(
             default = Label("@bazel_tools//tools/bash/runfiles"),
         ),
@@ -0,0 +1,52 @@
+//go:build linux
+
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// clampCPUs clamps the cpu_affinity of the command tagged tag to the CPUs
+// there are, warning about each number out of range.
+func clampCPUs(tag string, cpus []int) []int {
+	n := runtime.NumCPU()
+	out := make([]int, len(cpus))
+	for i, c := range cpus {
+		out[i] = min(max(c, 0), n-1)
+		if out[i] != c {
+			fmt.Fprintf(os.Stderr, "multirun: %s: cpu %d out of range (0 to %d), using %d\n", tag, c, n-1, out[i])
+		}
+	}
+	return out
+}
+
+// setAffinity pins a just-started process to cpus with sched_setaffinity;
+// threads and processes it starts afterwards inherit the mask. Failures are
+// only warned about.
+func setAffinity(tag string, pid int, cpus []int) {
+	if len(cpus) == 0 {
+		return
+	}
+	mask := make([]uint64, maxCPU(cpus)/64+1)
+	for _, c := range cpus {
+		mask[c/64] |= 1 << (c % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		fmt.Fprintf(os.Stderr, "multirun: %s: cannot set cpu_affinity %v: %v\n", tag, cpus, errno)
+		return
+	}
+	debugf("%s: cpu_affinity %v", tag, cpus)
+}
+
+func maxCPU(cpus []int) int {
+	m := 0
+	for _, c := range cpus {
+		m = max(m, c)
+	}
+	return m
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package multirun
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// affinity reads the CPUs process pid may run on.
+func affinity(t *testing.T, pid int) []int {
+	t.Helper()
+	mask := make([]uint64, 16)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, uintptr(pid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var cpus []int
+	for c := range len(mask) * 64 {
+		if mask[c/64]&(1<<(c%64)) != 0 {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus
+}
+
+func TestSetAffinity(t *testing.T) {
+	// The CPUs this test may use, which need not start at 0 in a container
+	allowed := affinity(t, 0)
+	want := slices.Compact([]int{allowed[0], allowed[len(allowed)-1]})
+
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	setAffinity("sleep", cmd.Process.Pid, want)
+	if got := affinity(t, cmd.Process.Pid); !slices.Equal(got, want) {
+		t.Errorf("cpu affinity %v, want %v", got, want)
+	}
+}
+
+func TestClampCPUs(t *testing.T) {
+	n := runtime.NumCPU()
+	var got []int
+	stderr := capture(t, &os.Stderr, func() { got = clampCPUs("cmd", []int{0, -1, n - 1, n + 5}) })
+	if want := []int{0, 0, n - 1, n - 1}; !slices.Equal(got, want) {
+		t.Errorf("clampCPUs = %v, want %v", got, want)
+	}
+	if n := strings.Count(stderr, "out of range"); n != 2 {
+		t.Errorf("stderr %q, want both out of range CPUs warned about", stderr)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package multirun
+
+// clampCPUs returns cpus unchanged: cpu_affinity is ignored here anyway.
+func clampCPUs(tag string, cpus []int) []int {
+	return cpus
+}
+
+// setAffinity does nothing: cpu_affinity is only supported on Linux.
+func setAffinity(tag string, pid int, cpus []int) {
+	if len(cpus) > 0 {
+		debugf("%s: cpu_affinity is not supported on this platform, ignored", tag)
+	}
+}
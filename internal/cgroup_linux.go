@@ -0,0 +1,153 @@
+//go:build linux
+
+package multirun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriodUs is the cpu.max period cpu_quota_percent is a share of.
+const cpuPeriodUs = 100000
+
+// cgroupSeq keeps the names of transient cgroups apart.
+var cgroupSeq atomic.Int64
+
+// joinCgroup starts the command, for memory_limit_mb or cpu_quota_percent,
+// in a transient cgroup of its own below multirun's that carries the
+// limits; the kernel places the child there before it execs. The cgroup is
+// removed by close. When cgroups are unavailable or not delegated to us,
+// the limits are warned about and ignored.
+func (c *commandIO) joinCgroup(cmd *exec.Cmd, blob Command) {
+	if blob.MemoryLimitMb == 0 && blob.CpuQuotaPercent == 0 {
+		return
+	}
+	dir, err := newCgroup(blob)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: warning: %s: cannot apply resource limits, ignored: %v\n", blob.Tag, err)
+		return
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		fmt.Fprintf(os.Stderr, "multirun: warning: %s: cannot apply resource limits, ignored: %v\n", blob.Tag, err)
+		return
+	}
+	debugf("%s: cgroup %s", blob.Tag, dir)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	c.cgroupClose = func() {
+		f.Close()
+		// Fails while children the command left behind are still in it
+		if err := os.Remove(dir); err != nil {
+			debugf("%s: cannot remove cgroup: %v", blob.Tag, err)
+		}
+	}
+}
+
+// cgroupParent returns the cgroup the transient ones are created in:
+// multirun's own, which multirun itself leaves for a "multirun" leaf below it
+// the first time. cgroup v2 only lets a cgroup hand controllers down to its
+// children while it has no processes of its own, so multirun cannot stay.
+//
+// This has side effects beyond the run: multirun stays in the leaf until it
+// exits, so commands without limits, hooks and ready_check probes start
+// there too; its former cgroup keeps the memory and cpu controllers enabled
+// for its children; and the empty leaf is left behind, for later runs to
+// reuse. Callers embedding multirun through Runner.Run move their own
+// process this way.
+var cgroupParent = sync.OnceValues(func() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	self, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(cgroupRoot, self)
+	leaf := filepath.Join(parent, "multirun")
+	if err := os.Mkdir(leaf, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return "", fmt.Errorf("moving multirun to %s: %w", leaf, err)
+	}
+	debugf("moved to cgroup %s", leaf)
+	return parent, nil
+})
+
+// prepareCgroups moves multirun out of its cgroup, if any of cmds needs one
+// of its own, before any command is started in it; see cgroupParent.
+func prepareCgroups(cmds []Command) {
+	if slices.ContainsFunc(cmds, func(c Command) bool { return c.MemoryLimitMb > 0 || c.CpuQuotaPercent > 0 }) {
+		// joinCgroup reports the error
+		_, _ = cgroupParent()
+	}
+}
+
+// newCgroup creates the cgroup for blob and writes its limits.
+func newCgroup(blob Command) (string, error) {
+	parent, err := cgroupParent()
+	if err != nil {
+		return "", err
+	}
+	var controllers []string
+	if blob.MemoryLimitMb > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if blob.CpuQuotaPercent > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0); err != nil {
+		return "", fmt.Errorf("enabling controllers: %w", err)
+	}
+
+	name := fmt.Sprintf("multirun-%d-%d", os.Getpid(), cgroupSeq.Add(1))
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", err
+	}
+	limits := map[string]string{}
+	if blob.MemoryLimitMb > 0 {
+		limits["memory.max"] = fmt.Sprint(blob.MemoryLimitMb * 1024 * 1024)
+	}
+	if blob.CpuQuotaPercent > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", blob.CpuQuotaPercent*cpuPeriodUs/100, cpuPeriodUs)
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			os.Remove(dir)
+			return "", fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// ownCgroup returns multirun's cgroup v2 path, from /proc/self/cgroup.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	if _, err := cgroupParent(); err != nil {
+		t.Skipf("cgroups are not writable: %v", err)
+	}
+	dir, err := newCgroup(Command{Tag: "t", MemoryLimitMb: 64, CpuQuotaPercent: 50})
+	if err != nil {
+		t.Skipf("cannot create a cgroup: %v", err)
+	}
+	defer os.Remove(dir)
+	for file, want := range map[string]string{
+		"memory.max": "67108864",
+		"cpu.max":    "50000 100000",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(data)); got != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// joinCgroup warns that memory_limit_mb and cpu_quota_percent are ignored:
+// they rely on Linux cgroups.
+func (c *commandIO) joinCgroup(cmd *exec.Cmd, blob Command) {
+	if blob.MemoryLimitMb != 0 || blob.CpuQuotaPercent != 0 {
+		fmt.Fprintf(os.Stderr, "multirun: warning: %s: resource limits are only supported on Linux, ignored\n", blob.Tag)
+	}
+}
+
+// prepareCgroups does nothing: there are no cgroups to prepare.
+func prepareCgroups([]Command) {}
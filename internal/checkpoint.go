@@ -0,0 +1,83 @@
+package multirun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// -----------------------------------------------------------------------------
+// Checkpoints
+// -----------------------------------------------------------------------------
+
+// checkpoint is the checkpoint_file of a serial run: its commands, and the
+// positions of those that have succeeded so far. Positions rather than tags
+// key it, as untagged commands all share the empty tag.
+type checkpoint struct {
+	Commands []string `json:"commands"`
+	Done     []int    `json:"done"`
+}
+
+// checkpointID names c in a checkpoint: its tag, or what it runs when it
+// has none.
+func checkpointID(c Command) string {
+	switch {
+	case c.Tag != "":
+		return c.Tag
+	case c.Command != "":
+		return c.Command
+	}
+	return c.Path
+}
+
+// newCheckpoint returns the checkpoint a serial run of cmds resumes from:
+// the one in path when it was written for the same commands, else an empty
+// one. With restart the file is ignored.
+func newCheckpoint(path string, cmds []Command, restart bool) *checkpoint {
+	cp := &checkpoint{}
+	for _, c := range cmds {
+		cp.Commands = append(cp.Commands, checkpointID(c))
+	}
+	if restart {
+		return cp
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp
+	}
+	var saved checkpoint
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "multirun: warning: checkpoint_file: %v, starting over\n", err)
+	case !slices.Equal(saved.Commands, cp.Commands):
+		fmt.Fprintln(os.Stderr, "multirun: warning: checkpoint_file was written for other commands, starting over")
+	default:
+		cp.Done = saved.Done
+	}
+	return cp
+}
+
+// done reports whether command i succeeded in an earlier run.
+func (cp *checkpoint) done(i int) bool {
+	return slices.Contains(cp.Done, i)
+}
+
+// save records that command i succeeded.
+func (cp *checkpoint) save(path string, i int) error {
+	cp.Done = append(cp.Done, i)
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash never leaves half a file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
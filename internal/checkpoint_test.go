@@ -0,0 +1,74 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// checkpointRun runs cmds, a JSON list, serially with a checkpoint_file in
+// dir, and returns the exit code and what the recorder scripts logged.
+func checkpointRun(t *testing.T, dir, cmds string) (int, []string) {
+	t.Helper()
+	os.Remove(filepath.Join(dir, "log"))
+	instr := fmt.Sprintf(`{"commands": %s, "jobs": 1, "checkpoint_file": %q}`, cmds, filepath.Join(dir, "checkpoint.json"))
+	code, _, _ := mainRun(t, dir, instr)
+	return code, recorded(t, dir)
+}
+
+func TestCheckpointResumes(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"rec.sh":   recorder,
+		"flaky.sh": `echo "$1" >> "$(dirname "$0")/log"; [ ! -e "$(dirname "$0")/fail" ]`,
+	})
+	cmds := `[
+  {"path": "rec.sh", "tag": "a", "args": ["a"]},
+  {"path": "flaky.sh", "tag": "b", "args": ["b"]},
+  {"path": "rec.sh", "tag": "c", "args": ["c"]}
+]`
+	if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code, ran := checkpointRun(t, dir, cmds); code == 0 || !slices.Equal(ran, []string{"a", "b"}) {
+		t.Fatalf("first run: exit code %d, ran %q, want b to fail after a", code, ran)
+	}
+
+	// The next run resumes with the command that failed
+	if err := os.Remove(filepath.Join(dir, "fail")); err != nil {
+		t.Fatal(err)
+	}
+	if code, ran := checkpointRun(t, dir, cmds); code != 0 || !slices.Equal(ran, []string{"b", "c"}) {
+		t.Fatalf("second run: exit code %d, ran %q, want b and c", code, ran)
+	}
+	// and, as everything succeeded, the one after starts over
+	if _, err := os.Stat(filepath.Join(dir, "checkpoint.json")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint_file left behind: %v", err)
+	}
+	if code, ran := checkpointRun(t, dir, cmds); code != 0 || !slices.Equal(ran, []string{"a", "b", "c"}) {
+		t.Errorf("third run: exit code %d, ran %q, want everything", code, ran)
+	}
+}
+
+func TestCheckpointUntaggedCommands(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"rec.sh":   recorder,
+		"flaky.sh": `echo "$1" >> "$(dirname "$0")/log"; [ ! -e "$(dirname "$0")/fail" ]`,
+	})
+	cmds := `[
+  {"path": "rec.sh", "args": ["a"]},
+  {"path": "flaky.sh", "args": ["b"]}
+]`
+	if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	checkpointRun(t, dir, cmds)
+	if err := os.Remove(filepath.Join(dir, "fail")); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first command succeeded, although both have the empty tag
+	if code, ran := checkpointRun(t, dir, cmds); code != 0 || !slices.Equal(ran, []string{"b"}) {
+		t.Errorf("exit code %d, ran %q, want only b", code, ran)
+	}
+}
@@ -0,0 +1,13 @@
+// Command multirun runs the commands of a multirun instructions file; see
+// the multirun package.
+package main
+
+import (
+	"os"
+
+	"github.com/ZacxDev/multirun"
+)
+
+func main() {
+	os.Exit(multirun.Main(os.Args[1:]))
+}
@@ -0,0 +1,60 @@
+package multirun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Confirmation
+// -----------------------------------------------------------------------------
+
+// confirm asks, for require_confirm or --confirm, whether to go ahead with
+// the run: on a terminal it lists the commands and waits for "yes";
+// without one nobody can answer, so it refuses unless --yes is given.
+func (rn *runner) confirm() error {
+	if !rn.instr.RequireConfirm && !rn.opts.confirm || rn.opts.yes {
+		return nil
+	}
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("the run needs confirmation but stdin is not a terminal; pass --yes to run anyway")
+	}
+
+	fmt.Fprintf(os.Stderr, "multirun: about to run %d commands:\n", len(rn.instr.Commands))
+	for _, c := range rn.instr.Commands {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", c.Tag, commandLine(c, slices.Concat(c.Args, rn.extraArgs.forTag(c.Tag))))
+	}
+	fmt.Fprint(os.Stderr, `Type "yes" to continue: `)
+	answer, ok := readLine(os.Stdin)
+	switch {
+	case !ok:
+		// Such as /dev/null, which passes for a terminal above
+		fmt.Fprintln(os.Stderr)
+		return errors.New("no answer on stdin, aborting; pass --yes to run anyway")
+	case strings.TrimSpace(answer) != "yes":
+		return errors.New("not confirmed, aborting")
+	}
+	return nil
+}
+
+// readLine reads a line from f a byte at a time, so that nothing past it is
+// taken from the input forward_stdin passes on to the commands. It reports
+// false when f ends before a newline.
+func readLine(f *os.File) (string, bool) {
+	var b strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := f.Read(buf)
+		if n == 0 || err != nil {
+			return b.String(), false
+		}
+		if buf[0] == '\n' {
+			return b.String(), true
+		}
+		b.WriteByte(buf[0])
+	}
+}
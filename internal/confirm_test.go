@@ -0,0 +1,61 @@
+package multirun
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withStdin runs fn with os.Stdin reading input from a pipe.
+func withStdin(t *testing.T, input string, fn func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.WriteString(w, input)
+		w.Close()
+	}()
+	saved := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = saved }()
+	fn()
+}
+
+func TestConfirmNeedsTerminal(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	const instr = `{"commands": [{"path": "rec.sh", "tag": "drop", "args": ["drop"]}], "jobs": 1, "require_confirm": true}`
+	var code int
+	var stderr string
+	withStdin(t, "yes\n", func() { code, _, stderr = mainRun(t, dir, instr) })
+	if code == 0 || !strings.Contains(stderr, "stdin is not a terminal") {
+		t.Errorf("exit %d, stderr %q, want a refusal without a terminal", code, stderr)
+	}
+	if got := recorded(t, dir); len(got) != 0 {
+		t.Fatalf("ran %v without confirmation", got)
+	}
+	withStdin(t, "", func() { code, _, stderr = mainRun(t, dir, instr, "--yes") })
+	if code != 0 || len(recorded(t, dir)) != 1 {
+		t.Errorf("exit %d, stderr %q, want --yes to run without asking", code, stderr)
+	}
+}
+
+func TestReadLineStopsAtNewline(t *testing.T) {
+	withStdin(t, "yes\nfor the command\n", func() {
+		if line, ok := readLine(os.Stdin); line != "yes" || !ok {
+			t.Errorf("readLine = %q, %t, want yes", line, ok)
+		}
+		rest, _ := io.ReadAll(os.Stdin)
+		if string(rest) != "for the command\n" {
+			t.Errorf("left %q on stdin, want the rest of the input", rest)
+		}
+	})
+	withStdin(t, "ye", func() {
+		if _, ok := readLine(os.Stdin); ok {
+			t.Error("readLine reported a line at EOF without a newline")
+		}
+	})
+}
@@ -21,7 +21,10 @@ runfiles_export_envvars
 """
 
 CommandInfo = provider(
-    fields = ["description"],
+    fields = {
+        "description": "A string printed for the command during multiruns, also its tag",
+        "settings": "A dict of further instructions fields for the command, such as needs or retries",
+    },
     doc = "Information about commands used by their multirun.",
 )
 
@@ -0,0 +1,104 @@
+package multirun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// -----------------------------------------------------------------------------
+// Detached runs
+// -----------------------------------------------------------------------------
+
+// detach starts every command in the background, in its own session, and
+// returns without waiting for them. Each command's pid and tag are written
+// to pidFile as a "<pid> <tag>" line for --stop. Output goes to log_dir when
+// set and straight to multirun's stdout and stderr otherwise, since nothing
+// stays behind to copy it. Nothing stays behind to wait on the commands
+// either, which is why newRunner refuses needs, before_all and lock_file
+// with --detach. It returns the exit code for multirun.
+func (rn *runner) detach(pidFile string) int {
+	f, err := os.Create(pidFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "multirun: --pid-file:", err)
+		return 1
+	}
+	defer f.Close()
+	prepareCgroups(rn.instr.Commands)
+
+	code := 0
+	for _, i := range rn.graph.order() {
+		blob := rn.instr.Commands[i]
+		cio := &commandIO{consoleMu: &rn.mu, secrets: rn.secrets}
+		cmd, _, err := launchCommand(context.Background(), blob, rn.extraArgs, cio)
+		var log *os.File
+		if err == nil {
+			log, err = openLog(rn.instr.LogDir, i, blob.Tag, 0)
+		}
+		if err == nil {
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if log != nil {
+				cmd.Stdout, cmd.Stderr = log, log
+			}
+			detachProcess(cmd)
+			err = cmd.Start()
+		}
+		cio.close()
+		if log != nil {
+			log.Close()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		setNice(blob.Tag, cmd.Process.Pid, blob.Nice)
+		setAffinity(blob.Tag, cmd.Process.Pid, blob.CpuAffinity)
+		debugf("%s: detached pid %d", blob.Tag, cmd.Process.Pid)
+		fmt.Fprintf(f, "%d %s\n", cmd.Process.Pid, blob.Tag)
+		cmd.Process.Release()
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "multirun: --pid-file:", err)
+		return 1
+	}
+	return code
+}
+
+// stopDetached sends sig to every command listed in a --detach pid file,
+// then removes the file. Commands that already exited are reported but do
+// not make it fail.
+func stopDetached(pidFile string, sig syscall.Signal) error {
+	f, err := os.Open(pidFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		field, tag, _ := strings.Cut(line, " ")
+		pid, err := strconv.Atoi(field)
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("%s:%d: bad pid %q", pidFile, n, field)
+		}
+		if err := signalDetached(pid, sig); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: %s (pid %d): %v\n", tag, pid, err)
+			continue
+		}
+		debugf("%s: sent %v to pid %d", tag, sig, pid)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(pidFile)
+}
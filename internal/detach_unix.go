@@ -0,0 +1,23 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachProcess starts cmd in a session of its own, so it outlives
+// multirun's terminal and --stop can signal everything it started.
+func detachProcess(cmd *exec.Cmd) {
+	// Keep what launchCommand set up, such as the cgroup to start in
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+}
+
+// signalDetached sends sig to the process group led by pid.
+func signalDetached(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
@@ -0,0 +1,97 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDetachAndStop(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"serve.sh": "exec sleep 30"})
+	instr := filepath.Join(dir, "instr.json")
+	if err := os.WriteFile(instr, []byte(`{"commands": [
+  {"path": "serve.sh", "tag": "a", "args": [], "env": {}},
+  {"path": "serve.sh", "tag": "b", "args": [], "env": {}}
+]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "pids")
+	if code := Main([]string{instr, "--runfiles-root=" + dir, "--detach", "--pid-file=" + pidFile, "--"}); code != 0 {
+		t.Fatalf("--detach exited with %d", code)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pids []int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		field, tag, _ := strings.Cut(line, " ")
+		pid, err := strconv.Atoi(field)
+		if err != nil || (tag != "a" && tag != "b") {
+			t.Fatalf("bad pid file line %q", line)
+		}
+		pids = append(pids, pid)
+	}
+	if len(pids) != 2 {
+		t.Fatalf("pid file lists %d commands, want 2:\n%s", len(pids), data)
+	}
+	for _, pid := range pids {
+		// The detached commands are still this process's children
+		var ws syscall.WaitStatus
+		if got, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err != nil || got != 0 {
+			t.Fatalf("pid %d is not running: %v", pid, err)
+		}
+	}
+
+	if code := Main([]string{instr, "--runfiles-root=" + dir, "--stop", "--pid-file=" + pidFile, "--"}); code != 0 {
+		t.Fatalf("--stop exited with %d", code)
+	}
+	for _, pid := range pids {
+		exited := make(chan syscall.WaitStatus)
+		go func() {
+			var ws syscall.WaitStatus
+			syscall.Wait4(pid, &ws, 0, nil)
+			exited <- ws
+		}()
+		select {
+		case ws := <-exited:
+			if !ws.Signaled() || ws.Signal() != syscall.SIGINT {
+				t.Errorf("pid %d ended with %v, want SIGINT", pid, ws)
+			}
+		case <-time.After(5 * time.Second):
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("pid %d still running after --stop", pid)
+		}
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("--stop left the pid file behind: %v", err)
+	}
+}
+
+func TestDetachRefusesWaiting(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	for name, extra := range map[string]string{
+		"needs":      `"commands": [{"path": "ok.sh", "tag": "a"}, {"path": "ok.sh", "tag": "b", "needs": ["a"]}]`,
+		"before_all": `"commands": [{"path": "ok.sh", "tag": "a"}], "before_all": {"path": "ok.sh", "tag": "setup"}`,
+		"lock_file":  `"commands": [{"path": "ok.sh", "tag": "a"}], "lock_file": "` + filepath.Join(dir, "lock") + `"`,
+	} {
+		instr := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(instr, []byte("{"+extra+"}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var code int
+		stderr := capture(t, &os.Stderr, func() {
+			code = Main([]string{instr, "--runfiles-root=" + dir, "--detach", "--pid-file=" + filepath.Join(dir, "pids"), "--"})
+		})
+		if code == 0 || !strings.Contains(stderr, "--detach cannot be combined with "+name) {
+			t.Errorf("%s: exit code %d, stderr %q; want it refused", name, code, stderr)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package multirun
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detachProcess starts cmd in a process group of its own, so console
+// interrupts aimed at multirun's group do not reach it.
+func detachProcess(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// signalDetached kills pid: Windows cannot deliver other signals.
+func signalDetached(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,176 @@
+package multirun
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Environment files
+// -----------------------------------------------------------------------------
+
+// parseEnvFile reads KEY=VALUE lines from a dotenv-style file. Blank lines
+// and lines starting with '#' are ignored, an optional "export " prefix is
+// accepted, and values may be double-quoted (with Go escapes) or
+// single-quoted (taken literally).
+func parseEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validEnvKey(key) {
+			return nil, fmt.Errorf("%s:%d: malformed line, expected KEY=VALUE", path, n)
+		}
+		value, err := unquoteEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func unquoteEnvValue(v string) (string, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+	switch v[0] {
+	case '"':
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("bad double-quoted value %s", v)
+		}
+		return s, nil
+	case '\'':
+		if len(v) < 2 || v[len(v)-1] != '\'' {
+			return "", fmt.Errorf("unterminated single-quoted value %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// mergeEnvFile loads the env file at path into blob.Env, keeping inline env
+// entries over the ones from the file.
+func mergeEnvFile(blob *Command, path string) error {
+	fileEnv, err := parseEnvFile(path)
+	if err != nil {
+		return err
+	}
+	if blob.Env == nil {
+		blob.Env = map[string]string{}
+	}
+	for k, v := range fileEnv {
+		if _, ok := blob.Env[k]; !ok {
+			blob.Env[k] = v
+		}
+	}
+	return nil
+}
+
+// resolveEnvFile resolves blob's env_file through runfiles and merges it
+// into blob.Env. It does nothing when no env_file is set.
+func resolveEnvFile(r resolver, workspace string, blob *Command) error {
+	if blob.EnvFile == "" {
+		return nil
+	}
+	p, err := scriptPath(r, workspace, blob.EnvFile)
+	if err != nil {
+		return err
+	}
+	return mergeEnvFile(blob, p)
+}
+
+// applyEnvOverrides sets the --env and then the --env-for entries in
+// blob.Env, over what the instructions file gave it.
+func applyEnvOverrides(blob *Command, global, forTag map[string]string) {
+	if len(global) == 0 && len(forTag) == 0 {
+		return
+	}
+	if blob.Env == nil {
+		blob.Env = map[string]string{}
+	}
+	for k, v := range global {
+		blob.Env[k] = v
+	}
+	for k, v := range forTag {
+		blob.Env[k] = v
+	}
+}
+
+// inheritEnvTo gives blob the top-level inherit_env settings it does not
+// set itself.
+func (instr *Instructions) inheritEnvTo(blob *Command) {
+	if blob.InheritEnv == nil {
+		blob.InheritEnv = instr.InheritEnv
+	}
+	if blob.InheritEnvKeys == nil {
+		blob.InheritEnvKeys = instr.InheritEnvKeys
+	}
+}
+
+// inherits reports whether blob gets multirun's value of the variable key:
+// always, unless inherit_env is false and key is not in inherit_env_keys.
+func (blob Command) inherits(key string) bool {
+	if blob.InheritEnv == nil || *blob.InheritEnv {
+		return true
+	}
+	return slices.ContainsFunc(blob.InheritEnvKeys, func(k string) bool {
+		// Windows variable names ignore case: Path is PATH
+		return k == key || runtime.GOOS == "windows" && strings.EqualFold(k, key)
+	})
+}
+
+// commandEnv returns the environment blob runs with: multirun's own, as
+// far as blob inherits it, with blob.Env laid over it, one entry per key,
+// sorted.
+func commandEnv(blob Command) []string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		// Windows has hidden variables such as "=C:=C:\dir": the key
+		// starts after the first character
+		if i := strings.IndexByte(kv[min(1, len(kv)):], '='); i >= 0 && blob.inherits(kv[:i+1]) {
+			env[kv[:i+1]] = kv[i+2:]
+		}
+	}
+	for k, v := range blob.Env {
+		env[k] = v
+	}
+	return flattenEnv(env)
+}
@@ -0,0 +1,122 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "test.env")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseEnvFile(t *testing.T) {
+	p := writeEnvFile(t, `
+# comment
+PLAIN=value
+export EXPORTED=yes
+  SPACED = padded  
+DOUBLE="a\tb \"q\""
+SINGLE='$NOT_EXPANDED \n'
+EMPTY=
+`)
+	got, err := parseEnvFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"PLAIN":    "value",
+		"EXPORTED": "yes",
+		"SPACED":   "padded",
+		"DOUBLE":   "a\tb \"q\"",
+		"SINGLE":   `$NOT_EXPANDED \n`,
+		"EMPTY":    "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEnvFile = %q, want %q", got, want)
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	for _, content := range []string{
+		"NO_EQUALS\n",
+		"1BAD=x\n",
+		"BAD-KEY=x\n",
+		"UNTERMINATED='x\n",
+		"BAD_QUOTE=\"x\n",
+	} {
+		if _, err := parseEnvFile(writeEnvFile(t, content)); err == nil {
+			t.Errorf("parseEnvFile(%q): expected an error", content)
+		}
+	}
+}
+
+func TestMergeEnvFileKeepsInlineEnv(t *testing.T) {
+	blob := Command{Env: map[string]string{"A": "inline"}}
+	if err := mergeEnvFile(&blob, writeEnvFile(t, "A=file\nB=file\n")); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"A": "inline", "B": "file"}; !reflect.DeepEqual(blob.Env, want) {
+		t.Errorf("env = %v, want %v", blob.Env, want)
+	}
+}
+
+func TestCommandEnvSorted(t *testing.T) {
+	t.Setenv("MULTIRUN_TEST_B", "outer")
+	env := commandEnv(Command{Env: map[string]string{"MULTIRUN_TEST_B": "inner", "MULTIRUN_TEST_A": "a"}})
+	if !slices.IsSorted(env) {
+		t.Error("env is not sorted")
+	}
+	if !slices.Contains(env, "MULTIRUN_TEST_B=inner") || slices.Contains(env, "MULTIRUN_TEST_B=outer") {
+		t.Errorf("env = %q, want one MULTIRUN_TEST_B with the command's value", env)
+	}
+}
+
+func TestPrintEnv(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"x.sh": "exit 0"})
+	code, stdout, _ := mainRun(t, dir, `{"commands": [{"path": "x.sh", "tag": "x", "env": {"ZZ": "1"}}], "jobs": 1}`, "--print-env=x")
+	if code != 0 || !strings.Contains(stdout, "ZZ=1\n") {
+		t.Errorf("exit %d, stdout %q, want ZZ=1 printed", code, stdout)
+	}
+}
+
+func TestInheritEnv(t *testing.T) {
+	t.Setenv("MULTIRUN_TEST_KEEP", "1")
+	t.Setenv("MULTIRUN_TEST_DROP", "1")
+	no := false
+	instr := Instructions{InheritEnv: &no, InheritEnvKeys: []string{"MULTIRUN_TEST_KEEP"}}
+	blob := Command{Env: map[string]string{"OWN": "1"}}
+	instr.inheritEnvTo(&blob)
+	env := commandEnv(blob)
+	if want := []string{"MULTIRUN_TEST_KEEP=1", "OWN=1"}; !slices.Equal(env, want) {
+		t.Errorf("env = %q, want %q", env, want)
+	}
+
+	yes := true
+	blob = Command{InheritEnv: &yes}
+	instr.inheritEnvTo(&blob)
+	if env := commandEnv(blob); !slices.Contains(env, "MULTIRUN_TEST_DROP=1") {
+		t.Error("a command's inherit_env did not override the top-level setting")
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	blob := Command{Env: map[string]string{"A": "file", "B": "file", "C": "file"}}
+	applyEnvOverrides(&blob, map[string]string{"A": "env", "B": "env"}, map[string]string{"B": "env-for"})
+	if want := map[string]string{"A": "env", "B": "env-for", "C": "file"}; !reflect.DeepEqual(blob.Env, want) {
+		t.Errorf("env = %v, want %v", blob.Env, want)
+	}
+	var empty Command
+	applyEnvOverrides(&empty, nil, map[string]string{"X": "1"})
+	if empty.Env["X"] != "1" {
+		t.Errorf("env = %v, want X set on a command without env", empty.Env)
+	}
+}
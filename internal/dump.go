@@ -0,0 +1,73 @@
+package multirun
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Effective instructions
+// -----------------------------------------------------------------------------
+
+// effectiveInstructions is what --dump-effective prints: the instructions
+// as multirun will run them, plus which settings the command line changed.
+type effectiveInstructions struct {
+	Instructions
+	// Overrides maps each setting changed on the command line to the
+	// flag that changed it.
+	Overrides map[string]string `json:"_overrides,omitempty"`
+}
+
+// cliOverrides lists the instructions settings that opts and the extra
+// command-line args change, keyed like the dumped JSON.
+func cliOverrides(opts *options, extraArgs []string) map[string]string {
+	out := map[string]string{}
+	if opts.jobs >= 0 {
+		out["jobs"] = "--jobs"
+	}
+	if opts.keepGoing.set {
+		out["keep_going"] = "--keep-going"
+	}
+	if opts.buffer.set {
+		out["buffer_output"] = "--buffer"
+	}
+	if opts.maxFailures >= 0 {
+		out["max_failures"] = "--max-failures"
+	}
+	if len(opts.only) > 0 {
+		out["commands"] = "--only"
+	}
+	if opts.rerunFailed != "" {
+		out["commands"] = "--rerun-failed"
+	}
+	if len(extraArgs) > 0 {
+		out["default_extra_args"] = "extra args"
+	}
+	for key := range opts.env {
+		out["commands[*].env."+key] = "--env"
+	}
+	for tag, env := range opts.envFor {
+		for key := range env {
+			out["commands["+tag+"].env."+key] = "--env-for"
+		}
+	}
+	for tag := range opts.argsFor {
+		out["commands["+tag+"].args"] = "--args-for"
+	}
+	return out
+}
+
+// dumpEffective writes instr, with extraArgs as its default_extra_args and
+// the overrides noted, to stdout as indented JSON.
+func dumpEffective(instr Instructions, extraArgs commandArgs, overrides map[string]string) error {
+	instr.DefaultExtraArgs = extraArgs.global
+	instr.Commands = append([]Command{}, instr.Commands...)
+	for i, c := range instr.Commands {
+		if tagged := extraArgs.byTag[c.Tag]; len(tagged) > 0 {
+			instr.Commands[i].Args = append(c.Args[:len(c.Args):len(c.Args)], tagged...)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(effectiveInstructions{instr, overrides})
+}
@@ -0,0 +1,50 @@
+package multirun
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDumpEffective(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"x.sh": "exit 0"})
+	code, stdout, stderr := mainRun(t, dir, `{"commands": [{"path": "x.sh", "tag": "x", "args": ["-a"]}], "jobs": 1}`,
+		"--dump-effective", "--jobs=3", "--env=A=1", "--args-for=x=--fast")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	var got struct {
+		Jobs     int `json:"jobs"`
+		Commands []struct {
+			Args []string          `json:"args"`
+			Env  map[string]string `json:"env"`
+		} `json:"commands"`
+		Overrides map[string]string `json:"_overrides"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("%v:\n%s", err, stdout)
+	}
+	if got.Jobs != 3 || !reflect.DeepEqual(got.Commands[0].Args, []string{"-a", "--fast"}) || got.Commands[0].Env["A"] != "1" {
+		t.Errorf("dumped %+v, want the overrides applied", got)
+	}
+	want := map[string]string{
+		"jobs":              "--jobs",
+		"commands[*].env.A": "--env",
+		"commands[x].args":  "--args-for",
+	}
+	if !reflect.DeepEqual(got.Overrides, want) {
+		t.Errorf("_overrides = %v, want %v", got.Overrides, want)
+	}
+}
+
+func TestDumpEffectiveNoOverrides(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"x.sh": "exit 0"})
+	_, stdout, _ := mainRun(t, dir, `{"commands": [{"path": "x.sh", "tag": "x"}], "jobs": 1}`, "--dump-effective")
+	var got map[string]any
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["_overrides"]; ok {
+		t.Errorf("_overrides dumped without any overrides: %v", got["_overrides"])
+	}
+}
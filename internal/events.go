@@ -0,0 +1,65 @@
+package multirun
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Event stream
+// -----------------------------------------------------------------------------
+
+// eventStream writes newline-delimited JSON lifecycle events for tooling.
+// All methods are safe for concurrent use and do nothing on a nil stream.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func openEventStream(fd int) (*eventStream, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+	}
+	return &eventStream{enc: json.NewEncoder(f)}, nil
+}
+
+func (e *eventStream) emit(v any) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(v)
+}
+
+func (e *eventStream) start(tag string) {
+	e.emit(struct {
+		Event string `json:"event"`
+		Tag   string `json:"tag"`
+	}{"start", tag})
+}
+
+func (e *eventStream) output(tag, stream, line string) {
+	e.emit(struct {
+		Event  string `json:"event"`
+		Tag    string `json:"tag"`
+		Stream string `json:"stream"`
+		Line   string `json:"line"`
+	}{"output", tag, stream, line})
+}
+
+func (e *eventStream) exit(tag string, err error, d time.Duration) {
+	e.emit(struct {
+		Event      string `json:"event"`
+		Tag        string `json:"tag"`
+		Code       int    `json:"code"`
+		DurationMs int64  `json:"duration_ms"`
+	}{"exit", tag, exitCodeOf(err), d.Milliseconds()})
+}
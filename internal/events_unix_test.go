@@ -0,0 +1,61 @@
+//go:build unix
+
+package multirun
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestEventsFd(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"hi.sh": "echo hi", "fail.sh": "echo oops >&2; exit 3"})
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	// multirun gets a descriptor of its own, as it would from a shell. It
+	// is left to it to close: the events are read as they were written.
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, _ := mainRun(t, dir, `{"commands": [
+  {"path": "hi.sh", "tag": "hi"},
+  {"path": "fail.sh", "tag": "fail"}
+], "jobs": 1, "keep_going": true}`, fmt.Sprint("--events-fd=", fd))
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	want := []map[string]any{
+		{"event": "start", "tag": "hi"},
+		{"event": "output", "tag": "hi", "stream": "stdout", "line": "hi"},
+		{"event": "exit", "tag": "hi", "code": 0.0},
+		{"event": "start", "tag": "fail"},
+		{"event": "output", "tag": "fail", "stream": "stderr", "line": "oops"},
+		{"event": "exit", "tag": "fail", "code": 3.0},
+	}
+	var got []map[string]any
+	lines := bufio.NewScanner(r)
+	for range want {
+		if !lines.Scan() {
+			t.Fatalf("events end after %v", got)
+		}
+		var e map[string]any
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("%q is not a JSON object: %v", lines.Text(), err)
+		}
+		delete(e, "duration_ms")
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,28 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Inherited file descriptors
+// -----------------------------------------------------------------------------
+
+// openFds checks that every inherit_fds descriptor is open in multirun and
+// returns them as files, in order, for the commands' ExtraFiles: the first
+// is fd 3 in each command, the next fd 4, and so on.
+func openFds(fds []int) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(fds))
+	for _, fd := range fds {
+		if fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package multirun
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestInheritFds(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"fds.sh": "echo to fd 3 >&3; echo to fd 4 >&4"})
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	out, err := os.Create(filepath.Join(dir, "fd4.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	// multirun gets descriptors of its own, as it would from whatever
+	// started it, and the pipe is read no further than what was written
+	var fds []int
+	for _, f := range []*os.File{w, out} {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, fd)
+	}
+
+	res := run(t, dir, Instructions{Commands: []Command{{Path: "fds.sh", Tag: "fds"}}, Jobs: 1, InheritFds: fds})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || line != "to fd 3\n" {
+		t.Errorf("read %q, %v from the first fd, want what the command wrote to fd 3", line, err)
+	}
+	if data, err := os.ReadFile(out.Name()); err != nil || string(data) != "to fd 4\n" {
+		t.Errorf("the second fd's file holds %q, %v, want what the command wrote to fd 4", data, err)
+	}
+}
+
+func TestInheritFdsNotOpen(t *testing.T) {
+	// The highest descriptor the process may have, which is surely unused
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	fd := int(lim.Cur) - 1
+	r := &Runner{RunfilesRoot: t.TempDir()}
+	for _, fds := range [][]int{{fd}, {-1}} {
+		_, err := r.Run(context.Background(), Instructions{Commands: []Command{{Path: "ok.sh", Tag: "ok"}}, InheritFds: fds}, nil)
+		if err == nil || !strings.Contains(err.Error(), "inherit_fds") {
+			t.Errorf("inherit_fds %v: err = %v, want it refused", fds, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package multirun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Fingerprints
+// -----------------------------------------------------------------------------
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintPath is where command i's last successful fingerprint is kept.
+func (rn *runner) fingerprintPath(i int) string {
+	return filepath.Join(rn.instr.StateDir, logFileName(i, rn.instr.Commands[i].Tag, ".sha256"))
+}
+
+// upToDate hashes command i's fingerprint_file and reports whether it
+// matches the hash stored by its last successful run. The hash is kept for
+// saveFingerprint. Without fingerprinting, or with --force, it is false.
+func (rn *runner) upToDate(i int) bool {
+	blob := rn.instr.Commands[i]
+	if blob.FingerprintFile == "" || rn.instr.StateDir == "" || rn.warming {
+		return false
+	}
+	sum, err := hashFile(blob.FingerprintFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %s: fingerprint_file: %v\n", blob.Tag, err)
+		return false
+	}
+	rn.fingerprints[i] = sum
+	if rn.opts.force {
+		return false
+	}
+	stored, err := os.ReadFile(rn.fingerprintPath(i))
+	return err == nil && strings.TrimSpace(string(stored)) == sum
+}
+
+// saveFingerprint stores the hash taken by upToDate once command i succeeded.
+func (rn *runner) saveFingerprint(i int) {
+	if rn.fingerprints[i] == "" || rn.warming {
+		return
+	}
+	if err := os.WriteFile(rn.fingerprintPath(i), []byte(rn.fingerprints[i]+"\n"), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %s: saving fingerprint: %v\n", rn.instr.Commands[i].Tag, err)
+	}
+}
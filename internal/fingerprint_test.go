@@ -0,0 +1,67 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFingerprintSkipsUnchangedInput(t *testing.T) {
+	for _, jobs := range []int{1, 0} {
+		t.Run(fmt.Sprint("jobs=", jobs), func(t *testing.T) {
+			dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+			input := filepath.Join(dir, "input.txt")
+			if err := os.WriteFile(input, []byte("v1"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			instr := Instructions{
+				Commands: []Command{{Path: "rec.sh", Tag: "gen", Args: []string{"gen"}, FingerprintFile: "input.txt"}},
+				Jobs:     jobs,
+				StateDir: t.TempDir(),
+			}
+			for n, tt := range []struct {
+				input string
+				want  []string
+			}{
+				{"", []string{"gen"}},
+				{"", []string{"gen"}},          // unchanged: skipped
+				{"v2", []string{"gen", "gen"}}, // changed: run again
+				{"", []string{"gen", "gen"}},
+			} {
+				if tt.input != "" {
+					if err := os.WriteFile(input, []byte(tt.input), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var res Result
+				capture(t, &os.Stderr, func() { res = run(t, dir, instr) })
+				if res.ExitCode != 0 || res.Commands[0].Status != "succeeded" {
+					t.Fatalf("run %d: exit code %d, status %q", n+1, res.ExitCode, res.Commands[0].Status)
+				}
+				if got := recorded(t, dir); !slices.Equal(got, tt.want) {
+					t.Errorf("after run %d: ran %q, want %q", n+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFingerprintNotSavedOnFailure(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"fail.sh": recorder + "\nexit 1"})
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	instr := Instructions{
+		Commands: []Command{{Path: "fail.sh", Tag: "gen", Args: []string{"gen"}, FingerprintFile: "input.txt"}},
+		Jobs:     1,
+		StateDir: t.TempDir(),
+	}
+	for range 2 {
+		capture(t, &os.Stderr, func() { run(t, dir, instr) })
+	}
+	if got := recorded(t, dir); !slices.Equal(got, []string{"gen", "gen"}) {
+		t.Errorf("ran %q, want the failed command run again", got)
+	}
+}
@@ -0,0 +1,308 @@
+package multirun
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Command-line flags
+// -----------------------------------------------------------------------------
+
+// options holds the multirun flags given after the instructions path.
+type options struct {
+	argsFor tagArgs
+	shuffle bool
+	seed    int64
+	seedSet bool
+
+	allowDuplicateTags bool
+	continueFrom       string
+	eventsFd           int
+	only               stringList
+	prefix             bool
+	color              string
+	verbose            bool
+	runfilesRoot       string
+	tail               int
+	prefixWidth        string
+	failOnEmpty        bool
+	allowComments      bool
+	noFailureSummary   bool
+	report             string
+	watch              stringList
+	lockWait           bool
+	exitCodeFile       string
+	env                envVars
+	envFor             tagEnvVars
+	force              bool
+	maxFailures        int
+	printEnv           string
+	completeTags       bool
+	detach             bool
+	pidFile            string
+	stop               bool
+	rerunFailed        string
+	dumpEffective      bool
+	labels             stringList
+	config             string
+	runDisabled        bool
+	maxOutputRate      int
+	plan               bool
+	collapseRepeats    bool
+	jsonLogs           bool
+	confirm            bool
+	yes                bool
+	jobs               int
+	keepGoing          boolOverride
+	buffer             boolOverride
+	restart            bool
+	highlight          string
+	repeat             int
+	repeatUntilFailure bool
+	noRunfiles         bool
+	outputDir          string
+	stopOnOutput       string
+	maxLineLength      int
+	secretCommand      string
+	warmup             bool
+	warmupCount        int
+}
+
+// tagArgs collects repeated --args-for=TAG=ARG values.
+type tagArgs map[string][]string
+
+func (t tagArgs) String() string { return "" }
+
+func (t tagArgs) Set(v string) error {
+	tag, arg, ok := strings.Cut(v, "=")
+	if !ok || tag == "" {
+		return fmt.Errorf("expected TAG=ARG, got %q", v)
+	}
+	t[tag] = append(t[tag], arg)
+	return nil
+}
+
+// envVars collects repeated --env=KEY=VALUE values.
+type envVars map[string]string
+
+func (e envVars) String() string { return "" }
+
+func (e envVars) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || !validEnvKey(key) {
+		return fmt.Errorf("expected KEY=VALUE, got %q", v)
+	}
+	e[key] = value
+	return nil
+}
+
+// tagEnvVars collects repeated --env-for=TAG=KEY=VALUE values.
+type tagEnvVars map[string]envVars
+
+func (t tagEnvVars) String() string { return "" }
+
+func (t tagEnvVars) Set(v string) error {
+	tag, kv, ok := strings.Cut(v, "=")
+	if !ok || tag == "" {
+		return fmt.Errorf("expected TAG=KEY=VALUE, got %q", v)
+	}
+	if t[tag] == nil {
+		t[tag] = envVars{}
+	}
+	return t[tag].Set(kv)
+}
+
+// boolOverride is a boolean flag overriding an instructions field: it is
+// only applied when given.
+type boolOverride struct {
+	set, value bool
+}
+
+func (b *boolOverride) String() string   { return strconv.FormatBool(b.value) }
+func (b *boolOverride) IsBoolFlag() bool { return true }
+
+func (b *boolOverride) Set(v string) error {
+	x, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	b.set, b.value = true, x
+	return nil
+}
+
+// negatedBool is the --no-X form of a boolOverride.
+type negatedBool struct {
+	b *boolOverride
+}
+
+func (n negatedBool) String() string   { return "" }
+func (n negatedBool) IsBoolFlag() bool { return true }
+
+func (n negatedBool) Set(v string) error {
+	x, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	n.b.set, n.b.value = true, !x
+	return nil
+}
+
+// stringList collects the values of a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func newFlagSet(opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("multirun", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var(opts.argsFor, "args-for", "append ARG only to the command tagged TAG (TAG=ARG, repeatable)")
+	fs.BoolVar(&opts.shuffle, "shuffle", false, "run the commands in a random order")
+	fs.Int64Var(&opts.seed, "seed", 0, "seed for --shuffle (implies --shuffle)")
+	fs.BoolVar(&opts.allowDuplicateTags, "allow-duplicate-tags", false, "accept several commands with the same tag")
+	fs.StringVar(&opts.continueFrom, "continue-from", "", "serial runs: skip the commands before the one tagged TAG")
+	fs.IntVar(&opts.eventsFd, "events-fd", -1, "write newline-delimited JSON lifecycle events to file descriptor N")
+	fs.Var(&opts.only, "only", "run only commands whose tag matches: exact, glob (test-*) or /regex/ (repeatable)")
+	fs.BoolVar(&opts.prefix, "prefix", false, "prefix every output line with the command's [tag]")
+	fs.StringVar(&opts.color, "color", "auto", "color --prefix labels: always, never or auto (when stdout is a terminal)")
+	fs.BoolVar(&opts.verbose, "verbose", false, "log internal diagnostics (path resolution, launches, exits) to stderr")
+	fs.BoolVar(&opts.verbose, "v", false, "shorthand for --verbose")
+	fs.StringVar(&opts.runfilesRoot, "runfiles-root", "", "resolve command paths under DIR instead of Bazel's runfiles")
+	fs.IntVar(&opts.tail, "tail", -1, "buffered runs: print only the last N lines of commands that succeed")
+	fs.StringVar(&opts.prefixWidth, "output-prefix-width", "", "pad --prefix tags to N characters (or auto for the longest tag), truncating longer ones")
+	fs.BoolVar(&opts.failOnEmpty, "fail-on-empty", false, "fail when there are no commands to run, including after --only")
+	fs.BoolVar(&opts.allowComments, "allow-comments", false, "accept // and /* */ comments and trailing commas in instructions files (always on for .json5)")
+	fs.BoolVar(&opts.noFailureSummary, "no-failure-summary", false, "buffered runs: do not repeat failed commands' output at the end")
+	fs.StringVar(&opts.report, "report", "", "write a JSON report of every command's outcome, duration and resource usage to FILE")
+	fs.Var(&opts.watch, "watch", "rerun the commands whenever one of these comma-separated files changes (repeatable)")
+	fs.BoolVar(&opts.lockWait, "lock-wait", false, "wait for lock_file to be released instead of failing")
+	fs.StringVar(&opts.exitCodeFile, "exit-code-file", "", "write a \"<tag> <exit code>\" line per command to FILE after the run")
+	fs.Var(opts.env, "env", "set KEY=VALUE in every command's environment (repeatable)")
+	fs.Var(opts.envFor, "env-for", "set KEY=VALUE only in the environment of the command tagged TAG (TAG=KEY=VALUE, repeatable)")
+	fs.BoolVar(&opts.force, "force", false, "run commands even when their fingerprint_file is unchanged")
+	fs.IntVar(&opts.maxFailures, "max-failures", -1, "stop the run once N commands have failed (0 for no limit); overrides max_failures")
+	fs.StringVar(&opts.printEnv, "print-env", "", "print the environment the command tagged TAG would get, sorted, and exit")
+	fs.BoolVar(&opts.completeTags, "complete-tags", false, "print the instructions file's tags for shell completion and exit")
+	fs.BoolVar(&opts.detach, "detach", false, "start the commands in the background, write their pids to --pid-file and exit")
+	fs.StringVar(&opts.pidFile, "pid-file", "", "file listing the commands started by --detach, for --stop")
+	fs.BoolVar(&opts.stop, "stop", false, "send child_kill_signal to the commands listed in --pid-file and exit")
+	fs.StringVar(&opts.rerunFailed, "rerun-failed", "", "run only the commands that failed in the --report FILE of an earlier run")
+	fs.BoolVar(&opts.dumpEffective, "dump-effective", false, "print the instructions as they would run, after resolution and overrides, as JSON and exit")
+	fs.Var(&opts.labels, "label", "rename the command tagged TAG, or at INDEX, to NEWTAG (TAG=NEWTAG or INDEX=NEWTAG, repeatable)")
+	fs.StringVar(&opts.config, "config", "", "patch the instructions with the overlay FILE: its fields win, its commands patch those with the same tag")
+	fs.BoolVar(&opts.runDisabled, "run-disabled", false, "run commands marked disabled too")
+	fs.IntVar(&opts.maxOutputRate, "max-output-rate", 0, "write at most N lines of command output per second, dropping lines once too far behind")
+	fs.BoolVar(&opts.plan, "plan", false, "print the waves the commands would run in, with the jobs and group limits that apply, and exit")
+	fs.BoolVar(&opts.collapseRepeats, "collapse-repeats", false, "print runs of identical consecutive output lines once, as \"<line> (xN)\"")
+	fs.BoolVar(&opts.jsonLogs, "json-logs", false, "write every line of command output to stdout as a JSON object with ts, tag, stream and message")
+	fs.BoolVar(&opts.confirm, "confirm", false, "list the commands and ask for \"yes\" on the terminal before running them, as require_confirm does")
+	fs.BoolVar(&opts.yes, "yes", false, "run without asking, even with require_confirm or --confirm")
+	fs.IntVar(&opts.jobs, "jobs", -1, "run at most N commands at once (0 for no limit, 1 for serial); overrides jobs and jobs_spec")
+	fs.Var(&opts.keepGoing, "keep-going", "keep running the other commands after one fails; overrides keep_going (--keep-going=false to turn it off)")
+	fs.Var(&opts.buffer, "buffer", "buffer each command's output until it exits; overrides buffer_output")
+	fs.Var(negatedBool{&opts.buffer}, "no-buffer", "stream output as it comes; overrides buffer_output")
+	fs.BoolVar(&opts.restart, "restart", false, "run every command, ignoring what checkpoint_file says earlier runs completed")
+	fs.StringVar(&opts.highlight, "highlight", "", "flag output lines matching the regular expression RE and count them per command")
+	fs.IntVar(&opts.repeat, "repeat", 1, "run the whole command set N times and summarize how many iterations passed")
+	fs.BoolVar(&opts.repeatUntilFailure, "repeat-until-failure", false, "with --repeat, stop after the first failing iteration; without it, repeat until one fails")
+	fs.BoolVar(&opts.noRunfiles, "no-runfiles", false, "for testing: take command paths as plain paths instead of runfiles paths; refused when runfiles are available")
+	fs.StringVar(&opts.outputDir, "output-dir", "", "write each command's stdout to DIR/<tag>.out and its stderr to DIR/<tag>.err")
+	fs.StringVar(&opts.stopOnOutput, "stop-on-output", "", "stop the whole run, as a failure, once a command prints a line matching the regular expression RE")
+	fs.IntVar(&opts.maxLineLength, "max-line-length", 0, "truncate output lines longer than N bytes where multirun handles them line by line (0: no limit)")
+	fs.StringVar(&opts.secretCommand, "secret-command", "", "fetch env values of the form @secret:NAME by running PATH with NAME on stdin; it prints the value")
+	fs.BoolVar(&opts.warmup, "warmup", false, "run the commands once before the real run, to prime caches; its results do not count")
+	fs.IntVar(&opts.warmupCount, "warmup-count", 0, "run the commands N times before the real run, as --warmup does once")
+	return fs
+}
+
+// parseArgs splits the arguments following the instructions path into
+// multirun's own flags and the extra args forwarded to the commands.
+//
+// Multirun flags are only recognized before a "--" separator, and only when
+// every argument up to it is one: "-v --jobs=2 -- -x" sets two flags and
+// forwards -x, while "-v --config=x" and "foo -- bar" are forwarded to the
+// commands untouched, as they were before multirun had flags of its own.
+func parseArgs(args []string) (*options, []string, error) {
+	opts := &options{argsFor: tagArgs{}, env: envVars{}, envFor: tagEnvVars{}}
+	fs := newFlagSet(opts)
+
+	n, ok := flagPrefix(fs, args)
+	if !ok {
+		return opts, args, nil
+	}
+	if err := fs.Parse(args[:n]); err != nil {
+		return nil, nil, err
+	}
+	repeatSet := false
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "seed":
+			opts.seedSet = true
+			opts.shuffle = true
+		case "repeat":
+			repeatSet = true
+		}
+	})
+	if opts.repeatUntilFailure && !repeatSet {
+		// No bound: repeat until an iteration fails
+		opts.repeat = 0
+	}
+	return opts, args[n+1:], nil
+}
+
+// flagPrefix returns the index of the first "--" in args when every argument
+// before it is a multirun flag, with its value if it takes one.
+func flagPrefix(fs *flag.FlagSet, args []string) (int, bool) {
+	n := 0
+	for n < len(args) {
+		a := args[n]
+		if a == "--" {
+			return n, true
+		}
+		name, hasValue := flagName(a)
+		f := fs.Lookup(name)
+		if f == nil {
+			return 0, false
+		}
+		n++
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if !hasValue {
+			n++
+		}
+	}
+	return 0, false
+}
+
+// flagName returns the flag name of a "-name", "--name" or "--name=value"
+// argument, or "" if a is not flag-shaped.
+func flagName(a string) (string, bool) {
+	if len(a) < 2 || a[0] != '-' {
+		return "", false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+	name, _, hasValue := strings.Cut(name, "=")
+	return name, hasValue
+}
+
+// commandArgs holds the extra arguments appended to each command: global ones
+// (from the command line, else default_extra_args) go to every command,
+// tagged ones only to the command with that tag.
+type commandArgs struct {
+	global []string
+	byTag  map[string][]string
+}
+
+func (a commandArgs) forTag(tag string) []string {
+	out := append([]string{}, a.global...)
+	return append(out, a.byTag[tag]...)
+}
@@ -0,0 +1,98 @@
+package multirun
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgsPassThrough(t *testing.T) {
+	for _, args := range [][]string{
+		{"-v"},
+		{"--config=x"},
+		{"--verbose", "--jobs", "2"},
+		{"--env=A=B", "--force", "--stop"},
+		{"foo", "--", "bar"},
+		{"-v", "--not-a-multirun-flag", "--", "x"},
+	} {
+		opts, rest, err := parseArgs(args)
+		if err != nil {
+			t.Fatalf("parseArgs(%q): %v", args, err)
+		}
+		if !reflect.DeepEqual(rest, args) {
+			t.Errorf("parseArgs(%q) forwarded %q, want all args", args, rest)
+		}
+		if opts.verbose || opts.config != "" || opts.jobs != -1 || opts.force || opts.stop || len(opts.env) != 0 {
+			t.Errorf("parseArgs(%q) set multirun flags: %+v", args, opts)
+		}
+	}
+}
+
+func TestParseArgsFlags(t *testing.T) {
+	opts, rest, err := parseArgs([]string{"-v", "--config", "overlay.json", "--jobs=2", "--args-for=unit=--test-filter=Foo", "--", "-v", "--config=x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.verbose || opts.config != "overlay.json" || opts.jobs != 2 {
+		t.Errorf("flags not applied: %+v", opts)
+	}
+	if got := opts.argsFor["unit"]; !reflect.DeepEqual(got, []string{"--test-filter=Foo"}) {
+		t.Errorf("args for unit = %q", got)
+	}
+	if want := []string{"-v", "--config=x"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("forwarded %q, want %q", rest, want)
+	}
+}
+
+func TestParseArgsSeparatorOnly(t *testing.T) {
+	_, rest, err := parseArgs([]string{"--", "--", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--", "x"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("forwarded %q, want %q", rest, want)
+	}
+}
+
+func TestParseArgsBadValue(t *testing.T) {
+	if _, _, err := parseArgs([]string{"--jobs=many", "--"}); err == nil {
+		t.Error("expected an error for --jobs=many")
+	}
+}
+
+func TestParseArgsEnvFlags(t *testing.T) {
+	args := []string{"--env=A=1", "--env-for=unit=B=2", "--args-for=unit=-x"}
+	opts, rest, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.env) != 0 || len(opts.envFor) != 0 || len(opts.argsFor) != 0 || !reflect.DeepEqual(rest, args) {
+		t.Errorf("without --, %q was not passed through: %+v, %q", args, opts, rest)
+	}
+
+	opts, rest, err = parseArgs(append(args, "--"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.env["A"] != "1" || opts.envFor["unit"]["B"] != "2" || !reflect.DeepEqual(opts.argsFor["unit"], []string{"-x"}) || len(rest) != 0 {
+		t.Errorf("flags before -- not applied: %+v, %q", opts, rest)
+	}
+}
+
+func TestParseArgsLifecycleFlags(t *testing.T) {
+	for _, args := range [][]string{{"--force"}, {"--stop"}, {"--config", "x"}, {"--detach", "--pid-file=p"}} {
+		opts, rest, err := parseArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.force || opts.stop || opts.detach || opts.config != "" || !reflect.DeepEqual(rest, args) {
+			t.Errorf("without --, %q was not passed through", args)
+		}
+	}
+	opts, _, err := parseArgs([]string{"--force", "--stop", "--config", "x", "--"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.force || !opts.stop || opts.config != "x" {
+		t.Errorf("flags before -- not applied: %+v", opts)
+	}
+}
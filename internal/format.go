@@ -0,0 +1,88 @@
+package multirun
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Output formats
+// -----------------------------------------------------------------------------
+
+// outputFormatter frames each command's console output for a log viewer.
+// StartCommand and EndCommand return marker lines ("" for none) printed
+// around a command's output; Line adapts one output line.
+type outputFormatter interface {
+	StartCommand(tag string) string
+	Line(line string) string
+	EndCommand(tag string) string
+}
+
+// outputFormats lists the output_format values.
+var outputFormats = map[string]outputFormatter{
+	"plain":  plainFormat{},
+	"github": githubFormat{},
+	"gitlab": gitlabFormat{},
+}
+
+// newOutputFormatter returns the formatter named by output_format.
+func newOutputFormatter(name string) (outputFormatter, error) {
+	if name == "" {
+		name = "plain"
+	}
+	f, ok := outputFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output_format %q (want plain, github or gitlab)", name)
+	}
+	return f, nil
+}
+
+// plainFormat leaves the output as it is.
+type plainFormat struct{}
+
+func (plainFormat) StartCommand(string) string { return "" }
+func (plainFormat) Line(line string) string    { return line }
+func (plainFormat) EndCommand(string) string   { return "" }
+
+// githubFormat folds each command into a GitHub Actions log group.
+type githubFormat struct{}
+
+func (githubFormat) StartCommand(tag string) string { return "::group::" + tag }
+func (githubFormat) Line(line string) string        { return line }
+func (githubFormat) EndCommand(string) string       { return "::endgroup::" }
+
+// gitlabFormat folds each command into a collapsed GitLab CI section.
+type gitlabFormat struct{}
+
+// gitlabSectionName keeps section names to the characters GitLab accepts.
+var gitlabSectionName = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func (gitlabFormat) StartCommand(tag string) string {
+	return fmt.Sprintf("\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s",
+		time.Now().Unix(), gitlabSectionName.ReplaceAllString(tag, "_"), tag)
+}
+
+func (gitlabFormat) Line(line string) string { return line }
+
+func (gitlabFormat) EndCommand(tag string) string {
+	return fmt.Sprintf("\x1b[0Ksection_end:%d:%s\r\x1b[0K",
+		time.Now().Unix(), gitlabSectionName.ReplaceAllString(tag, "_"))
+}
+
+// formatLines runs every line of text through f.Line.
+func formatLines(f outputFormatter, text string) string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = f.Line(l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// printMarker prints a formatter marker line, if there is one.
+func (rn *runner) printMarker(marker string) {
+	if marker != "" {
+		rn.println(marker)
+	}
+}
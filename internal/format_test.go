@@ -0,0 +1,42 @@
+package multirun
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewOutputFormatter(t *testing.T) {
+	for _, name := range []string{"", "plain", "github", "gitlab"} {
+		if _, err := newOutputFormatter(name); err != nil {
+			t.Errorf("newOutputFormatter(%q): %v", name, err)
+		}
+	}
+	if _, err := newOutputFormatter("teamcity"); err == nil {
+		t.Error("an unknown output_format was accepted")
+	}
+}
+
+func TestGitlabSectionName(t *testing.T) {
+	start := gitlabFormat{}.StartCommand("api server:1")
+	if !strings.Contains(start, ":api_server_1[collapsed=true]") || !strings.HasSuffix(start, "api server:1") {
+		t.Errorf("start marker = %q, want a sanitized section name and the tag as title", start)
+	}
+	if end := (gitlabFormat{}).EndCommand("api server:1"); !strings.Contains(end, ":api_server_1\r") {
+		t.Errorf("end marker = %q, want the same section name", end)
+	}
+}
+
+func TestGithubGroups(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"hello.sh": "echo hello"})
+	instr := Instructions{
+		Commands:     []Command{{Path: "hello.sh", Tag: "hello"}},
+		Jobs:         1,
+		BufferOutput: true,
+		OutputFormat: "github",
+	}
+	stdout := capture(t, &os.Stdout, func() { run(t, dir, instr) })
+	if !strings.Contains(stdout, "::group::hello\n") || !strings.Contains(stdout, "hello\n::endgroup::") {
+		t.Errorf("stdout = %q, want the output inside a GitHub group", stdout)
+	}
+}
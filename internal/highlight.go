@@ -0,0 +1,56 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Highlighting
+// -----------------------------------------------------------------------------
+
+// highlightMarker stands in front of lines matching --highlight when colors
+// are off.
+const highlightMarker = ">>> "
+
+// markLine flags line, from command i, when it matches --highlight: in
+// reverse video with colors on, else behind highlightMarker. Matches are
+// counted for printHighlights.
+func (rn *runner) markLine(i int, line string) string {
+	if rn.highlight == nil || !rn.highlight.MatchString(line) {
+		return line
+	}
+	rn.matches[i].Add(1)
+	if rn.colors {
+		return "\x1b[7m" + line + "\x1b[0m"
+	}
+	return highlightMarker + line
+}
+
+// markLines applies markLine to every line of text.
+func (rn *runner) markLines(i int, text string) string {
+	if rn.highlight == nil {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for j, l := range lines {
+		lines[j] = rn.markLine(i, l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// printHighlights prints, after the run, how many lines of each command
+// matched --highlight, and resets the counts for the next --repeat
+// iteration.
+func (rn *runner) printHighlights(res *runResult) {
+	if rn.highlight == nil {
+		return
+	}
+	for i, c := range rn.instr.Commands {
+		if res.state[i] == statePending || res.state[i] == stateSkipped {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "multirun: %s: %d lines matched --highlight\n", c.Tag, rn.matches[i].Swap(0))
+	}
+}
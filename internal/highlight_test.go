@@ -0,0 +1,66 @@
+package multirun
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMarkLine(t *testing.T) {
+	rn := &runner{highlight: regexp.MustCompile(`ERROR|panic:`), matches: make([]atomic.Int64, 2)}
+	for _, tt := range []struct {
+		colors     bool
+		line, want string
+	}{
+		{false, "all good", "all good"},
+		{false, "ERROR: disk full", ">>> ERROR: disk full"},
+		{false, "panic: oops", ">>> panic: oops"},
+		{true, "ERROR: disk full", "\x1b[7mERROR: disk full\x1b[0m"},
+		{true, "error: lower case", "error: lower case"},
+	} {
+		rn.colors = tt.colors
+		if got := rn.markLine(1, tt.line); got != tt.want {
+			t.Errorf("colors %t: markLine(%q) = %q, want %q", tt.colors, tt.line, got, tt.want)
+		}
+	}
+	if n := rn.matches[1].Load(); n != 3 {
+		t.Errorf("counted %d matches, want 3", n)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"noisy.sh": `echo start; echo "ERROR one"; echo "ERROR two"`,
+		"fine.sh":  "echo fine",
+		"fail.sh":  "exit 1",
+	})
+	for _, jobs := range []int{1, 0} {
+		instr := fmt.Sprintf(`{"commands": [
+  {"path": "noisy.sh", "tag": "noisy"},
+  {"path": "fine.sh", "tag": "fine"},
+  {"path": "fail.sh", "tag": "fail"},
+  {"path": "fine.sh", "tag": "skipped", "needs": ["fail"]}
+], "jobs": %d, "buffer_output": true}`, jobs)
+		_, stdout, stderr := mainRun(t, dir, instr, "--highlight=ERROR")
+		for _, want := range []string{"start\n>>> ERROR one\n>>> ERROR two\n", "fine\n"} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("jobs %d: stdout %q lacks %q", jobs, stdout, want)
+			}
+		}
+		// The summary leaves out the commands that never ran
+		for _, want := range []string{
+			"multirun: noisy: 2 lines matched --highlight\n",
+			"multirun: fine: 0 lines matched --highlight\n",
+			"multirun: fail: 0 lines matched --highlight\n",
+		} {
+			if !strings.Contains(stderr, want) {
+				t.Errorf("jobs %d: stderr %q lacks %q", jobs, stderr, want)
+			}
+		}
+		if strings.Contains(stderr, "skipped: 0 lines matched") {
+			t.Errorf("jobs %d: stderr %q counts a command that never ran", jobs, stderr)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Idle timeout
+// -----------------------------------------------------------------------------
+
+// idleTimer kills a command once it has produced no output for d. It is
+// written to alongside the command's output, every write restarting the
+// countdown.
+type idleTimer struct {
+	mu    sync.Mutex
+	d     time.Duration
+	t     *time.Timer
+	fired bool
+}
+
+func (w *idleTimer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.t != nil && !w.fired {
+		w.t.Reset(w.d)
+	}
+	return len(p), nil
+}
+
+// arm starts the countdown for blob's started process p. It does nothing on
+// a nil idleTimer.
+func (w *idleTimer) arm(blob Command, p *os.Process) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.t = time.AfterFunc(w.d, func() {
+		w.mu.Lock()
+		w.fired = true
+		w.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "multirun: %s: no output for %s, killing\n", blob.Tag, w.d)
+		sig, grace := blob.timeoutKill()
+		terminate(p, sig, grace)
+	})
+}
+
+// stop cancels the countdown once the command has exited.
+func (w *idleTimer) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.t != nil {
+		w.t.Stop()
+	}
+}
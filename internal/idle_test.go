@@ -0,0 +1,35 @@
+package multirun
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"silent.sh": "exec sleep 30",
+		"chatty.sh": "for i in 1 2 3 4 5 6; do echo tick; sleep 0.3; done",
+	})
+	begin := time.Now()
+	var res Result
+	stderr := capture(t, &os.Stderr, func() {
+		capture(t, &os.Stdout, func() {
+			res = run(t, dir, Instructions{KeepGoing: true, Commands: []Command{
+				{Path: "silent.sh", Tag: "silent", IdleTimeoutSeconds: 1},
+				{Path: "chatty.sh", Tag: "chatty", IdleTimeoutSeconds: 1},
+			}})
+		})
+	})
+	if d := time.Since(begin); d > 10*time.Second {
+		t.Errorf("run took %s, want the silent command killed after 1s", d)
+	}
+	// chatty outlives the timeout, but never goes a second without output
+	if got := statuses(res); got["silent"] != "failed" || got["chatty"] != "succeeded" {
+		t.Errorf("statuses = %v, want only silent failed", got)
+	}
+	if !strings.Contains(stderr, "silent: no output for 1s, killing") {
+		t.Errorf("stderr %q does not report the idle kill", stderr)
+	}
+}
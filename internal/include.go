@@ -0,0 +1,200 @@
+package multirun
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Loading instructions
+// -----------------------------------------------------------------------------
+
+// maxIncludeDepth bounds how deeply instructions files may include each other.
+const maxIncludeDepth = 16
+
+// readInstructions decodes the instructions file at path. With comments
+// set, or for a .json5 file, comments and trailing commas are allowed.
+func readInstructions(path string, comments bool) (*Instructions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if comments || filepath.Ext(path) == ".json5" {
+		data = stripTrailingCommas(stripComments(data))
+	}
+	var instr Instructions
+	if err := json.Unmarshal(data, &instr); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &instr, nil
+}
+
+// stripComments blanks out // and /* */ comments outside string literals.
+// Newlines are kept so decode errors still point at the right line.
+func stripComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			end := stringEnd(data, i)
+			out = append(out, data[i:end]...)
+			i = end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			i += 2
+			for i < len(data) && !(data[i] == '*' && i+1 < len(data) && data[i+1] == '/') {
+				if data[i] == '\n' {
+					out = append(out, '\n')
+				}
+				i++
+			}
+			i++ // the closing '/'
+			out = append(out, ' ')
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// stripTrailingCommas drops commas directly followed (ignoring whitespace)
+// by a closing '}' or ']', outside string literals.
+func stripTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '"':
+			end := stringEnd(data, i)
+			out = append(out, data[i:end]...)
+			i = end - 1
+			continue
+		case ',':
+			j := i + 1
+			for j < len(data) && strings.IndexByte(" \t\r\n", data[j]) >= 0 {
+				j++
+			}
+			if j < len(data) && (data[j] == '}' || data[j] == ']') {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// stringEnd returns the index just past the string literal starting at
+// data[start], or len(data) if it is unterminated.
+func stringEnd(data []byte, start int) int {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// expandIncludes appends the commands of every file listed in instr's
+// `includes` (resolved through runfiles, recursively) to instr.Commands.
+// Only commands are taken from included files; all other settings come from
+// the root file. stack holds the files being expanded, to detect cycles.
+func expandIncludes(r resolver, instr *Instructions, stack []string, comments bool) error {
+	if len(stack) > maxIncludeDepth {
+		return fmt.Errorf("includes nested deeper than %d levels: %s", maxIncludeDepth, strings.Join(stack, " -> "))
+	}
+	for _, inc := range instr.Includes {
+		path, err := scriptPath(r, instr.WorkspaceName, inc)
+		if err != nil {
+			return fmt.Errorf("include %q: %w", inc, err)
+		}
+		for _, s := range stack {
+			if s == path {
+				return fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), path)
+			}
+		}
+
+		sub, err := readInstructions(path, comments)
+		if err != nil {
+			return err
+		}
+		if sub.WorkspaceName == "" {
+			sub.WorkspaceName = instr.WorkspaceName
+		}
+		if err := expandIncludes(r, sub, append(stack, path), comments); err != nil {
+			return err
+		}
+		instr.Commands = append(instr.Commands, sub.Commands...)
+	}
+	instr.Includes = nil
+	return nil
+}
+
+// applyOverlay patches instr with the --config overlay file at path. Its
+// top-level fields replace instr's; each entry of its "commands" patches the
+// command with the same tag: env entries are merged, args are appended and
+// other fields are replaced. Fields absent from the overlay are untouched.
+func applyOverlay(instr *Instructions, path string, comments bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if comments || filepath.Ext(path) == ".json5" {
+		data = stripTrailingCommas(stripComments(data))
+	}
+	var overlay map[string]json.RawMessage
+	if err := json.Unmarshal(data, &overlay); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	cmds := overlay["commands"]
+	delete(overlay, "commands")
+
+	// Decoding into the loaded value only sets the fields present
+	top, _ := json.Marshal(overlay)
+	if err := json.Unmarshal(top, instr); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if cmds == nil {
+		return nil
+	}
+	var patches []map[string]json.RawMessage
+	if err := json.Unmarshal(cmds, &patches); err != nil {
+		return fmt.Errorf("%s: commands: %w", path, err)
+	}
+	for _, patch := range patches {
+		var tag string
+		if err := json.Unmarshal(patch["tag"], &tag); err != nil || tag == "" {
+			return fmt.Errorf("%s: every command needs a tag", path)
+		}
+		i := slices.IndexFunc(instr.Commands, func(c Command) bool { return c.Tag == tag })
+		if i < 0 {
+			return fmt.Errorf("%s: no command tagged %q", path, tag)
+		}
+		var args []string
+		if raw, ok := patch["args"]; ok {
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return fmt.Errorf("%s: %s: args: %w", path, tag, err)
+			}
+			delete(patch, "args")
+		}
+		fields, _ := json.Marshal(patch)
+		if err := json.Unmarshal(fields, &instr.Commands[i]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, tag, err)
+		}
+		instr.Commands[i].Args = append(instr.Commands[i].Args, args...)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeOverlay(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "overlay.json")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func overlayBase() Instructions {
+	return Instructions{
+		Commands: []Command{
+			{Path: "a.sh", Tag: "a", Args: []string{"x"}, Env: map[string]string{"K": "1", "L": "2"}},
+			{Path: "b.sh", Tag: "b", Args: []string{"y"}},
+		},
+		Jobs:      1,
+		KeepGoing: true,
+	}
+}
+
+func TestOverlayJobs(t *testing.T) {
+	instr := overlayBase()
+	if err := applyOverlay(&instr, writeOverlay(t, `{"jobs": 4}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if instr.Jobs != 4 {
+		t.Errorf("jobs = %d, want 4", instr.Jobs)
+	}
+	if !instr.KeepGoing || !reflect.DeepEqual(instr.Commands, overlayBase().Commands) {
+		t.Errorf("fields absent from the overlay changed: %+v", instr)
+	}
+}
+
+func TestOverlayCommandEnv(t *testing.T) {
+	instr := overlayBase()
+	if err := applyOverlay(&instr, writeOverlay(t, `{"commands": [{"tag": "a", "env": {"K": "9", "M": "3"}}]}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"K": "9", "L": "2", "M": "3"}; !reflect.DeepEqual(instr.Commands[0].Env, want) {
+		t.Errorf("env = %v, want %v", instr.Commands[0].Env, want)
+	}
+	if instr.Commands[1].Env != nil {
+		t.Errorf("untagged command's env changed: %v", instr.Commands[1].Env)
+	}
+}
+
+func TestOverlayCommandArgs(t *testing.T) {
+	instr := overlayBase()
+	if err := applyOverlay(&instr, writeOverlay(t, `{"commands": [{"tag": "b", "args": ["--fast"]}]}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"y", "--fast"}; !reflect.DeepEqual(instr.Commands[1].Args, want) {
+		t.Errorf("args = %q, want %q", instr.Commands[1].Args, want)
+	}
+	if want := []string{"x"}; !reflect.DeepEqual(instr.Commands[0].Args, want) {
+		t.Errorf("other command's args = %q, want %q", instr.Commands[0].Args, want)
+	}
+}
+
+func TestOverlayUnknownTag(t *testing.T) {
+	instr := overlayBase()
+	if err := applyOverlay(&instr, writeOverlay(t, `{"commands": [{"tag": "nope", "args": ["z"]}]}`), false); err == nil {
+		t.Error("expected an error for an overlay command with an unknown tag")
+	}
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestExpandIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"inc1.json": `{"commands": [{"path": "x", "tag": "inc1"}], "includes": ["inc2.json"], "jobs": 5}`,
+		"inc2.json": `{"commands": [{"path": "x", "tag": "inc2"}]}`,
+	})
+	instr := Instructions{Commands: []Command{{Path: "x", Tag: "root"}}, Includes: []string{"inc1.json"}, Jobs: 1}
+	if err := expandIncludes(dirResolver{dir}, &instr, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := tagsOf(instr.Commands); !reflect.DeepEqual(got, []string{"root", "inc1", "inc2"}) {
+		t.Errorf("commands = %v, want root, inc1, inc2", got)
+	}
+	if instr.Jobs != 1 || instr.Includes != nil {
+		t.Errorf("settings of included files leaked: jobs=%d includes=%v", instr.Jobs, instr.Includes)
+	}
+}
+
+func TestExpandIncludesCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.json": `{"commands": [], "includes": ["b.json"]}`,
+		"b.json": `{"commands": [], "includes": ["a.json"]}`,
+	})
+	instr := Instructions{Includes: []string{"a.json"}}
+	err := expandIncludes(dirResolver{dir}, &instr, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("err = %v, want an include cycle", err)
+	}
+}
+
+func TestReadInstructionsComments(t *testing.T) {
+	const content = `{
+	// the dev stack
+	"commands": [
+		{"path": "a//b", "tag": "x /* not a comment */", "args": ["\"//\"",],},
+	],
+	/* run
+	   everything */ "jobs": 0,
+}`
+	dir := writeFiles(t, map[string]string{"instr.json5": content, "instr.json": content})
+	instr, err := readInstructions(filepath.Join(dir, "instr.json5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := instr.Commands[0]
+	if c.Path != "a//b" || c.Tag != "x /* not a comment */" || !reflect.DeepEqual(c.Args, []string{`"//"`}) {
+		t.Errorf("command = %+v, string literals were changed", c)
+	}
+	if _, err := readInstructions(filepath.Join(dir, "instr.json"), false); err == nil {
+		t.Error("comments accepted in a .json file without comments set")
+	}
+	if _, err := readInstructions(filepath.Join(dir, "instr.json"), true); err != nil {
+		t.Errorf("comments set: %v", err)
+	}
+}
+
+func TestStripCommentsKeepsLines(t *testing.T) {
+	got := string(stripComments([]byte("a // x\n/* y\nz */b")))
+	if want := "a \n\n b"; got != want {
+		t.Errorf("stripComments = %q, want %q", got, want)
+	}
+}
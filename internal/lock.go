@@ -0,0 +1,38 @@
+package multirun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Instance lock
+// -----------------------------------------------------------------------------
+
+// errLockHeld is returned by tryLock when another process holds the lock.
+var errLockHeld = errors.New("lock held")
+
+// acquireLock takes an exclusive advisory lock on path, creating the file if
+// needed. Unless wait is set, it fails at once when another instance holds
+// the lock. The lock lasts until the returned file is closed or multirun
+// exits.
+func acquireLock(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = tryLock(f)
+	if errors.Is(err, errLockHeld) && wait {
+		fmt.Fprintf(os.Stderr, "multirun: waiting for another instance to release %s\n", path)
+		err = waitLock(f)
+	}
+	if errors.Is(err, errLockHeld) {
+		err = fmt.Errorf("another instance holds %s", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,49 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	first, err := acquireLock(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acquireLock(path, false); err == nil || !strings.Contains(err.Error(), "another instance holds") {
+		t.Fatalf("second acquire without wait: err = %v, want the lock held", err)
+	}
+
+	stderr := capture(t, &os.Stderr, func() {
+		acquired := make(chan error, 1)
+		go func() {
+			f, err := acquireLock(path, true)
+			if err == nil {
+				f.Close()
+			}
+			acquired <- err
+		}()
+		select {
+		case err := <-acquired:
+			t.Fatalf("second acquire with wait returned %v while the lock was held", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		first.Close()
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Errorf("second acquire with wait: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("second acquire with wait still blocked after the lock was released")
+		}
+	})
+	if !strings.Contains(stderr, "waiting for another instance to release") {
+		t.Errorf("stderr %q does not say it is waiting", stderr)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package multirun
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFileEx locks the first byte of f.
+func lockFileEx(f *os.File, flags uint32) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	return err
+}
+
+func tryLock(f *os.File) error {
+	err := lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately)
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+	return err
+}
+
+func waitLock(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock)
+}
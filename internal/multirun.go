@@ -8,57 +8,249 @@
 // Usage inside Bazel invoked by multirun.bzl:
 //
 //	<binary> <instructions.json> [extra args to append to each command]
-package main
+package multirun
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
-
-	// this is only resolved by bazel
-	"github.com/bazelbuild/rules_go/go/runfiles"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
 // Data structures that mirror the Python version
 // -----------------------------------------------------------------------------
 
-type commandBlob struct {
+// Command is one command of a run, as listed in the instructions.
+type Command struct {
 	Path string            `json:"path"`
 	Tag  string            `json:"tag"`
 	Args []string          `json:"args"`
 	Env  map[string]string `json:"env"`
+	// Needs lists the tags of commands that must succeed before this one starts.
+	Needs []string `json:"needs,omitempty"`
+	// EnvFile is a runfiles path to a KEY=VALUE file; inline Env entries win.
+	EnvFile string `json:"env_file,omitempty"`
+	// AllowExitCodes lists non-zero exit codes that still count as success.
+	AllowExitCodes []int `json:"allow_exit_codes,omitempty"`
+	// Retries is how many more times a failed command is run.
+	Retries int `json:"retries,omitempty"`
+	// RetryOnExitCodes limits retries to these exit codes; empty retries
+	// any failure.
+	RetryOnExitCodes []int `json:"retry_on_exit_codes,omitempty"`
+	// Group names a resource shared with other commands; at most
+	// group_limits[group] commands of a group (one by default) run at
+	// the same time.
+	Group string `json:"group,omitempty"`
+	// StdinFile is a runfiles path to a file fed to the command's stdin.
+	StdinFile string `json:"stdin_file,omitempty"`
+	// OnFailure runs once this command has failed, with MULTIRUN_FAILED_TAG
+	// and MULTIRUN_FAILED_CODE set.
+	OnFailure *Command `json:"on_failure,omitempty"`
+	// FingerprintFile is a runfiles path hashed before the command runs;
+	// with state_dir set, the command is skipped while the hash matches
+	// the one from its last successful run.
+	FingerprintFile string `json:"fingerprint_file,omitempty"`
+	// Nice lowers (or, with privileges, raises) the command's scheduling
+	// priority, from -20 to 19. Unix only.
+	Nice int `json:"nice,omitempty"`
+	// IdleTimeoutSeconds kills the command, as a failure, once it has
+	// written nothing to stdout or stderr for this long.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds,omitempty"`
+	// OutputSink sends the command's combined output to "unix://path" (a
+	// Unix socket) or "pipe://path" (a named pipe) instead of stdout. If
+	// it cannot be opened, the output goes to stdout.
+	OutputSink string `json:"output_sink,omitempty"`
+	// DelayStartSeconds holds the command back for this long after the
+	// run begins, without holding back other commands.
+	DelayStartSeconds int `json:"delay_start_seconds,omitempty"`
+	// Disabled leaves the command out of the run, as if it were not
+	// listed, unless --run-disabled is given.
+	Disabled bool `json:"disabled,omitempty"`
+	// Runfiles set to false takes path as an absolute path or a program
+	// looked up on $PATH instead of a runfiles path.
+	Runfiles *bool `json:"runfiles,omitempty"`
+	// TimeoutKillSignal and TimeoutKillGraceMs override the top-level
+	// settings of the same name for this command.
+	TimeoutKillSignal  string `json:"timeout_kill_signal,omitempty"`
+	TimeoutKillGraceMs int    `json:"timeout_kill_grace_ms,omitempty"`
+	// InheritEnv and InheritEnvKeys override the top-level settings of
+	// the same name for this command.
+	InheritEnv     *bool    `json:"inherit_env,omitempty"`
+	InheritEnvKeys []string `json:"inherit_env_keys,omitempty"`
+	// Umask sets the command's file mode creation mask, e.g. 2 (for 002)
+	// to keep files group-writable. JSON has no octal numbers: the value
+	// is the mask in decimal, so 022 is 18. Unix only.
+	Umask *int `json:"umask,omitempty"`
+	// Command is an inline shell snippet run instead of a path, with args
+	// and extra args as its positional parameters; see shellCommand.
+	// Exactly one of path and command is set.
+	Command string `json:"command,omitempty"`
+	// MemoryLimitMb and CpuQuotaPercent cap the command's memory and its
+	// CPU time (100 is one full CPU) through a cgroup of its own; see
+	// joinCgroup. To create it, multirun moves itself into a "multirun"
+	// cgroup below its own, which it leaves behind; see cgroupParent.
+	// Linux with cgroup v2 only.
+	MemoryLimitMb   int `json:"memory_limit_mb,omitempty"`
+	CpuQuotaPercent int `json:"cpu_quota_percent,omitempty"`
+	// ReadyCheck lets the commands that need this one start once it is
+	// ready rather than once it has exited; see ReadyCheck. The run stops
+	// the command, as a success, once no command left needs it. Parallel
+	// runs only.
+	ReadyCheck *ReadyCheck `json:"ready_check,omitempty"`
+	// CpuAffinity pins the command to these CPUs, numbered from 0; out of
+	// range numbers are clamped. Linux only.
+	CpuAffinity []int `json:"cpu_affinity,omitempty"`
 }
 
-type instructionsFile struct {
-	Commands      []commandBlob `json:"commands"`
-	Jobs          int           `json:"jobs"` // 0 = unlimited / parallel
-	PrintCommand  bool          `json:"print_command"`
-	KeepGoing     bool          `json:"keep_going"`
-	BufferOutput  bool          `json:"buffer_output"`
-	ForwardStdin  bool          `json:"forward_stdin"`
-	WorkspaceName string        `json:"workspace_name"`
+// Instructions describe a run: its commands and how to run them. They are
+// what multirun.bzl writes to the instructions file.
+type Instructions struct {
+	Commands      []Command `json:"commands"`
+	Jobs          int       `json:"jobs"` // 0 = unlimited / parallel, 1 = serial
+	PrintCommand  bool      `json:"print_command"`
+	KeepGoing     bool      `json:"keep_going"`
+	BufferOutput  bool      `json:"buffer_output"`
+	ForwardStdin  bool      `json:"forward_stdin"`
+	WorkspaceName string    `json:"workspace_name"`
+	// LogDir, when set, receives a <tag>.log copy of each command's output.
+	LogDir string `json:"log_dir,omitempty"`
+	// StartupDelayMs staggers parallel launches by this many milliseconds.
+	StartupDelayMs int `json:"startup_delay_ms,omitempty"`
+	// ExitPolicy selects how command failures map to multirun's exit code:
+	// "any" (default), "all" or "first".
+	ExitPolicy string `json:"exit_policy,omitempty"`
+	// ProgressIntervalMs, when set, prints a progress line to stderr at this
+	// interval during parallel runs.
+	ProgressIntervalMs int `json:"progress_interval_ms,omitempty"`
+	// FlushIntervalMs, when set, prints the complete lines a buffered
+	// command has produced so far at this interval instead of only at exit.
+	FlushIntervalMs int `json:"flush_interval_ms,omitempty"`
+	// ForwardStdinTo restricts stdin forwarding to the command with this tag.
+	ForwardStdinTo string `json:"forward_stdin_to,omitempty"`
+	// MaxRuntimeSeconds bounds the wall-clock time of the whole run; when it
+	// runs out, running commands are killed and pending ones skipped.
+	MaxRuntimeSeconds int `json:"max_runtime_seconds,omitempty"`
+	// Includes lists runfiles paths of further instructions files whose
+	// commands are appended to this one's.
+	Includes []string `json:"includes,omitempty"`
+	// Finalizer, when set, runs once after all commands have finished,
+	// whatever their outcome, with MULTIRUN_RESULT=success|failure.
+	Finalizer *Command `json:"finalizer,omitempty"`
+	// BeforeAll, when set, runs to completion before any command starts.
+	// If it fails, no command runs unless keep_going is set; either way
+	// the run fails.
+	BeforeAll *Command `json:"before_all,omitempty"`
+	// ChildKillSignal names the signal sent to running commands when
+	// multirun is interrupted or terminated; SIGINT by default.
+	ChildKillSignal string `json:"child_kill_signal,omitempty"`
+	// Pty runs every command on its own pseudo-terminal (Linux only), for
+	// programs that only color or line-buffer their output on a terminal.
+	Pty bool `json:"pty,omitempty"`
+	// DefaultExtraArgs stands in for the extra args when none are given on
+	// the command line; see prepare for the precedence.
+	DefaultExtraArgs []string `json:"default_extra_args,omitempty"`
+	// JobsSpec, when set, overrides Jobs relative to the CPU count: "auto",
+	// "0.5x", "2x" or a plain number.
+	JobsSpec string `json:"jobs_spec,omitempty"`
+	// PreflightCheck makes sure every command's binary exists before
+	// anything is launched.
+	PreflightCheck bool `json:"preflight_check,omitempty"`
+	// LockFile, when set, is locked for the whole run so that only one
+	// multirun using it runs at a time.
+	LockFile string `json:"lock_file,omitempty"`
+	// MaxBufferBytes bounds how much of a buffered command's output is
+	// held in memory; the rest goes to a temporary file. 0 means no limit.
+	MaxBufferBytes int `json:"max_buffer_bytes,omitempty"`
+	// StateDir keeps state between runs, such as fingerprints.
+	StateDir string `json:"state_dir,omitempty"`
+	// OutputFormat frames each command's output for a CI log viewer:
+	// "plain" (default), "github" or "gitlab". Commands running in
+	// parallel without buffer_output are not framed.
+	OutputFormat string `json:"output_format,omitempty"`
+	// MaxFailures stops the run once this many commands have failed: no
+	// more are launched and running ones are terminated. 0 means no limit.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// GroupLimits caps how many commands of each named group run at once;
+	// groups not listed run one at a time, and 0 means no cap.
+	GroupLimits map[string]int `json:"group_limits,omitempty"`
+	// OutputMode "summary" makes buffered parallel runs print a status
+	// line for each command that succeeds instead of its output; failed
+	// commands still print everything.
+	OutputMode string `json:"output_mode,omitempty"`
+	// TimeoutKillSignal is sent to a command that ran out of time (through
+	// max_runtime_seconds or idle_timeout_seconds); SIGKILL by default.
+	// Unless it is SIGKILL, the command is killed if it is still running
+	// TimeoutKillGraceMs later (5000 by default).
+	TimeoutKillSignal  string `json:"timeout_kill_signal,omitempty"`
+	TimeoutKillGraceMs int    `json:"timeout_kill_grace_ms,omitempty"`
+	// InheritEnv set to false starts commands from an empty environment
+	// instead of multirun's, keeping only the variables named in
+	// InheritEnvKeys (such as PATH or HOME); env entries apply on top.
+	InheritEnv     *bool    `json:"inherit_env,omitempty"`
+	InheritEnvKeys []string `json:"inherit_env_keys,omitempty"`
+	// CheckpointFile, in serial runs, records the commands that succeeded
+	// so that the next run, unless given --restart, skips them and resumes
+	// where this one stopped. It is removed once every command succeeded.
+	CheckpointFile string `json:"checkpoint_file,omitempty"`
+	// RequireConfirm lists the commands and asks for "yes" before running
+	// them; see confirm.
+	RequireConfirm bool `json:"require_confirm,omitempty"`
+	// InheritFds are multirun's own file descriptors passed on to every
+	// command as fd 3, 4, and so on, in order, such as a socket opened by
+	// whatever started multirun. Unix only.
+	InheritFds []int `json:"inherit_fds,omitempty"`
+	// TranscriptFile receives every line of output from all commands and
+	// hooks, tagged and timestamped in the order it arrived, whatever the
+	// console shows; see transcript.
+	TranscriptFile string `json:"transcript_file,omitempty"`
 }
 
 type runningProc struct {
 	cmd   *exec.Cmd
-	blob  commandBlob
+	blob  Command
 	stdin io.WriteCloser // nil unless ForwardStdin
+	// output is a buffered command's output so far, nil when it streams
+	output fmt.Stringer
+	exited atomic.Bool
+	// notReady is set when the command was stopped for failing its
+	// ready_check, which makes it a failure however it exits
+	notReady atomic.Bool
+	// retired is set when the run stopped the ready-checked command as
+	// nothing needs it any more, which makes it a success however it exits
+	retired atomic.Bool
 }
 
 // -----------------------------------------------------------------------------
 // Helpers
 // -----------------------------------------------------------------------------
 
+// verbose enables debugf output; set by --verbose.
+var verbose atomic.Bool
+
+// debugf logs an internal diagnostic to stderr when --verbose is given.
+func debugf(format string, args ...any) {
+	if verbose.Load() {
+		fmt.Fprintf(os.Stderr, "multirun: debug: "+format+"\n", args...)
+	}
+}
+
 func bashOnWindows() (string, error) {
 	if runtime.GOOS != "windows" {
 		return "", nil
@@ -69,20 +261,169 @@ func bashOnWindows() (string, error) {
 	return exec.LookPath("bash.exe")
 }
 
-func scriptPath(r *runfiles.Runfiles, workspace, p string) (string, error) {
-	// Behaviour identical to Python: leading "../" means external, else in‑workspace.
-	if strings.HasPrefix(p, "../") {
-		val, err := r.Rlocation(p[3:])
+// bashArgs returns bash's arguments for running path with args on Windows:
+// the flags from BAZEL_SH_ARGS, then a -c script running the quoted path
+// with "$@". Under MSYS (MSYSTEM set) the path is converted to /c/... form.
+func bashArgs(path string, args []string) []string {
+	if os.Getenv("MSYSTEM") != "" {
+		path = msysPath(path)
+	}
+	script := shellQuote(filepath.ToSlash(path)) + ` "$@"`
+	out := strings.Fields(os.Getenv("BAZEL_SH_ARGS"))
+	out = append(out, "-c", script, "--")
+	return append(out, args...)
+}
+
+// msysPath turns a drive-letter path such as C:\dir\tool into /c/dir/tool,
+// as cygpath -u would. Other paths are returned unchanged.
+func msysPath(p string) string {
+	if len(p) < 2 || p[1] != ':' || !('a' <= p[0]|0x20 && p[0]|0x20 <= 'z') {
+		return p
+	}
+	return "/" + string(p[0]|0x20) + strings.ReplaceAll(p[2:], `\`, "/")
+}
+
+// shellCommand returns the program and arguments running blob's inline
+// command with args as its positional parameters and the tag as $0: bash -c,
+// or sh -c where there is no bash. On Windows it is the bash of BAZEL_SH,
+// falling back to cmd /c with args appended.
+func shellCommand(blob Command, args []string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		bash, err := bashOnWindows()
 		if err != nil {
-			return "", err
+			return "cmd", append([]string{"/c", blob.Command}, args...)
+		}
+		out := strings.Fields(os.Getenv("BAZEL_SH_ARGS"))
+		out = append(out, "-c", blob.Command, blob.Tag)
+		return bash, append(out, args...)
+	}
+	sh := "sh"
+	if bash, err := exec.LookPath("bash"); err == nil {
+		sh = bash
+	}
+	return sh, append([]string{"-c", blob.Command, blob.Tag}, args...)
+}
+
+func hasTag(cmds []Command, tag string) bool {
+	for _, c := range cmds {
+		if c.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDuplicateTags rejects non-empty tags used by more than one command.
+func checkDuplicateTags(cmds []Command) error {
+	seen := map[string]int{}
+	for i, c := range cmds {
+		if c.Tag == "" {
+			continue
 		}
-		return val, nil
+		if j, ok := seen[c.Tag]; ok {
+			return fmt.Errorf("duplicate tag %q at commands[%d] and commands[%d]", c.Tag, j, i)
+		}
+		seen[c.Tag] = i
+	}
+	return nil
+}
+
+// placeholderRe matches the {{name}} placeholders substituted in args.
+var placeholderRe = regexp.MustCompile(`\{\{(\w+)\}\}`)
 
+// expandPlaceholders substitutes {{tag}}, {{index}} and {{jobs}} in every
+// command's args. Unknown placeholders are left as they are, with a warning.
+func expandPlaceholders(cmds []Command, jobs int) {
+	for i := range cmds {
+		values := map[string]string{
+			"tag":   cmds[i].Tag,
+			"index": strconv.Itoa(i),
+			"jobs":  strconv.Itoa(jobs),
+		}
+		for j, arg := range cmds[i].Args {
+			cmds[i].Args[j] = placeholderRe.ReplaceAllStringFunc(arg, func(m string) string {
+				name := m[2 : len(m)-2]
+				if v, ok := values[name]; ok {
+					return v
+				}
+				fmt.Fprintf(os.Stderr, "multirun: warning: %s: unknown placeholder %s in args\n", cmds[i].Tag, m)
+				return m
+			})
+		}
 	}
-	val, err := r.Rlocation(filepath.ToSlash(filepath.Join(workspace, p)))
+}
+
+// preflight stats the resolved path of every command and reports all the
+// missing ones in a single error.
+func preflight(cmds []Command) error {
+	var missing []string
+	for _, c := range cmds {
+		if c.Command != "" {
+			continue
+		}
+		if _, err := os.Stat(c.Path); err != nil {
+			missing = append(missing, fmt.Sprintf("  %s: %v", c.Tag, err))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("preflight check failed, %d of %d commands are missing:\n%s",
+			len(missing), len(cmds), strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+// resolveHook resolves the path and env_file of a helper command such as
+// the finalizer.
+func resolveHook(r resolver, workspace string, blob *Command) error {
+	p, err := commandPath(r, workspace, *blob)
+	if err != nil {
+		return err
+	}
+	blob.Path = p
+	return resolveEnvFile(r, workspace, blob)
+}
+
+// commandPath resolves blob's path: through runfiles, or with runfiles
+// set to false, as an absolute path or a program on $PATH.
+func commandPath(r resolver, workspace string, blob Command) (string, error) {
+	switch {
+	case blob.Path != "" && blob.Command != "":
+		return "", fmt.Errorf("%s: set either path or command, not both", blob.Tag)
+	case blob.Command != "":
+		return "", nil
+	case blob.Path == "":
+		return "", fmt.Errorf("%s: needs a path or a command", blob.Tag)
+	}
+	if blob.Runfiles == nil || *blob.Runfiles {
+		return scriptPath(r, workspace, blob.Path)
+	}
+	if filepath.IsAbs(blob.Path) {
+		return blob.Path, nil
+	}
+	p, err := exec.LookPath(blob.Path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", blob.Tag, err)
+	}
+	return p, nil
+}
+
+// scriptPath resolves a short_path from the instructions to a real path.
+func scriptPath(r resolver, workspace, p string) (string, error) {
+	// Windows callers may use backslashes; runfiles paths never do
+	p = strings.ReplaceAll(p, `\`, "/")
+	// Behaviour identical to Python: leading "../" means external (with
+	// Bzlmod e.g. "../+rules_foo+bar/tool"), else in‑workspace.
+	rpath := path.Join(workspace, p)
+	if ext, ok := strings.CutPrefix(p, "../"); ok {
+		rpath = path.Clean(ext)
+	}
+	val, err := r.Rlocation(rpath)
 	if err != nil {
 		return "", err
 	}
+	if val == "" {
+		return "", fmt.Errorf("%s: not found in runfiles", rpath)
+	}
 	return val, nil
 }
 
@@ -90,41 +431,104 @@ func scriptPath(r *runfiles.Runfiles, workspace, p string) (string, error) {
 // Execution primitives
 // -----------------------------------------------------------------------------
 
-// launchCommand starts a command.  If blocking==true it waits and returns the exit code.
-func launchCommand(blob commandBlob, r *runfiles.Runfiles, blocking bool, extraArgs []string, pipeStdout bool, pipeStdin bool) (*exec.Cmd, io.WriteCloser, error) {
+// checkExecutable reports, more clearly than exec would, why blob's path
+// cannot be run: it is missing, a directory, or lacks the exec bit. Windows
+// runs commands through bash, so the exec bit is not checked there.
+func checkExecutable(blob Command) error {
+	if blob.Command != "" {
+		return nil
+	}
+	fi, err := os.Stat(blob.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%s: command not found: %s", blob.Tag, blob.Path)
+	case err != nil:
+		return fmt.Errorf("%s: %w", blob.Tag, err)
+	case fi.IsDir():
+		return fmt.Errorf("%s: command path is a directory: %s", blob.Tag, blob.Path)
+	case runtime.GOOS != "windows" && fi.Mode().Perm()&0o111 == 0:
+		return fmt.Errorf("%s: command is not executable (no +x): %s", blob.Tag, blob.Path)
+	}
+	return nil
+}
+
+// launchCommand prepares a command wired up according to cio; the caller starts it.
+// The process is killed if ctx is done before it exits.
+func launchCommand(ctx context.Context, blob Command, extraArgs commandArgs, cio *commandIO) (*exec.Cmd, io.WriteCloser, error) {
+	if err := checkExecutable(blob); err != nil {
+		return nil, nil, err
+	}
+
 	var bash string
 	var err error
-	if runtime.GOOS == "windows" {
+	if runtime.GOOS == "windows" && blob.Command == "" {
 		bash, err = bashOnWindows()
 		if err != nil {
 			return nil, nil, fmt.Errorf("bash not found on Windows (set BAZEL_SH): %w", err)
 		}
+		debugf("%s: using shell %s", blob.Tag, bash)
 	}
 
 	argv := append([]string{}, blob.Args...)
-	argv = append(argv, extraArgs...)
+	argv = append(argv, extraArgs.forTag(blob.Tag)...)
+	debugf("%s: %s", blob.Tag, commandLine(blob, argv))
 
-	var cmd *exec.Cmd
-	if bash != "" {
-		script := fmt.Sprintf(`%s "$@"`, blob.Path)
-		full := append([]string{"-c", script, "--"}, argv...)
-		cmd = exec.Command(bash, full...)
-	} else {
-		cmd = exec.Command(blob.Path, argv...)
+	name, args := blob.Path, argv
+	switch {
+	case blob.Command != "":
+		name, args = shellCommand(blob, argv)
+		debugf("%s: running inline command with %s", blob.Tag, name)
+	case bash != "":
+		name, args = bash, bashArgs(blob.Path, argv)
 	}
+	name, args = withUmask(blob, name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
 
-	cmd.Env = append(os.Environ(), flattenEnv(blob.Env)...)
+	// blob is a copy: the resolved secrets go no further than cmd.Env
+	blob.Env, err = cio.secrets.resolve(blob.Env)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", blob.Tag, err)
+	}
+	cmd.Env = commandEnv(blob)
+	if blob.IdleTimeoutSeconds > 0 {
+		// Children of a command killed for idling may keep its output
+		// pipes open; do not wait on them for long
+		cmd.WaitDelay = time.Second
+	}
+	if sig, grace := blob.timeoutKill(); sig != syscall.SIGKILL {
+		// Wait kills the command once WaitDelay has passed after Cancel
+		cmd.Cancel = func() error { return signalProcess(cmd.Process, sig) }
+		cmd.WaitDelay = grace
+	}
+	stdout, stderr := cio.writers()
+	if cio.pty {
+		// The command sees a terminal on all three streams
+		if err := cio.attachPty(cmd, stdout); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+	}
+	cmd.ExtraFiles = cio.fds
+	// After attachPty, which sets SysProcAttr afresh
+	cio.joinCgroup(cmd, blob)
 
-	if !pipeStdout {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	if blob.StdinFile != "" {
+		f, err := os.Open(blob.StdinFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("stdin_file: %w", err)
+		}
+		cio.stdinFile = f
+		cmd.Stdin = f
 	}
 
 	var stdinWriter io.WriteCloser
-	if pipeStdin {
+	if cio.pipeStdin {
+		// Pipes must be set up before Start; output capture goes through
+		// cio's writers above, so stdin is the only one created here
 		stdinWriter, err = cmd.StdinPipe()
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, fmt.Errorf("%s: stdin pipe: %w", blob.Tag, err)
 		}
 	}
 
@@ -136,6 +540,7 @@ func flattenEnv(env map[string]string) []string {
 	for k, v := range env {
 		out = append(out, fmt.Sprintf("%s=%s", k, v))
 	}
+	sort.Strings(out)
 	return out
 }
 
@@ -143,191 +548,1637 @@ func flattenEnv(env map[string]string) []string {
 // Concurrency helpers
 // -----------------------------------------------------------------------------
 
+// errNotStarted is returned by a parallel launch abandoned because the run
+// is stopping.
+var errNotStarted = errors.New("not started: the run is stopping")
+
+// procSet is the set of launched processes, shared between the scheduler,
+// the stdin forwarder and the interrupt handler.
+type procSet struct {
+	mu          sync.Mutex
+	procs       []*runningProc
+	stdinClosed bool
+	interrupted bool
+}
+
+func (s *procSet) add(p *runningProc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.procs = append(s.procs, p)
+	// stdin already hit EOF: a late starter must not wait on it forever
+	if s.stdinClosed && p.stdin != nil {
+		p.stdin.Close()
+	}
+}
+
+// stopping reports whether the run was interrupted or halted.
+func (s *procSet) stopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interrupted
+}
+
+func (s *procSet) snapshot() []*runningProc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*runningProc{}, s.procs...)
+}
+
+// stdinQueue feeds a command's stdin pipe from a goroutine of its own, so
+// forwarding never blocks on a command that does not read its input. What it
+// has not taken yet is queued in memory.
+type stdinQueue struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	queue  [][]byte
+	closed bool
+	wake   chan struct{}
+}
+
+func newStdinQueue(w io.WriteCloser) *stdinQueue {
+	q := &stdinQueue{w: w, wake: make(chan struct{}, 1)}
+	go q.drain()
+	return q
+}
+
+func (q *stdinQueue) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0, os.ErrClosed
+	}
+	q.queue = append(q.queue, bytes.Clone(p))
+	q.mu.Unlock()
+	q.notify()
+	return len(p), nil
+}
+
+// Close closes the pipe once everything queued has been written.
+func (q *stdinQueue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.notify()
+	return nil
+}
+
+func (q *stdinQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *stdinQueue) drain() {
+	broken := false
+	for range q.wake {
+		q.mu.Lock()
+		batch, closed := q.queue, q.closed
+		q.queue = nil
+		q.mu.Unlock()
+		for _, b := range batch {
+			// Once the command stopped reading, the rest is dropped
+			if !broken {
+				_, err := q.w.Write(b)
+				broken = err != nil
+			}
+		}
+		if closed {
+			q.w.Close()
+			return
+		}
+	}
+}
+
 // forward stdin lines to all running processes
-func forwardStdin(stop <-chan struct{}, procs []*runningProc) {
+func forwardStdin(set *procSet) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		line := scanner.Text() + "\n"
-		for _, p := range procs {
+		for _, p := range set.snapshot() {
 			if p.stdin != nil {
 				io.WriteString(p.stdin, line)
 			}
 		}
 	}
 	// close pipes
-	for _, p := range procs {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.stdinClosed = true
+	for _, p := range set.procs {
 		if p.stdin != nil {
 			p.stdin.Close()
 		}
 	}
 }
 
+// reportProgress prints line() to stderr every interval until stop is closed.
+func reportProgress(interval time.Duration, stop <-chan struct{}, line func() string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fmt.Fprintln(os.Stderr, "multirun:", line())
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Runner
+// -----------------------------------------------------------------------------
+
+// runner holds what one multirun invocation shares across its commands.
+type runner struct {
+	instr      *Instructions
+	r          resolver
+	extraArgs  commandArgs
+	graph      *depGraph
+	opts       *options
+	events     *eventStream  // nil unless --events-fd is given
+	fds        []*os.File    // inherit_fds, passed to every command
+	transcript *transcript   // nil unless transcript_file is set
+	secrets    *secretSource // nil unless --secret-command is given
+	colors     bool          // colorize --prefix labels
+	killSig    syscall.Signal
+	format     outputFormatter
+	// fingerprints holds the fingerprint_file hash taken before each run
+	fingerprints []string
+	// prefixWidth pads or truncates tags in labels; 0 leaves them as is
+	prefixWidth int
+	rate        *rateLimiter // paces console output; nil without --max-output-rate
+	// current is the serial run's running command, for the signal handler
+	current atomic.Pointer[os.Process]
+	// highlight flags matching output lines (--highlight); matches counts
+	// them per command
+	highlight *regexp.Regexp
+	matches   []atomic.Int64
+	// stopOnOutput stops the run once an output line matches it
+	// (--stop-on-output), through stopRun, which cancels the context of
+	// the current execute; tripped is set once that happened
+	stopOnOutput *regexp.Regexp
+	stopRun      context.CancelCauseFunc
+	tripped      atomic.Bool
+	// warming is set during --warmup runs, whose results do not count;
+	// warmedUp once they are done
+	warming, warmedUp bool
+
+	// mu serializes console output and guards the parallel run's state
+	mu sync.Mutex
+}
+
+// commandIO sets up the output wiring of the given attempt of command i
+// (0, then 1 for its first retry). capture, when non-nil, receives its
+// combined output instead of the console.
+func (rn *runner) commandIO(i, attempt int, capture io.Writer, pipeStdin bool) (*commandIO, error) {
+	blob := rn.instr.Commands[i]
+	logDir, outputDir, trans := rn.instr.LogDir, rn.opts.outputDir, rn.transcript
+	if rn.warming {
+		logDir, outputDir, trans = "", "", nil
+	}
+	logFile, err := openLog(logDir, i, blob.Tag, attempt)
+	if err != nil {
+		return nil, err
+	}
+	outFile, errFile, err := openStreamFiles(outputDir, i, blob.Tag)
+	if err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, fmt.Errorf("--output-dir: %w", err)
+	}
+	cio := &commandIO{capture: capture, log: logFile, outFile: outFile, errFile: errFile, pipeStdin: pipeStdin, consoleMu: &rn.mu, pty: rn.instr.Pty, rate: rn.rate, collapse: rn.opts.collapseRepeats,
+		jsonLogs: rn.opts.jsonLogs, tag: blob.Tag, fds: rn.fds, trans: trans, maxLine: rn.opts.maxLineLength, secrets: rn.secrets}
+	if rn.highlight != nil {
+		cio.mark = func(line string) string { return rn.markLine(i, line) }
+	}
+	if rn.opts.prefix {
+		cio.prefix = rn.label(i)
+	}
+	if rn.warming {
+		cio.prefix = warmupLabel + cio.prefix
+	}
+	if _, plain := rn.format.(plainFormat); !plain {
+		cio.format = rn.format
+	}
+	if blob.OutputSink != "" {
+		sink, err := openSink(blob.OutputSink)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: warning: %s: output_sink: %v, writing to stdout\n", blob.Tag, err)
+		} else {
+			cio.sink = sink
+		}
+	}
+	if blob.IdleTimeoutSeconds > 0 {
+		cio.idle = &idleTimer{d: time.Duration(blob.IdleTimeoutSeconds) * time.Second}
+	}
+	if rn.events != nil || rn.stopOnOutput != nil {
+		cio.onLine = func(stream, line string) {
+			rn.events.output(blob.Tag, stream, line)
+			rn.checkTrip(blob.Tag, line)
+		}
+	}
+	return cio, nil
+}
+
+// label returns the "[tag] " prefix of command i, colored when enabled and
+// padded to --output-prefix-width.
+func (rn *runner) label(i int) string {
+	tag, pad := rn.instr.Commands[i].Tag, ""
+	if rn.prefixWidth > 0 {
+		tag, pad = fitWidth(tag, rn.prefixWidth)
+	}
+	l := "[" + tag + "]"
+	if rn.colors {
+		l = colorize(i, l)
+	}
+	return l + pad + " "
+}
+
+// println writes a line to stdout, paced by --max-output-rate.
+func (rn *runner) println(text string) {
+	if rn.rate != nil {
+		rn.rate.println(os.Stdout, text)
+		return
+	}
+	fmt.Println(text)
+}
+
+// run runs every command once, in parallel or serially as jobs asks: 1 is
+// serial, 0 parallel without a limit and anything else parallel with at
+// most that many commands at a time, stopping at the first failure unless
+// keep_going is set, as a serial run does.
+func (rn *runner) run(ctx context.Context) *runResult {
+	if rn.instr.Jobs != 1 {
+		debugf("running %d commands in parallel (jobs=%d)", len(rn.instr.Commands), rn.instr.Jobs)
+		return rn.runParallel(ctx)
+	}
+	debugf("running %d commands serially", len(rn.instr.Commands))
+	return rn.runSerial(ctx)
+}
+
 // -----------------------------------------------------------------------------
 // Serial execution
 // -----------------------------------------------------------------------------
 
-func runSerial(instr *instructionsFile, r *runfiles.Runfiles, extraArgs []string) bool {
-	for _, blob := range instr.Commands {
-		if instr.PrintCommand {
-			fmt.Println(blob.Tag)
+// runSerial runs the commands one at a time. With --continue-from, the
+// commands ordered before the named one are skipped as if they already
+// succeeded.
+func (rn *runner) runSerial(ctx context.Context) *runResult {
+	instr := rn.instr
+	continueFrom := rn.opts.continueFrom
+	res := newRunResult(len(instr.Commands))
+	resuming := continueFrom != ""
+	runStart := time.Now()
+	var cp *checkpoint
+	if instr.CheckpointFile != "" && !rn.warming {
+		cp = newCheckpoint(instr.CheckpointFile, instr.Commands, rn.opts.restart)
+	}
+
+	// Signal handling – pass child_kill_signal on to the running command
+	// and stop the run once it has exited
+	var interrupted atomic.Bool
+	stopSignals := forwardSignals(func(again bool) {
+		interrupted.Store(true)
+		_ = signalProcess(rn.current.Load(), interruptSignal(rn.killSig, again))
+	})
+	defer stopSignals()
+
+	for _, i := range rn.graph.order() {
+		blob := instr.Commands[i]
+		if interrupted.Load() {
+			res.interrupted = true
+			res.skip(i, stopReason(ctx))
+			continue
+		}
+		if ctx.Err() != nil {
+			res.skip(i, stopReason(ctx))
+			continue
+		}
+		if resuming && blob.Tag == continueFrom {
+			resuming = false
+		}
+		if resuming {
+			fmt.Fprintf(os.Stderr, "multirun: skipping %s (before %s)\n", blob.Tag, continueFrom)
+			// It ran in an earlier invocation; let its dependents go ahead
+			res.state[i] = stateSucceeded
+			continue
+		}
+		if cp != nil && cp.done(i) {
+			fmt.Fprintf(os.Stderr, "multirun: skipping %s (done in an earlier run, see checkpoint_file)\n", blob.Tag)
+			res.state[i], res.codes[i] = stateSucceeded, 0
+			continue
 		}
 
-		cmd, _, err := launchCommand(blob, r, true, extraArgs, false, false)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			if !instr.KeepGoing {
-				return false
-			}
+		if dep, _ := rn.graph.readiness(i, res.state, res.ready); dep >= 0 {
+			res.skipForDep(instr.Commands, i, dep)
 			continue
 		}
-		if err := cmd.Run(); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if !instr.KeepGoing {
-					return false
-				}
-				if exitErr.ExitCode() != 0 {
-					// Mark overall failure but keep going
-					continue
+
+		if rn.upToDate(i) {
+			fmt.Fprintf(os.Stderr, "multirun: skipping %s (fingerprint unchanged)\n", blob.Tag)
+			res.state[i], res.codes[i] = stateSucceeded, 0
+			continue
+		}
+
+		// delay_start_seconds counts from the start of the run, so the
+		// commands before it may have used up the delay already
+		if wait := time.Until(runStart.Add(time.Duration(blob.DelayStartSeconds) * time.Second)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				res.skip(i, stopReason(ctx))
+				continue
+			}
+		}
+
+		rn.printMarker(rn.format.StartCommand(blob.Tag))
+		if instr.PrintCommand {
+			rn.println(blob.Tag)
+		}
+
+		err := rn.runOne(ctx, i, res)
+		for retryable(blob, err, res.retries[i]) && ctx.Err() == nil && !interrupted.Load() {
+			res.noteRetry(blob, i, err)
+			err = rn.runOne(ctx, i, res)
+		}
+		rn.printMarker(rn.format.EndCommand(blob.Tag))
+		res.finish(i, err, blob.AllowExitCodes)
+		if res.state[i] == stateSucceeded {
+			rn.saveFingerprint(i)
+			if cp != nil {
+				if err := cp.save(instr.CheckpointFile, i); err != nil {
+					fmt.Fprintln(os.Stderr, "multirun: warning: checkpoint_file:", err)
 				}
 			}
 		}
+		if res.state[i] == stateFailed && blob.OnFailure != nil {
+			rn.runOnFailure(i, res.codes[i])
+		}
+		if interrupted.Load() {
+			res.interrupted = true
+			continue
+		}
+		if res.state[i] != stateSucceeded && !instr.KeepGoing {
+			return res
+		}
+		if res.tooManyFailures(instr.MaxFailures) {
+			fmt.Fprintf(os.Stderr, "multirun: %d commands failed (max_failures), stopping\n", len(res.failed))
+			return res
+		}
+	}
+	// Everything ran: the next run starts over
+	if cp != nil && res.ok() {
+		if err := os.Remove(instr.CheckpointFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "multirun: warning: checkpoint_file:", err)
+		}
+	}
+	return res
+}
+
+// runOne runs command i to completion in the foreground, recording its
+// duration and resource usage in res.
+func (rn *runner) runOne(ctx context.Context, i int, res *runResult) error {
+	blob := rn.instr.Commands[i]
+	cio, err := rn.commandIO(i, res.retries[i], nil, false)
+	if err != nil {
+		res.noteLaunchFailure(i)
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer cio.close()
+	cmd, _, err := launchCommand(ctx, blob, rn.extraArgs, cio)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		setNice(blob.Tag, cmd.Process.Pid, blob.Nice)
+		setAffinity(blob.Tag, cmd.Process.Pid, blob.CpuAffinity)
+	}
+	if err != nil {
+		res.noteLaunchFailure(i)
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	started := time.Now()
+	debugf("%s: started pid %d", blob.Tag, cmd.Process.Pid)
+	rn.events.start(blob.Tag)
+	cio.idle.arm(blob, cmd.Process)
+	rn.current.Store(cmd.Process)
+
+	err = cmd.Wait()
+	rn.current.Store(nil)
+	cio.close()
+	debugf("%s: pid %d exited with code %d", blob.Tag, cmd.Process.Pid, exitCodeOf(err))
+	res.record(i, cmd.ProcessState, time.Since(started))
+	rn.events.exit(blob.Tag, err, time.Since(started))
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return err
+}
+
+// runFinalizer runs the finalizer command, telling it through
+// MULTIRUN_RESULT whether the run succeeded. It is not bound to the run's
+// context, so it still runs after the global time budget ran out.
+func (rn *runner) runFinalizer(succeeded bool) error {
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	return rn.runHook("finalizer", *rn.instr.Finalizer, map[string]string{"MULTIRUN_RESULT": result})
+}
+
+// runOnFailure runs the on_failure command of command i, which failed with
+// exit code code, except in --warmup runs. Its own failure is only logged.
+func (rn *runner) runOnFailure(i, code int) {
+	if rn.warming {
+		return
+	}
+	blob := rn.instr.Commands[i]
+	_ = rn.runHook(blob.Tag+": on_failure", *blob.OnFailure, map[string]string{
+		"MULTIRUN_FAILED_TAG":  blob.Tag,
+		"MULTIRUN_FAILED_CODE": strconv.Itoa(code),
+	})
+}
+
+// runHook runs a helper command such as the finalizer in the foreground,
+// with env added to its own. name labels its messages.
+func (rn *runner) runHook(name string, blob Command, env map[string]string) error {
+	own := blob.Env
+	blob.Env = map[string]string{}
+	for k, v := range own {
+		blob.Env[k] = v
+	}
+	for k, v := range env {
+		blob.Env[k] = v
+	}
+
+	cio := &commandIO{consoleMu: &rn.mu, jsonLogs: rn.opts.jsonLogs, tag: name, trans: rn.transcript, secrets: rn.secrets}
+	cmd, _, err := launchCommand(context.Background(), blob, commandArgs{}, cio)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		setNice(blob.Tag, cmd.Process.Pid, blob.Nice)
+		setAffinity(blob.Tag, cmd.Process.Pid, blob.CpuAffinity)
+	}
+	if err != nil {
+		cio.close()
+		fmt.Fprintf(os.Stderr, "multirun: %s: %v\n", name, err)
+		return err
 	}
-	return true
+	debugf("%s: started pid %d", name, cmd.Process.Pid)
+	err = cmd.Wait()
+	cio.close()
+	debugf("%s: pid %d exited with code %d", name, cmd.Process.Pid, exitCodeOf(err))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %s: %v\n", name, err)
+	}
+	return err
 }
 
 // -----------------------------------------------------------------------------
 // Parallel execution
 // -----------------------------------------------------------------------------
 
-func runParallel(instr *instructionsFile, r *runfiles.Runfiles, extraArgs []string) bool {
-	var wg sync.WaitGroup
-	mu := sync.Mutex{}
-	success := true
+// procResult is sent by a collector goroutine once its process has exited.
+type procResult struct {
+	index   int
+	err     error
+	output  string // buffered output of a failed command
+	ps      *os.ProcessState
+	elapsed time.Duration
+}
+
+// runParallel launches every command as soon as the commands it needs have
+// succeeded, keeping at most jobs of them running (any number for 0).
+// Commands whose dependencies failed are skipped and count as failures.
+// Once ctx is done no further commands are launched.
+//
+// With a jobs limit the run stands in for a serial one, so unless
+// keep_going is set the first failure stops it as it would a serial run:
+// nothing more is launched and the running commands are terminated.
+func (rn *runner) runParallel(ctx context.Context) *runResult {
+	instr := rn.instr
+	mu := &rn.mu
+	res := newRunResult(len(instr.Commands))
 
 	pipeStdout := instr.BufferOutput
-	pipeStdin := instr.ForwardStdin
+	summary := instr.OutputMode == outputModeSummary
+	pipeStdin := instr.ForwardStdin || instr.ForwardStdinTo != ""
 
-	procs := make([]*runningProc, 0, len(instr.Commands))
+	set := &procSet{}
+	results := make(chan procResult)
+	// readied takes the commands whose ready_check passed, until the run
+	// is over and probesDone is closed
+	readied := make(chan int)
+	probesDone := make(chan struct{})
+	defer close(probesDone)
+	// servers holds the running ready-checked commands by index
+	servers := map[int]*runningProc{}
+	running := 0
+	delay := time.Duration(instr.StartupDelayMs) * time.Millisecond
+	var lastStart time.Time
+	runStart := time.Now()
+	// nextWake is when the earliest command held back by
+	// delay_start_seconds may start; zero when none is waiting
+	var nextWake time.Time
+	forwarding := false
+	// inGroup counts the running commands of each group; only the
+	// scheduler loop touches it
+	inGroup := map[string]int{}
+	groupFull := func(group string) bool {
+		if group == "" {
+			return false
+		}
+		limit := instr.groupLimit(group)
+		return limit > 0 && inGroup[group] >= limit
+	}
+	// onFailure starts command i's on_failure command, if any, in the
+	// background; call with mu held
+	var hooks sync.WaitGroup
+	onFailure := func(i int) {
+		if instr.Commands[i].OnFailure == nil {
+			return
+		}
+		hooks.Add(1)
+		go func(code int) {
+			defer hooks.Done()
+			rn.runOnFailure(i, code)
+		}(res.codes[i])
+	}
+	failedOutput := map[int]string{}
 
-	// Launch all
-	for _, blob := range instr.Commands {
-		cmd, stdinWriter, err := launchCommand(blob, r, false, extraArgs, pipeStdout, pipeStdin)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			success = false
-			continue
+	// halt stops the run as an interrupt would: nothing more is launched
+	// and the running commands get child_kill_signal
+	halt := func(reason string) {
+		set.mu.Lock()
+		already := set.interrupted
+		set.interrupted = true
+		set.mu.Unlock()
+		if already {
+			return
 		}
-		if err := cmd.Start(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			success = false
-			continue
+		fmt.Fprintf(os.Stderr, "multirun: %s, stopping\n", reason)
+		for _, p := range set.snapshot() {
+			_ = signalProcess(p.cmd.Process, rn.killSig)
 		}
-		rp := &runningProc{cmd: cmd, blob: blob, stdin: stdinWriter}
-		if pipeStdin {
-			rp.stdin = cmd.Stdin.(io.WriteCloser)
+	}
+
+	// Signal handling – when multirun is interrupted or terminated, pass
+	// child_kill_signal on to the children
+	stopSignals := forwardSignals(func(again bool) {
+		mu.Lock()
+		res.interrupted = true
+		mu.Unlock()
+		set.mu.Lock()
+		set.interrupted = true
+		set.mu.Unlock()
+		sig := interruptSignal(rn.killSig, again)
+		for _, p := range set.snapshot() {
+			_ = signalProcess(p.cmd.Process, sig)
 		}
-		procs = append(procs, rp)
+	})
+	defer stopSignals()
+
+	// SIGUSR1 shows what the buffered commands still running have
+	// written so far
+	if pipeStdout {
+		stopPeek := onPeekSignal(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			peekOutput(set)
+		})
+		defer stopPeek()
 	}
 
-	// stdin forwarder
-	done := make(chan struct{})
-	if pipeStdin {
-		go forwardStdin(done, procs)
+	// Progress reporting reads res under mu until the run is over
+	if instr.ProgressIntervalMs > 0 {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			reportProgress(time.Duration(instr.ProgressIntervalMs)*time.Millisecond, stop, func() string {
+				mu.Lock()
+				defer mu.Unlock()
+				return res.progress(instr.Commands)
+			})
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
 	}
 
-	// Signal handling – when user hits Ctrl‑C propagate to children
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	go func() {
-		<-signals
-		for _, p := range procs {
-			_ = p.cmd.Process.Signal(syscall.SIGINT)
+	// start launches command i and a goroutine collecting its result.
+	start := func(i int) error {
+		blob := instr.Commands[i]
+		var captured *outputBuffer
+		var tail *tailBuffer
+		var capture io.Writer
+		switch {
+		case pipeStdout && (rn.opts.tail >= 0 || summary):
+			keep := rn.opts.tail
+			if summary {
+				keep = 0
+			}
+			var err error
+			if tail, err = newTailBuffer(keep); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+			capture = tail
+		case pipeStdout:
+			captured = &outputBuffer{max: instr.MaxBufferBytes}
+			capture = captured
+		}
+		// With forward_stdin_to only the named command gets a pipe; the
+		// others read from the null device.
+		wantStdin := pipeStdin && (instr.ForwardStdinTo == "" || blob.Tag == instr.ForwardStdinTo)
+		cio, err := rn.commandIO(i, res.retries[i], capture, wantStdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if tail != nil {
+				tail.close()
+			}
+			return err
+		}
+		cmd, stdinWriter, err := launchCommand(ctx, blob, rn.extraArgs, cio)
+		if err == nil {
+			// Collectors run in their own goroutines, so sleeping here
+			// only holds back further launches.
+			if delay > 0 && !lastStart.IsZero() {
+				time.Sleep(time.Until(lastStart.Add(delay)))
+			}
+			// A signal may have come in while sleeping
+			if set.stopping() || ctx.Err() != nil {
+				err = errNotStarted
+			} else {
+				err = cmd.Start()
+				lastStart = time.Now()
+			}
+		}
+		if err == nil {
+			setNice(blob.Tag, cmd.Process.Pid, blob.Nice)
+			setAffinity(blob.Tag, cmd.Process.Pid, blob.CpuAffinity)
+		}
+		if err != nil {
+			if err != errNotStarted {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			cio.close()
+			if tail != nil {
+				tail.close()
+			}
+			return err
+		}
+		started := time.Now()
+		debugf("%s: started pid %d", blob.Tag, cmd.Process.Pid)
+		rn.events.start(blob.Tag)
+		cio.idle.arm(blob, cmd.Process)
+		rp := &runningProc{cmd: cmd, blob: blob}
+		switch {
+		case captured != nil:
+			rp.output = captured
+		case tail != nil:
+			rp.output = tail
+		}
+		if stdinWriter != nil {
+			rp.stdin = newStdinQueue(stdinWriter)
+		}
+		set.add(rp)
+		if blob.ReadyCheck != nil {
+			servers[i] = rp
+			go func() {
+				err := waitReady(ctx, blob, cmd.Env, rp.exited.Load)
+				switch {
+				case err == nil:
+					debugf("%s: ready", blob.Tag)
+					select {
+					case readied <- i:
+					case <-probesDone:
+					}
+				case err != errProbeAbandoned:
+					fmt.Fprintf(os.Stderr, "multirun: %s: ready_check: %v, stopping it\n", blob.Tag, err)
+					rp.notReady.Store(true)
+					_ = signalProcess(rp.cmd.Process, rn.killSig)
+				}
+			}()
 		}
-	}()
 
-	// Collect
-	for _, p := range procs {
-		wg.Add(1)
-		go func(rp *runningProc) {
-			defer wg.Done()
-			var captured strings.Builder
-			if pipeStdout {
-				outPipe, _ := rp.cmd.StdoutPipe()
-				rp.cmd.Stderr = rp.cmd.Stdout
-				rp.cmd.Stdout = nil
-				go io.Copy(&captured, outPipe)
+		go func() {
+			// Buffered output is printed as labeled blocks: periodically
+			// when flush_interval_ms is set, and once more for the tail.
+			printed, began := false, false
+			show := func(text string, final bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				text = strings.TrimSpace(text)
+				if !began && (text != "" || final) {
+					rn.printMarker(rn.format.StartCommand(blob.Tag))
+					began = true
+				}
+				if instr.PrintCommand && (text != "" || (final && !printed)) {
+					rn.println(rp.blob.Tag)
+				}
+				if text != "" {
+					if rn.opts.collapseRepeats {
+						text = collapseRepeats(text)
+					}
+					text = rn.markLines(i, text)
+					rn.println(formatLines(rn.format, prefixLines(text, cio.prefix)))
+					printed = true
+				}
+			}
+			flush := func(final bool) { show(captured.take(final), final) }
+
+			var stopFlush chan struct{}
+			var flusherDone sync.WaitGroup
+			if captured != nil && instr.FlushIntervalMs > 0 {
+				stopFlush = make(chan struct{})
+				flusherDone.Add(1)
+				go func() {
+					defer flusherDone.Done()
+					ticker := time.NewTicker(time.Duration(instr.FlushIntervalMs) * time.Millisecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stopFlush:
+							return
+						case <-ticker.C:
+							flush(false)
+						}
+					}
+				}()
 			}
+
 			err := rp.cmd.Wait()
-			mu.Lock()
-			if pipeStdout && instr.PrintCommand {
-				fmt.Println(rp.blob.Tag)
+			rp.exited.Store(true)
+			switch {
+			case rp.notReady.Load():
+				err = fmt.Errorf("%s: ready_check did not pass", blob.Tag)
+			case rp.retired.Load():
+				err = nil
 			}
-			if captured.Len() > 0 {
-				fmt.Print(strings.TrimSpace(captured.String()) + "\n")
+			elapsed := time.Since(started)
+			cio.close()
+			debugf("%s: pid %d exited with code %d", blob.Tag, rp.cmd.Process.Pid, exitCodeOf(err))
+			rn.events.exit(blob.Tag, err, elapsed)
+			if stopFlush != nil {
+				close(stopFlush)
+				flusherDone.Wait()
 			}
-			if err != nil {
-				success = false
+			ok := succeeded(blob, err)
+			var output string // kept for the failure summary
+			switch {
+			case tail != nil:
+				// --tail: the last lines on success, everything on failure
+				text, omitted, readErr := tail.text(ok)
+				tail.close()
+				if readErr != nil {
+					fmt.Fprintln(os.Stderr, "multirun:", readErr)
+				}
+				if omitted > 0 && !summary {
+					mu.Lock()
+					fmt.Fprintf(os.Stderr, "multirun: %s: showing the last %d of %d lines\n", blob.Tag, rn.opts.tail, rn.opts.tail+omitted)
+					mu.Unlock()
+				}
+				show(text, true)
+				if !ok {
+					output = text
+				}
+				if summary {
+					mu.Lock()
+					if ok {
+						rn.println(fmt.Sprintf("✓ %s (%.1fs)", blob.Tag, elapsed.Seconds()))
+					} else {
+						rn.println(fmt.Sprintf("✗ %s (code %d)", blob.Tag, exitCodeOf(err)))
+					}
+					mu.Unlock()
+				}
+			case captured != nil:
+				flush(true)
+				// Output past max_buffer_bytes is streamed from disk
+				mu.Lock()
+				out := io.Writer(os.Stdout)
+				lines := &lineWriter{emit: func(l string) { rn.println(rn.format.Line(cio.prefix + rn.markLine(i, l))) }, collapse: cio.collapse, max: cio.maxLine}
+				if cio.prefix != "" || cio.format != nil || rn.rate != nil || cio.collapse || rn.highlight != nil {
+					out = lines
+				}
+				n, name, err := captured.drainSpill(out)
+				lines.close()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "multirun:", err)
+				}
+				if name != "" {
+					fmt.Fprintf(os.Stderr, "multirun: %s: output truncated in memory, %d bytes spilled to %s\n", blob.Tag, n, name)
+				}
+				mu.Unlock()
+				if !ok {
+					output = captured.String()
+				}
+			}
+			if began {
+				mu.Lock()
+				rn.printMarker(rn.format.EndCommand(blob.Tag))
+				mu.Unlock()
+			}
+			results <- procResult{index: i, err: err, output: output, ps: rp.cmd.ProcessState, elapsed: elapsed}
+		}()
+		return nil
+	}
+
+	for {
+		// Launch everything that has become ready; skipping a command can
+		// unblock (and skip) its own dependents, so repeat until stable.
+		nextWake = time.Time{}
+		for changed := true; changed; {
+			changed = false
+			set.mu.Lock()
+			interrupted := set.interrupted || ctx.Err() != nil
+			set.mu.Unlock()
+			for i, blob := range instr.Commands {
+				if res.state[i] != statePending {
+					continue
+				}
+				dep, ready := rn.graph.readiness(i, res.state, res.ready)
+				startAt := runStart.Add(time.Duration(blob.DelayStartSeconds) * time.Second)
+				switch {
+				case dep >= 0:
+					mu.Lock()
+					res.skipForDep(instr.Commands, i, dep)
+					mu.Unlock()
+					changed = true
+				case interrupted:
+					mu.Lock()
+					res.skip(i, stopReason(ctx))
+					mu.Unlock()
+				case ready && time.Now().Before(startAt):
+					if nextWake.IsZero() || startAt.Before(nextWake) {
+						nextWake = startAt
+					}
+				case ready && !groupFull(blob.Group) && (instr.Jobs == 0 || running < instr.Jobs):
+					if rn.upToDate(i) {
+						fmt.Fprintf(os.Stderr, "multirun: skipping %s (fingerprint unchanged)\n", blob.Tag)
+						mu.Lock()
+						res.state[i], res.codes[i] = stateSucceeded, 0
+						mu.Unlock()
+						changed = true
+						continue
+					}
+					err := start(i)
+					mu.Lock()
+					if err == errNotStarted {
+						res.skip(i, stopReason(ctx))
+						mu.Unlock()
+						interrupted = true
+						continue
+					}
+					if err != nil {
+						res.noteLaunchFailure(i)
+						res.finish(i, err, nil)
+						onFailure(i)
+						changed = true
+						if !instr.KeepGoing {
+							mu.Unlock()
+							halt(fmt.Sprintf("%s could not be started", blob.Tag))
+							interrupted = true
+							continue
+						}
+					} else {
+						res.state[i] = stateRunning
+						running++
+						if blob.Group != "" {
+							inGroup[blob.Group]++
+						}
+					}
+					mu.Unlock()
+				}
 			}
+		}
+
+		// stdin forwarder, started once the first commands are running so
+		// early input is not dropped
+		if pipeStdin && !forwarding {
+			forwarding = true
+			go forwardStdin(set)
+		}
+
+		// Ready-checked commands, such as servers, would otherwise keep
+		// the run going after the commands that need them are done
+		for i, rp := range servers {
+			if res.state[i] == stateRunning && res.ready[i] && !rn.graph.needed(i, res.state) && !rp.retired.Load() {
+				debugf("%s: no longer needed, stopping it", instr.Commands[i].Tag)
+				rp.retired.Store(true)
+				_ = signalProcess(rp.cmd.Process, rn.killSig)
+			}
+		}
+
+		if running == 0 && nextWake.IsZero() {
+			break
+		}
+		var wake <-chan time.Time
+		if !nextWake.IsZero() {
+			wake = time.After(time.Until(nextWake))
+		}
+		var pr procResult
+		select {
+		case pr = <-results:
+		case i := <-readied:
+			mu.Lock()
+			res.ready[i] = true
+			mu.Unlock()
+			continue
+		case <-wake:
+			continue
+		}
+		running--
+		mu.Lock()
+		res.record(pr.index, pr.ps, pr.elapsed)
+		mu.Unlock()
+		blob := instr.Commands[pr.index]
+		set.mu.Lock()
+		interrupted := set.interrupted || ctx.Err() != nil
+		set.mu.Unlock()
+		if !interrupted && retryable(blob, pr.err, res.retries[pr.index]) {
+			mu.Lock()
+			res.noteRetry(blob, pr.index, pr.err)
 			mu.Unlock()
-		}(p)
+			err := start(pr.index)
+			if err == nil {
+				running++
+				continue
+			}
+			if err != errNotStarted {
+				pr.err = err
+			}
+		}
+		mu.Lock()
+		res.finish(pr.index, pr.err, instr.Commands[pr.index].AllowExitCodes)
+		if res.state[pr.index] == stateFailed {
+			onFailure(pr.index)
+		} else {
+			rn.saveFingerprint(pr.index)
+		}
+		failed := res.state[pr.index] == stateFailed
+		stop := res.tooManyFailures(instr.MaxFailures)
+		failures := len(res.failed)
+		mu.Unlock()
+		switch {
+		case stop:
+			halt(fmt.Sprintf("%d commands failed (max_failures)", failures))
+		case failed && instr.Jobs > 1 && !instr.KeepGoing:
+			halt(fmt.Sprintf("%s failed", blob.Tag))
+		}
+		if blob.Group != "" {
+			inGroup[blob.Group]--
+		}
+		if pr.output != "" {
+			failedOutput[pr.index] = pr.output
+		}
 	}
 
-	wg.Wait()
-	close(done)
-	return success
+	hooks.Wait()
+	if pipeStdout && !rn.opts.noFailureSummary && !rn.warming {
+		if text := failureSummary(instr.Commands, res, failedOutput); text != "" {
+			rn.println(text)
+		}
+	}
+	return res
 }
 
 // -----------------------------------------------------------------------------
 // main
 // -----------------------------------------------------------------------------
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "usage: multirun <instructions.json> [extra args]")
-		os.Exit(1)
+// Main runs the multirun command line: args are the arguments after the
+// program name, starting with the instructions path. It returns the
+// process exit code.
+func Main(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: multirun <instructions.json> [flags --] [extra args]")
+		return 1
+	}
+	instrPath := args[0]
+	opts, rest, err := parseArgs(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+	extraArgs := commandArgs{global: rest, byTag: opts.argsFor}
+	verbose.Store(opts.verbose)
+
+	// Completion only reads the file: runfiles may not even be available,
+	// so includes are not followed
+	if opts.completeTags {
+		loaded, err := readInstructions(instrPath, opts.allowComments)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(completionTags(loaded.Commands))
+		return 0
 	}
-	instrPath := os.Args[1]
-	extraArgs := os.Args[2:]
 
 	// Runfiles resolver
-	r, err := runfiles.New()
+	var r resolver
+	if opts.noRunfiles {
+		r, err = newLiteralResolver(opts.runfilesRoot)
+	} else {
+		r, err = newResolver(opts.runfilesRoot)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "runfiles:", err)
-		os.Exit(1)
+		return 1
 	}
 
 	// Read instructions
-	f, err := os.Open(instrPath)
+	loaded, err := readInstructions(instrPath, opts.allowComments)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return 1
 	}
-	defer f.Close()
-	var instr instructionsFile
-	if err := json.NewDecoder(f).Decode(&instr); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	instr := *loaded
+	if opts.noRunfiles {
+		// Paths are used as written, not under the workspace directory
+		instr.WorkspaceName = ""
+	}
+
+	if opts.stop {
+		if opts.pidFile == "" {
+			fmt.Fprintln(os.Stderr, "multirun: --stop needs --pid-file")
+			return 1
+		}
+		sig, err := parseSignal(instr.ChildKillSignal, syscall.SIGINT)
+		if err == nil {
+			err = stopDetached(opts.pidFile, sig)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "multirun: --stop:", err)
+			return 1
+		}
+		return 0
+	}
+	rootPath, _ := filepath.Abs(instrPath)
+	if err := expandIncludes(r, &instr, []string{rootPath}, opts.allowComments); err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+	if opts.config != "" {
+		if err := applyOverlay(&instr, opts.config, opts.allowComments); err != nil {
+			fmt.Fprintln(os.Stderr, "multirun: --config:", err)
+			return 1
+		}
+	}
+
+	if err := prepare(r, &instr, opts, &extraArgs); err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+
+	if opts.printEnv != "" {
+		i := slices.IndexFunc(instr.Commands, func(c Command) bool { return c.Tag == opts.printEnv })
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "multirun: --print-env: no command tagged %q\n", opts.printEnv)
+			return 1
+		}
+		blob := instr.Commands[i]
+		for _, kv := range commandEnv(blob) {
+			k, v, _ := strings.Cut(kv, "=")
+			if _, own := blob.Env[k]; own {
+				v = redactSecret(v)
+			}
+			fmt.Println(k + "=" + v)
+		}
+		return 0
+	}
+
+	if opts.dumpEffective {
+		if err := dumpEffective(instr, extraArgs, cliOverrides(opts, rest)); err != nil {
+			fmt.Fprintln(os.Stderr, "multirun: --dump-effective:", err)
+			return 1
+		}
+		return 0
+	}
+
+	rn, err := newRunner(r, &instr, opts, extraArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+
+	if opts.plan {
+		rn.printPlan()
+		return 0
+	}
+
+	if err := rn.confirm(); err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+
+	if opts.detach {
+		return rn.detach(opts.pidFile)
+	}
+
+	var code int
+	if opts.repeat > 1 || opts.repeatUntilFailure {
+		code, err = rn.repeat(context.Background())
+	} else {
+		code, _, err = rn.execute(context.Background())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "multirun:", err)
+		return 1
+	}
+	return code
+}
+
+// prepare checks instr for duplicate tags, applies opts to it and resolves
+// its commands through r, ready for newRunner: jobs_spec, labels,
+// placeholders, command selection, and the runfiles paths, env files and
+// hooks of every command. extraArgs fall back to default_extra_args.
+func prepare(r resolver, instr *Instructions, opts *options, extraArgs *commandArgs) error {
+	// Before any filtering, so that whether a duplicate is reported does
+	// not depend on --only, disabled or --rerun-failed
+	if !opts.allowDuplicateTags {
+		if err := checkDuplicateTags(instr.Commands); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if instr.JobsSpec != "" {
+		instr.Jobs, err = parseJobsSpec(instr.JobsSpec, runtime.NumCPU())
+		if err != nil {
+			return fmt.Errorf("jobs_spec: %w", err)
+		}
+	}
+	debugf("loaded %d commands, jobs=%d, keep_going=%t, buffer_output=%t, workspace_name=%q",
+		len(instr.Commands), instr.Jobs, instr.KeepGoing, instr.BufferOutput, instr.WorkspaceName)
+
+	if opts.jobs >= 0 {
+		debugf("--jobs=%d overrides jobs=%d", opts.jobs, instr.Jobs)
+		instr.Jobs = opts.jobs
+	}
+	if opts.keepGoing.set {
+		debugf("--keep-going=%t overrides keep_going=%t", opts.keepGoing.value, instr.KeepGoing)
+		instr.KeepGoing = opts.keepGoing.value
+	}
+	if opts.buffer.set {
+		debugf("--buffer=%t overrides buffer_output=%t", opts.buffer.value, instr.BufferOutput)
+		instr.BufferOutput = opts.buffer.value
+	}
+	if opts.maxFailures >= 0 {
+		instr.MaxFailures = opts.maxFailures
+	}
+
+	if len(opts.labels) > 0 {
+		if err := applyLabels(instr.Commands, opts.labels); err != nil {
+			return fmt.Errorf("--label: %w", err)
+		}
+	}
+
+	expandPlaceholders(instr.Commands, instr.Jobs)
+
+	// Extra args: command-line ones replace default_extra_args entirely
+	// rather than adding to them. --args-for args are appended after
+	// either, for their tag only.
+	if len(extraArgs.global) == 0 {
+		extraArgs.global = instr.DefaultExtraArgs
+	}
+
+	if len(opts.only) > 0 {
+		instr.Commands, err = selectCommands(instr.Commands, opts.only)
+		if err != nil {
+			return fmt.Errorf("--only: %w", err)
+		}
+	}
+
+	if !opts.runDisabled {
+		instr.Commands = dropDisabled(instr.Commands)
+	}
+
+	if opts.rerunFailed != "" {
+		instr.Commands, err = selectFailed(instr.Commands, opts.rerunFailed)
+		if err != nil {
+			return fmt.Errorf("--rerun-failed: %w", err)
+		}
+		if len(instr.Commands) == 0 {
+			fmt.Fprintln(os.Stderr, "multirun: --rerun-failed: no failed commands to rerun")
+		}
+	}
+
+	if opts.failOnEmpty && len(instr.Commands) == 0 {
+		return errors.New("no commands to run")
 	}
 
 	// Replace short_paths with runfiles absolute paths
 	for i := range instr.Commands {
-		p, err := scriptPath(r, instr.WorkspaceName, instr.Commands[i].Path)
+		p, err := commandPath(r, instr.WorkspaceName, instr.Commands[i])
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
+		debugf("%s: resolved %s -> %s", instr.Commands[i].Tag, instr.Commands[i].Path, p)
 		instr.Commands[i].Path = p
+
+		if err := resolveEnvFile(r, instr.WorkspaceName, &instr.Commands[i]); err != nil {
+			return fmt.Errorf("env_file: %w", err)
+		}
+		applyEnvOverrides(&instr.Commands[i], opts.env, opts.envFor[instr.Commands[i].Tag])
+		instr.inheritEnvTo(&instr.Commands[i])
+		if fp := instr.Commands[i].FingerprintFile; fp != "" {
+			p, err := scriptPath(r, instr.WorkspaceName, fp)
+			if err != nil {
+				return fmt.Errorf("fingerprint_file: %w", err)
+			}
+			instr.Commands[i].FingerprintFile = p
+		}
+		if n := instr.Commands[i].Nice; n < -20 || n > 19 {
+			instr.Commands[i].Nice = min(max(n, -20), 19)
+			fmt.Fprintf(os.Stderr, "multirun: %s: nice %d out of range, using %d\n", instr.Commands[i].Tag, n, instr.Commands[i].Nice)
+		}
+		if cpus := instr.Commands[i].CpuAffinity; len(cpus) > 0 {
+			instr.Commands[i].CpuAffinity = clampCPUs(instr.Commands[i].Tag, cpus)
+		}
+		if u := instr.Commands[i].Umask; u != nil && (*u < 0 || *u > 0o777) {
+			return fmt.Errorf("%s: umask %d out of range (0 to 511, that is 0777)", instr.Commands[i].Tag, *u)
+		}
+		if c := instr.Commands[i]; c.MemoryLimitMb < 0 || c.CpuQuotaPercent < 0 {
+			return fmt.Errorf("%s: memory_limit_mb and cpu_quota_percent cannot be negative", c.Tag)
+		}
+		if check := instr.Commands[i].ReadyCheck; check != nil {
+			if err := check.validate(instr.Commands[i].Tag); err != nil {
+				return err
+			}
+		}
+		if h := instr.Commands[i].OnFailure; h != nil {
+			if err := resolveHook(r, instr.WorkspaceName, h); err != nil {
+				return fmt.Errorf("%s: on_failure: %w", instr.Commands[i].Tag, err)
+			}
+			instr.inheritEnvTo(h)
+		}
+		if stdinFile := instr.Commands[i].StdinFile; stdinFile != "" {
+			p, err := scriptPath(r, instr.WorkspaceName, stdinFile)
+			if err != nil {
+				return fmt.Errorf("stdin_file: %w", err)
+			}
+			instr.Commands[i].StdinFile = p
+		}
 	}
+	if f := instr.Finalizer; f != nil {
+		if err := resolveHook(r, instr.WorkspaceName, f); err != nil {
+			return fmt.Errorf("finalizer: %w", err)
+		}
+		instr.inheritEnvTo(f)
+	}
+	if b := instr.BeforeAll; b != nil {
+		if err := resolveHook(r, instr.WorkspaceName, b); err != nil {
+			return fmt.Errorf("before_all: %w", err)
+		}
+		instr.inheritEnvTo(b)
+	}
+	return nil
+}
 
-	var ok bool
-	if instr.Jobs == 0 {
-		ok = runParallel(&instr, r, extraArgs)
-	} else {
-		ok = runSerial(&instr, r, extraArgs)
+// newRunner checks the prepared instr against opts and sets up the runner
+// for it.
+func newRunner(r resolver, instr *Instructions, opts *options, extraArgs commandArgs) (*runner, error) {
+	if instr.PreflightCheck {
+		cmds := instr.Commands[:len(instr.Commands):len(instr.Commands)]
+		if instr.BeforeAll != nil {
+			cmds = append(cmds, *instr.BeforeAll)
+		}
+		if instr.Finalizer != nil {
+			cmds = append(cmds, *instr.Finalizer)
+		}
+		if err := preflight(cmds); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every --args-for tag must name a command
+	for tag := range opts.argsFor {
+		if !hasTag(instr.Commands, tag) {
+			return nil, fmt.Errorf("--args-for: no command tagged %q", tag)
+		}
+	}
+
+	for tag := range opts.envFor {
+		if !hasTag(instr.Commands, tag) {
+			return nil, fmt.Errorf("--env-for: no command tagged %q", tag)
+		}
+	}
+
+	if opts.outputDir != "" && instr.Pty {
+		fmt.Fprintln(os.Stderr, "multirun: warning: a pty merges stderr into stdout, so --output-dir writes empty .err files")
+	}
+	for _, dir := range []string{instr.LogDir, instr.StateDir, opts.outputDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range instr.Commands {
+		c := &instr.Commands[i]
+		if c.TimeoutKillSignal == "" {
+			c.TimeoutKillSignal = instr.TimeoutKillSignal
+		}
+		if c.TimeoutKillGraceMs == 0 {
+			c.TimeoutKillGraceMs = instr.TimeoutKillGraceMs
+		}
+		if _, err := parseSignal(c.TimeoutKillSignal, syscall.SIGKILL); err != nil {
+			return nil, fmt.Errorf("%s: timeout_kill_signal: %w", c.Tag, err)
+		}
+	}
+
+	for group, limit := range instr.GroupLimits {
+		if limit < 0 {
+			return nil, fmt.Errorf("group_limits: negative limit %d for group %q", limit, group)
+		}
+	}
+
+	if opts.maxLineLength < 0 {
+		return nil, fmt.Errorf("--max-line-length: negative length %d", opts.maxLineLength)
+	}
+	if opts.maxOutputRate < 0 {
+		return nil, fmt.Errorf("--max-output-rate: negative rate %d", opts.maxOutputRate)
+	}
+
+	if instr.OutputMode != "" && instr.OutputMode != outputModeSummary {
+		return nil, fmt.Errorf("unknown output_mode %q (want %q)", instr.OutputMode, outputModeSummary)
+	}
+
+	if err := validateExitPolicy(instr.ExitPolicy); err != nil {
+		return nil, err
+	}
+
+	if opts.shuffle {
+		seed := opts.seed
+		if !opts.seedSet {
+			seed = time.Now().UnixNano()
+			fmt.Fprintf(os.Stderr, "multirun: shuffling commands with --seed=%d\n", seed)
+		}
+		shuffleCommands(instr.Commands, seed)
+	}
+
+	if opts.warmup {
+		opts.warmupCount = max(opts.warmupCount, 1)
+	}
+	if opts.warmupCount < 0 {
+		return nil, fmt.Errorf("--warmup-count: negative count %d", opts.warmupCount)
+	}
+	if opts.detach {
+		switch {
+		case opts.pidFile == "":
+			return nil, errors.New("--detach needs --pid-file")
+		case len(opts.watch) > 0:
+			return nil, errors.New("--detach cannot be combined with --watch")
+		case instr.Pty:
+			return nil, errors.New("--detach cannot be combined with pty")
+		case opts.repeat > 1 || opts.repeatUntilFailure:
+			return nil, errors.New("--detach cannot be combined with --repeat")
+		case opts.warmupCount > 0:
+			return nil, errors.New("--detach cannot be combined with --warmup")
+		case instr.BeforeAll != nil:
+			return nil, errors.New("--detach cannot be combined with before_all")
+		case instr.LockFile != "":
+			return nil, errors.New("--detach cannot be combined with lock_file")
+		case slices.ContainsFunc(instr.Commands, func(c Command) bool { return len(c.Needs) > 0 }):
+			return nil, errors.New("--detach cannot be combined with needs: nothing waits for the commands to succeed")
+		}
+	}
+	if opts.repeat < 0 {
+		return nil, fmt.Errorf("--repeat: negative count %d", opts.repeat)
+	}
+	if (opts.repeat > 1 || opts.repeatUntilFailure) && len(opts.watch) > 0 {
+		return nil, errors.New("--repeat cannot be combined with --watch")
+	}
+
+	if instr.Pty {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("pty is only supported on Linux")
+		}
+		if instr.ForwardStdin || instr.ForwardStdinTo != "" {
+			return nil, errors.New("pty cannot be combined with forward_stdin")
+		}
+	}
+
+	format, err := newOutputFormatter(instr.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.jsonLogs {
+		if _, plain := format.(plainFormat); !plain {
+			return nil, fmt.Errorf("--json-logs cannot be combined with output_format %q", instr.OutputFormat)
+		}
+		if instr.BufferOutput || instr.PrintCommand {
+			fmt.Fprintln(os.Stderr, "multirun: warning: --json-logs writes every line as it comes, ignoring buffer_output and print_command")
+			instr.BufferOutput, instr.PrintCommand = false, false
+		}
+	}
+
+	killSig, err := parseSignal(instr.ChildKillSignal, syscall.SIGINT)
+	if err != nil {
+		return nil, fmt.Errorf("child_kill_signal: %w", err)
+	}
+
+	for _, c := range instr.Commands {
+		if c.StdinFile != "" && (instr.ForwardStdin && instr.ForwardStdinTo == "" || instr.ForwardStdinTo == c.Tag) {
+			return nil, fmt.Errorf("%s: stdin_file cannot be combined with forward_stdin", c.Tag)
+		}
 	}
 
-	if ok {
-		os.Exit(0)
+	if instr.BufferOutput && instr.Jobs != 1 && (instr.ForwardStdin || instr.ForwardStdinTo != "") {
+		fmt.Fprintln(os.Stderr, "multirun: warning: forward_stdin with buffer_output: commands get input while their output is held back, so prompts and replies will not line up")
+	}
+
+	if instr.ForwardStdinTo != "" && !hasTag(instr.Commands, instr.ForwardStdinTo) {
+		return nil, fmt.Errorf("forward_stdin_to: no command tagged %q", instr.ForwardStdinTo)
+	}
+
+	if instr.CheckpointFile != "" && instr.Jobs != 1 {
+		fmt.Fprintln(os.Stderr, "multirun: warning: checkpoint_file only applies to serial runs, ignoring it")
+	}
+	if instr.Jobs == 1 && slices.ContainsFunc(instr.Commands, func(c Command) bool { return c.ReadyCheck != nil }) {
+		fmt.Fprintln(os.Stderr, "multirun: warning: ready_check only applies to parallel runs, ignoring it")
+	}
+
+	if opts.continueFrom != "" {
+		if instr.Jobs != 1 {
+			fmt.Fprintln(os.Stderr, "multirun: warning: --continue-from only applies to serial runs, ignoring it")
+		} else if !hasTag(instr.Commands, opts.continueFrom) {
+			return nil, fmt.Errorf("--continue-from: no command tagged %q", opts.continueFrom)
+		}
+	}
+
+	graph, err := newDepGraph(instr.Commands)
+	if err != nil {
+		return nil, err
+	}
+
+	rn := &runner{
+		instr:        instr,
+		r:            r,
+		extraArgs:    extraArgs,
+		graph:        graph,
+		opts:         opts,
+		killSig:      killSig,
+		format:       format,
+		fingerprints: make([]string, len(instr.Commands)),
+	}
+	rn.colors, err = useColor(opts.color, os.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("--color: %w", err)
+	}
+	if opts.highlight != "" {
+		if rn.highlight, err = regexp.Compile(opts.highlight); err != nil {
+			return nil, fmt.Errorf("--highlight: %w", err)
+		}
+		rn.matches = make([]atomic.Int64, len(instr.Commands))
+	}
+	if opts.stopOnOutput != "" {
+		if rn.stopOnOutput, err = regexp.Compile(opts.stopOnOutput); err != nil {
+			return nil, fmt.Errorf("--stop-on-output: %w", err)
+		}
+	}
+	rn.prefixWidth, err = prefixWidth(opts.prefixWidth, instr.Commands)
+	if err != nil {
+		return nil, fmt.Errorf("--output-prefix-width: %w", err)
+	}
+	if len(instr.InheritFds) > 0 {
+		if runtime.GOOS == "windows" {
+			return nil, errors.New("inherit_fds is only supported on Unix")
+		}
+		if rn.fds, err = openFds(instr.InheritFds); err != nil {
+			return nil, fmt.Errorf("inherit_fds: %w", err)
+		}
+	}
+	if opts.secretCommand != "" {
+		rn.secrets = newSecretSource(opts.secretCommand)
+	}
+	if instr.TranscriptFile != "" {
+		if rn.transcript, err = openTranscript(instr.TranscriptFile); err != nil {
+			return nil, fmt.Errorf("transcript_file: %w", err)
+		}
+	}
+	if opts.eventsFd >= 0 {
+		rn.events, err = openEventStream(opts.eventsFd)
+		if err != nil {
+			return nil, fmt.Errorf("--events-fd: %w", err)
+		}
+	}
+	return rn, nil
+}
+
+// execute runs the commands under lock_file, with before_all and the
+// --warmup runs ahead of them and the finalizer after, and writes the --report and --exit-code-file
+// files. It returns multirun's exit code and how every command finished;
+// the error is set only when the run could not start.
+func (rn *runner) execute(ctx context.Context) (int, *runResult, error) {
+	instr, opts := rn.instr, rn.opts
+	if instr.LockFile != "" {
+		lock, err := acquireLock(instr.LockFile, opts.lockWait)
+		if err != nil {
+			return 1, nil, err
+		}
+		defer lock.Close()
+	}
+	prepareCgroups(instr.Commands)
+
+	// Started here, as execute closes it: --repeat runs it more than once
+	if opts.maxOutputRate > 0 {
+		rn.rate = newRateLimiter(opts.maxOutputRate)
+	}
+
+	ctx, rn.stopRun = context.WithCancelCause(ctx)
+	defer rn.stopRun(nil)
+	rn.tripped.Store(false)
+
+	runStart := time.Now()
+	if instr.MaxRuntimeSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(instr.MaxRuntimeSeconds)*time.Second)
+		defer cancel()
+	}
+
+	if instr.OutputMode == outputModeSummary && !(instr.BufferOutput && instr.Jobs != 1) {
+		fmt.Fprintln(os.Stderr, "multirun: warning: output_mode summary only applies to parallel runs with buffer_output, ignoring it")
+	}
+	if opts.tail >= 0 && !(instr.BufferOutput && instr.Jobs != 1) {
+		fmt.Fprintln(os.Stderr, "multirun: warning: --tail only applies to parallel runs with buffer_output, ignoring it")
+	}
+	setupFailed := false
+	if instr.BeforeAll != nil {
+		setupFailed = rn.runHook("before_all", *instr.BeforeAll, nil) != nil
+	}
+	warmupInterrupted := false
+	if !setupFailed || instr.KeepGoing {
+		warmupInterrupted = !rn.warmup(ctx)
+	}
+
+	var res *runResult
+	switch {
+	case setupFailed && !instr.KeepGoing:
+		fmt.Fprintln(os.Stderr, "multirun: before_all failed, not running the commands")
+		res = newRunResult(len(instr.Commands))
+	case warmupInterrupted:
+		res = newRunResult(len(instr.Commands))
+		res.interrupted = true
+	case len(opts.watch) > 0:
+		res = rn.watch(ctx, watchPaths(opts.watch))
+	default:
+		res = rn.run(ctx)
+	}
+
+	res.reportRetries(instr.Commands)
+	rn.printHighlights(res)
+	code := exitCode(instr.ExitPolicy, res)
+	if setupFailed && code == 0 {
+		code = 1
+	}
+	if res.interrupted {
+		code = exitInterrupted
+	}
+	if rn.tripped.Load() && code == 0 {
+		code = 1
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(os.Stderr, "multirun: exceeded global time budget of %ds\n", instr.MaxRuntimeSeconds)
+		if code == 0 {
+			code = 1
+		}
+	}
+	if instr.Finalizer != nil {
+		if err := rn.runFinalizer(code == 0); err != nil && code == 0 {
+			code = 1
+		}
+	}
+	if rn.rate != nil {
+		rn.rate.close()
+	}
+	if opts.report != "" {
+		if err := writeReport(opts.report, instr.Commands, res, code, time.Since(runStart)); err != nil {
+			fmt.Fprintln(os.Stderr, "multirun: --report:", err)
+			if code == 0 {
+				code = 1
+			}
+		}
+	}
+	if opts.exitCodeFile != "" {
+		if err := writeExitCodes(opts.exitCodeFile, instr.Commands, res); err != nil {
+			fmt.Fprintln(os.Stderr, "multirun: --exit-code-file:", err)
+			if code == 0 {
+				code = 1
+			}
+		}
 	}
-	os.Exit(1)
+	return code, res, nil
 }
@@ -0,0 +1,753 @@
+package multirun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptDir writes each name: body pair as an executable shell script in a
+// fresh directory, which a Runner can use as its RunfilesRoot.
+func scriptDir(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs Unix shell scripts")
+	}
+	dir := t.TempDir()
+	for name, body := range scripts {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// capture returns what fn writes to *f, which is os.Stdout or os.Stderr.
+func capture(t *testing.T, f **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *f
+	*f = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	defer func() { *f = saved }()
+	fn()
+	w.Close()
+	return <-out
+}
+
+// run runs instr with the scripts of dir as its runfiles, failing the test
+// if the run cannot start.
+func run(t *testing.T, dir string, instr Instructions, extraArgs ...string) Result {
+	t.Helper()
+	r := &Runner{RunfilesRoot: dir}
+	res, err := r.Run(context.Background(), instr, extraArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// statuses maps every command's tag to its status.
+func statuses(res Result) map[string]string {
+	m := map[string]string{}
+	for _, c := range res.Commands {
+		m[c.Tag] = c.Status
+	}
+	return m
+}
+
+func TestVerbose(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	verbose.Store(true)
+	defer verbose.Store(false)
+
+	out := capture(t, &os.Stderr, func() {
+		run(t, dir, Instructions{Commands: []Command{{Path: "ok.sh", Tag: "ok"}}, Jobs: 1})
+	})
+	for _, want := range []string{
+		"ok: resolved ok.sh -> " + filepath.Join(dir, "ok.sh"),
+		"ok: started pid ",
+		"exited with code 0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("verbose output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestQuietByDefault(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	out := capture(t, &os.Stderr, func() {
+		run(t, dir, Instructions{Commands: []Command{{Path: "ok.sh", Tag: "ok"}}, Jobs: 1})
+	})
+	if strings.Contains(out, "multirun: debug:") {
+		t.Errorf("debug output without --verbose:\n%s", out)
+	}
+}
+
+func TestJobsLimitStopsAtFirstFailure(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"fail.sh":  "exit 1",
+		"sleep.sh": "exec sleep 5",
+		"ok.sh":    "exit 0",
+	})
+	instr := Instructions{
+		Commands: []Command{
+			{Path: "fail.sh", Tag: "a"},
+			{Path: "sleep.sh", Tag: "b"},
+			{Path: "ok.sh", Tag: "c"},
+		},
+		Jobs: 2,
+	}
+	var res Result
+	capture(t, &os.Stderr, func() { res = run(t, dir, instr) })
+	if res.ExitCode == 0 {
+		t.Error("run succeeded despite a failing command")
+	}
+	got := statuses(res)
+	if got["a"] != "failed" || got["b"] != "failed" || got["c"] != "skipped" {
+		t.Errorf("statuses = %v, want a and b failed, c skipped", got)
+	}
+	if d := res.Commands[1].Duration; d >= 5*time.Second {
+		t.Errorf("b ran for %v; it should have been stopped", d)
+	}
+
+	instr.KeepGoing = true
+	instr.Commands[1].Path = "ok.sh"
+	capture(t, &os.Stderr, func() { res = run(t, dir, instr) })
+	if got := statuses(res); got["a"] != "failed" || got["b"] != "succeeded" || got["c"] != "succeeded" {
+		t.Errorf("with keep_going, statuses = %v, want only a failed", got)
+	}
+}
+
+func TestUnlimitedJobsRunEverything(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"fail.sh": "exit 1", "ok.sh": "exit 0"})
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: []Command{
+			{Path: "fail.sh", Tag: "a"},
+			{Path: "ok.sh", Tag: "b"},
+		}})
+	})
+	if got := statuses(res); got["a"] != "failed" || got["b"] != "succeeded" {
+		t.Errorf("statuses = %v, want a failed and b succeeded", got)
+	}
+}
+
+// recorder is a script that sleeps for its second argument, if any, then
+// appends its first to the file log next to it; see recorded.
+const recorder = `sleep "${2:-0}"; echo "$1" >> "$(dirname "$0")/log"`
+
+// recorded returns what the recorder scripts of dir logged, in order.
+func recorded(t *testing.T, dir string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func TestNeedsOrdersParallelRun(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	res := run(t, dir, Instructions{Commands: []Command{
+		{Path: "rec.sh", Tag: "serve", Args: []string{"serve"}, Needs: []string{"seed"}},
+		{Path: "rec.sh", Tag: "seed", Args: []string{"seed"}, Needs: []string{"migrate"}},
+		{Path: "rec.sh", Tag: "migrate", Args: []string{"migrate", "0.2"}},
+	}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	if got, want := recorded(t, dir), []string{"migrate", "seed", "serve"}; !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestFailedDependencySkipsDependents(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder, "fail.sh": "exit 1"})
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{
+			Commands: []Command{
+				{Path: "fail.sh", Tag: "migrate"},
+				{Path: "rec.sh", Tag: "seed", Args: []string{"seed"}, Needs: []string{"migrate"}},
+				{Path: "rec.sh", Tag: "serve", Args: []string{"serve"}, Needs: []string{"seed"}},
+				{Path: "rec.sh", Tag: "lint", Args: []string{"lint"}},
+			},
+			KeepGoing: true,
+		})
+	})
+	if res.ExitCode == 0 {
+		t.Error("run succeeded despite a failed dependency")
+	}
+	want := map[string]string{"migrate": "failed", "seed": "skipped", "serve": "skipped", "lint": "succeeded"}
+	if got := statuses(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if r := res.Commands[2].Reason; !strings.Contains(r, "migrate") {
+		t.Errorf("serve skipped for %q, want the failed dependency named", r)
+	}
+	if got := recorded(t, dir); !slices.Equal(got, []string{"lint"}) {
+		t.Errorf("ran %v, want only lint", got)
+	}
+}
+
+func TestCheckDuplicateTags(t *testing.T) {
+	if err := checkDuplicateTags([]Command{{Tag: "a"}, {Tag: ""}, {Tag: ""}, {Tag: "b"}}); err != nil {
+		t.Errorf("distinct and empty tags: %v", err)
+	}
+	err := checkDuplicateTags([]Command{{Tag: "a"}, {Tag: "b"}, {Tag: "a"}})
+	if err == nil || !strings.Contains(err.Error(), "commands[0] and commands[2]") {
+		t.Errorf("err = %v, want both positions named", err)
+	}
+}
+
+func TestDuplicateTagsRefusedBeforeSelection(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	instr := `{"commands": [
+  {"path": "ok.sh", "tag": "a"},
+  {"path": "ok.sh", "tag": "a", "disabled": true},
+  {"path": "ok.sh", "tag": "b"}
+], "jobs": 1}`
+	for _, flags := range [][]string{nil, {"--only=b"}} {
+		code, _, stderr := mainRun(t, dir, instr, flags...)
+		if code == 0 || !strings.Contains(stderr, "duplicate") {
+			t.Errorf("flags %q: exit code %d, stderr %q: want the duplicate refused", flags, code, stderr)
+		}
+	}
+}
+
+func TestDuplicateTagsRefused(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	instr := Instructions{Commands: []Command{{Path: "ok.sh", Tag: "a"}, {Path: "ok.sh", Tag: "a"}}, Jobs: 1}
+	if _, err := (&Runner{RunfilesRoot: dir}).Run(context.Background(), instr, nil); err == nil {
+		t.Error("duplicate tags were accepted")
+	}
+}
+
+// mainRun writes instr as dir's instructions file and runs Main on it with
+// the scripts of dir as runfiles and flags, returning the exit code and
+// what was written to stdout and stderr.
+func mainRun(t *testing.T, dir, instr string, flags ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	path := filepath.Join(dir, "instr.json")
+	if err := os.WriteFile(path, []byte(instr), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{path, "--runfiles-root=" + dir}, flags...)
+	stdout = capture(t, &os.Stdout, func() {
+		stderr = capture(t, &os.Stderr, func() { code = Main(append(args, "--")) })
+	})
+	return code, stdout, stderr
+}
+
+func TestContinueFrom(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	code, _, stderr := mainRun(t, dir, `{"commands": [
+  {"path": "rec.sh", "tag": "a", "args": ["a"]},
+  {"path": "rec.sh", "tag": "b", "args": ["b"]},
+  {"path": "rec.sh", "tag": "c", "args": ["c"]}
+], "jobs": 1}`, "--continue-from=b")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	if got := recorded(t, dir); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("ran %v, want [b c]", got)
+	}
+	if code, _, _ := mainRun(t, dir, `{"commands": [{"path": "rec.sh", "tag": "a"}], "jobs": 1}`, "--continue-from=nope"); code == 0 {
+		t.Error("--continue-from with an unknown tag succeeded")
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	cmds := []Command{
+		{Tag: "shard", Args: []string{"--shard={{index}}/{{jobs}}", "--name={{tag}}"}},
+		{Tag: "other", Args: []string{"{{index}}", "{{nope}}"}},
+	}
+	stderr := capture(t, &os.Stderr, func() { expandPlaceholders(cmds, 4) })
+	if want := []string{"--shard=0/4", "--name=shard"}; !slices.Equal(cmds[0].Args, want) {
+		t.Errorf("args = %q, want %q", cmds[0].Args, want)
+	}
+	if want := []string{"1", "{{nope}}"}; !slices.Equal(cmds[1].Args, want) {
+		t.Errorf("args = %q, want %q", cmds[1].Args, want)
+	}
+	if !strings.Contains(stderr, "other: unknown placeholder {{nope}}") {
+		t.Errorf("stderr = %q, want a warning about {{nope}}", stderr)
+	}
+}
+
+// resolverFunc adapts a function to the resolver interface.
+type resolverFunc func(string) (string, error)
+
+func (f resolverFunc) Rlocation(path string) (string, error) { return f(path) }
+
+func TestScriptPath(t *testing.T) {
+	echo := resolverFunc(func(p string) (string, error) { return "/runfiles/" + p, nil })
+	tests := map[string]string{
+		"bin/tool":                "/runfiles/_main/bin/tool",
+		`bin\tool`:                "/runfiles/_main/bin/tool",
+		"../+rules_foo+bar/tool":  "/runfiles/+rules_foo+bar/tool",
+		`..\rules_x\sub\..\tool`:  "/runfiles/rules_x/tool",
+		"../rules_x/nested/a/bin": "/runfiles/rules_x/nested/a/bin",
+	}
+	for p, want := range tests {
+		if got, err := scriptPath(echo, "_main", p); err != nil || got != want {
+			t.Errorf("scriptPath(%q) = %q, %v, want %q", p, got, err, want)
+		}
+	}
+	missing := resolverFunc(func(string) (string, error) { return "", nil })
+	if _, err := scriptPath(missing, "_main", "bin/tool"); err == nil || !strings.Contains(err.Error(), "_main/bin/tool") {
+		t.Errorf("err = %v, want the runfiles path reported as not found", err)
+	}
+}
+
+func TestInlineCommand(t *testing.T) {
+	dir := scriptDir(t, nil)
+	var res Result
+	stdout := capture(t, &os.Stdout, func() {
+		res = run(t, dir, Instructions{Commands: []Command{
+			{Tag: "greet", Command: `echo "hello $1 $2"`, Args: []string{"inline"}},
+		}, Jobs: 1}, "world")
+	})
+	if res.ExitCode != 0 || !strings.Contains(stdout, "hello inline world") {
+		t.Errorf("exit %d, stdout %q, want args and extra args as positional parameters", res.ExitCode, stdout)
+	}
+	for _, blob := range []Command{{Tag: "both", Path: "x.sh", Command: "true"}, {Tag: "neither"}} {
+		if _, err := commandPath(dirResolver{dir}, "", blob); err == nil {
+			t.Errorf("%s: path and command accepted", blob.Tag)
+		}
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"fail.sh": "exit 3",
+		"ok.sh":   "exit 0",
+		"note.sh": `echo "$MULTIRUN_FAILED_TAG:$MULTIRUN_FAILED_CODE" >> "$(dirname "$0")/log"`,
+	})
+	note := &Command{Path: "note.sh"}
+	res := run(t, dir, Instructions{Commands: []Command{
+		{Path: "fail.sh", Tag: "fail", OnFailure: note},
+		{Path: "ok.sh", Tag: "ok", OnFailure: note},
+	}, Jobs: 0})
+	if got := recorded(t, dir); !slices.Equal(got, []string{"fail:3"}) {
+		t.Errorf("on_failure ran with %v, want once for fail with its exit code", got)
+	}
+	if res.ExitCode == 0 {
+		t.Error("the run succeeded although a command failed")
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"recfail.sh": recorder + "\nexit 1"})
+	var cmds []Command
+	for _, tag := range []string{"a", "b", "c", "d"} {
+		cmds = append(cmds, Command{Path: "recfail.sh", Tag: tag, Args: []string{tag}})
+	}
+	var res Result
+	stderr := capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: cmds, Jobs: 1, KeepGoing: true, MaxFailures: 2})
+	})
+	if got := recorded(t, dir); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("ran %v, want the run stopped after 2 failures", got)
+	}
+	if got := statuses(res); got["c"] != "not_run" || got["d"] != "not_run" {
+		t.Errorf("statuses = %v, want c and d not run", got)
+	}
+	if !strings.Contains(stderr, "2 commands failed (max_failures), stopping") {
+		t.Errorf("stderr = %q, want the stop reported", stderr)
+	}
+}
+
+func TestBeforeAll(t *testing.T) {
+	scripts := map[string]string{"rec.sh": recorder, "recfail.sh": recorder + "\nexit 1"}
+	dir := scriptDir(t, scripts)
+	cmds := []Command{{Path: "rec.sh", Tag: "a", Args: []string{"a"}}}
+	res := run(t, dir, Instructions{Commands: cmds, Jobs: 0, BeforeAll: &Command{Path: "rec.sh", Args: []string{"setup"}}})
+	if got := recorded(t, dir); res.ExitCode != 0 || !slices.Equal(got, []string{"setup", "a"}) {
+		t.Errorf("exit %d, ran %v, want setup before a", res.ExitCode, got)
+	}
+
+	dir = scriptDir(t, scripts)
+	stderr := capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: cmds, Jobs: 0, BeforeAll: &Command{Path: "recfail.sh", Args: []string{"setup"}}})
+	})
+	if got := recorded(t, dir); res.ExitCode == 0 || !slices.Equal(got, []string{"setup"}) {
+		t.Errorf("exit %d, ran %v, want nothing after a failed before_all", res.ExitCode, got)
+	}
+	if !strings.Contains(stderr, "before_all failed, not running the commands") {
+		t.Errorf("stderr = %q, want the failed setup reported", stderr)
+	}
+}
+
+func TestFinalizer(t *testing.T) {
+	for _, tt := range []struct {
+		name, cmd, finalizer string
+		want                 string
+		wantCode             int
+	}{
+		{"after success", "exit 0", "exit 0", "success", 0},
+		{"after failure", "exit 3", "exit 0", "failure", 1},
+		{"failing finalizer", "exit 0", "exit 1", "success", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := scriptDir(t, map[string]string{
+				"cmd.sh": tt.cmd,
+				"fin.sh": `echo "$MULTIRUN_RESULT" >> "$(dirname "$0")/log"; ` + tt.finalizer,
+			})
+			var res Result
+			capture(t, &os.Stderr, func() {
+				res = run(t, dir, Instructions{
+					Commands:  []Command{{Path: "cmd.sh", Tag: "cmd"}},
+					Jobs:      1,
+					Finalizer: &Command{Path: "fin.sh", Tag: "fin"},
+				})
+			})
+			if got := recorded(t, dir); !slices.Equal(got, []string{tt.want}) {
+				t.Errorf("finalizer saw MULTIRUN_RESULT %q, want %q", got, tt.want)
+			}
+			if res.ExitCode != tt.wantCode {
+				t.Errorf("exit code %d, want %d", res.ExitCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestMsysPath(t *testing.T) {
+	for in, want := range map[string]string{
+		`C:\tools\lint.sh`: "/c/tools/lint.sh",
+		`d:\a b\c`:         "/d/a b/c",
+		"E:/x/y":           "/e/x/y",
+		"C:":               "/c",
+		`\\server\share`:   `\\server\share`,
+		"/already/unix":    "/already/unix",
+		"1:/not/a/drive":   "1:/not/a/drive",
+		"c":                "c",
+	} {
+		if got := msysPath(in); got != want {
+			t.Errorf("msysPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBashArgs(t *testing.T) {
+	for _, tt := range []struct {
+		msystem, shArgs string
+		path            string
+		want            []string
+	}{
+		{"", "", "C:/tools/lint.sh", []string{"-c", `C:/tools/lint.sh "$@"`, "--", "x"}},
+		{"", "", "C:/my tools/lint.sh", []string{"-c", `'C:/my tools/lint.sh' "$@"`, "--", "x"}},
+		{"MINGW64", "", `C:\tools\lint.sh`, []string{"-c", `/c/tools/lint.sh "$@"`, "--", "x"}},
+		{"MINGW64", "-e  -u", "C:/tools/lint.sh", []string{"-e", "-u", "-c", `/c/tools/lint.sh "$@"`, "--", "x"}},
+	} {
+		t.Setenv("MSYSTEM", tt.msystem)
+		t.Setenv("BAZEL_SH_ARGS", tt.shArgs)
+		if got := bashArgs(tt.path, []string{"x"}); !slices.Equal(got, tt.want) {
+			t.Errorf("MSYSTEM=%q BAZEL_SH_ARGS=%q: bashArgs(%q) = %q, want %q", tt.msystem, tt.shArgs, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFailingPreflight(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	r := &Runner{RunfilesRoot: dir}
+	_, err := r.Run(context.Background(), Instructions{
+		Commands: []Command{
+			{Path: "rec.sh", Tag: "a", Args: []string{"a"}},
+			{Path: "gone.sh", Tag: "b"},
+			{Path: "rec.sh", Tag: "c", Args: []string{"c"}},
+		},
+		Jobs:           1,
+		PreflightCheck: true,
+		Finalizer:      &Command{Path: "lost.sh", Tag: "fin"},
+	}, nil)
+	if err == nil {
+		t.Fatal("run started with missing commands")
+	}
+	// Every missing command is reported at once, and none of them runs
+	for _, want := range []string{"2 of 4 commands are missing", "b: ", "fin: "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to mention %q", err, want)
+		}
+	}
+	if got := recorded(t, dir); len(got) > 0 {
+		t.Errorf("ran %q before the failed preflight", got)
+	}
+}
+
+func TestCheckExecutable(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"ok.sh": 0o755, "plain.txt": 0o644} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		blob Command
+		want string // in the error; empty for none
+	}{
+		{"executable", Command{Tag: "t", Path: filepath.Join(dir, "ok.sh")}, ""},
+		{"inline", Command{Tag: "t", Command: "true"}, ""},
+		{"not found", Command{Tag: "t", Path: filepath.Join(dir, "missing")}, "t: command not found: "},
+		{"directory", Command{Tag: "t", Path: dir}, "t: command path is a directory: "},
+		{"not executable", Command{Tag: "t", Path: filepath.Join(dir, "plain.txt")}, "t: command is not executable (no +x): "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "not executable" && runtime.GOOS == "windows" {
+				t.Skip("Windows has no exec bit")
+			}
+			err := checkExecutable(tt.blob)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+				t.Errorf("err = %v, want it to start with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartupDelayStaggersLaunches(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	begin := time.Now()
+	res := run(t, dir, Instructions{StartupDelayMs: 300, Commands: []Command{
+		{Path: "rec.sh", Tag: "a", Args: []string{"a"}},
+		{Path: "rec.sh", Tag: "b", Args: []string{"b"}},
+		{Path: "rec.sh", Tag: "c", Args: []string{"c"}},
+	}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	// Three launches are two delays apart
+	if d := time.Since(begin); d < 600*time.Millisecond {
+		t.Errorf("run took %s, want at least 600ms", d)
+	}
+	if got, want := recorded(t, dir), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestProgressLines(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0", "slow.sh": "sleep 0.6"})
+	stderr := capture(t, &os.Stderr, func() {
+		run(t, dir, Instructions{ProgressIntervalMs: 100, Commands: []Command{
+			{Path: "ok.sh", Tag: "quick"},
+			{Path: "slow.sh", Tag: "slow"},
+		}})
+	})
+	if want := "multirun: 1/2 done, running: [slow]\n"; !strings.Contains(stderr, want) {
+		t.Errorf("stderr %q lacks the progress line %q", stderr, want)
+	}
+}
+
+func TestForwardStdinTo(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"read.sh": `cat > "$(dirname "$0")/$1.in"`})
+	withStdin(t, "hello\nworld\n", func() {
+		run(t, dir, Instructions{ForwardStdinTo: "reader", Commands: []Command{
+			{Path: "read.sh", Tag: "reader", Args: []string{"reader"}},
+			{Path: "read.sh", Tag: "other", Args: []string{"other"}},
+		}})
+	})
+	for name, want := range map[string]string{"reader.in": "hello\nworld\n", "other.in": ""} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestStdinQueue(t *testing.T) {
+	r, w := io.Pipe()
+	q := newStdinQueue(w)
+	// Nobody reads yet, and still no write blocks
+	written := make(chan struct{})
+	go func() {
+		for i := range 100 {
+			fmt.Fprintf(q, "line %d\n", i)
+		}
+		q.Close()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on a command not reading its stdin")
+	}
+	if _, err := q.Write([]byte("late\n")); err != os.ErrClosed {
+		t.Errorf("write after Close: err = %v, want os.ErrClosed", err)
+	}
+
+	// The reader gets every line, in order, then EOF
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 100 {
+		t.Fatalf("read %d lines, want 100", len(lines))
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("line %d", i); line != want {
+			t.Fatalf("line %d is %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestStdinFile(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"cat.sh": `cat >> "$(dirname "$0")/log"`})
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("fed from a file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmds := []Command{{Path: "cat.sh", Tag: "cat", StdinFile: "input.txt"}}
+	if res := run(t, dir, Instructions{Commands: cmds, Jobs: 1}); res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	if got := recorded(t, dir); !slices.Equal(got, []string{"fed", "from", "a", "file"}) {
+		t.Errorf("command read %q, want the file", got)
+	}
+
+	r := &Runner{RunfilesRoot: dir}
+	_, err := r.Run(context.Background(), Instructions{Commands: cmds, Jobs: 1, ForwardStdin: true}, nil)
+	if err == nil || !strings.Contains(err.Error(), "stdin_file cannot be combined with forward_stdin") {
+		t.Errorf("err = %v, want stdin_file and forward_stdin refused together", err)
+	}
+}
+
+func TestDelayStartSeconds(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	begin := time.Now()
+	res := run(t, dir, Instructions{Commands: []Command{
+		{Path: "rec.sh", Tag: "late", Args: []string{"late"}, DelayStartSeconds: 1},
+		{Path: "rec.sh", Tag: "early", Args: []string{"early"}},
+		{Path: "rec.sh", Tag: "slow", Args: []string{"slow", "0.3"}},
+	}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	// late waits, while the others start at once
+	if got, want := recorded(t, dir), []string{"early", "slow", "late"}; !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if d := time.Since(begin); d < time.Second {
+		t.Errorf("run took %s, want late held back for 1s", d)
+	}
+
+	// The delay counts from the start of the run, not of the command before
+	dir = scriptDir(t, map[string]string{"rec.sh": recorder})
+	begin = time.Now()
+	run(t, dir, Instructions{Jobs: 1, Commands: []Command{
+		{Path: "rec.sh", Tag: "slow", Args: []string{"slow", "1.2"}},
+		{Path: "rec.sh", Tag: "late", Args: []string{"late"}, DelayStartSeconds: 1},
+	}})
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Errorf("serial run took %s, want late started right after slow", d)
+	}
+}
+
+func TestMaxRuntimeSeconds(t *testing.T) {
+	for _, jobs := range []int{1, 0} {
+		t.Run(fmt.Sprint("jobs=", jobs), func(t *testing.T) {
+			dir := scriptDir(t, map[string]string{"long.sh": "exec sleep 30", "ok.sh": "exit 0"})
+			begin := time.Now()
+			var res Result
+			capture(t, &os.Stderr, func() {
+				// keep_going, so that only the deadline keeps after from running
+				res = run(t, dir, Instructions{Jobs: jobs, MaxRuntimeSeconds: 1, KeepGoing: true, Commands: []Command{
+					{Path: "long.sh", Tag: "long"},
+					{Path: "ok.sh", Tag: "after", DelayStartSeconds: 5},
+				}})
+			})
+			if d := time.Since(begin); d > 10*time.Second {
+				t.Errorf("run took %s, want the long command killed after 1s", d)
+			}
+			if res.ExitCode == 0 {
+				t.Error("exit code 0, want a failure")
+			}
+			long, after := res.Commands[0], res.Commands[1]
+			if long.Status != "failed" {
+				t.Errorf("long: status %q, want failed", long.Status)
+			}
+			if after.Status != "skipped" || after.Reason != "max_runtime_seconds exceeded" {
+				t.Errorf("after: status %q, reason %q, want skipped for max_runtime_seconds exceeded", after.Status, after.Reason)
+			}
+		})
+	}
+}
+
+// member is a script that notes in the file log next to it when it starts
+// and ends, as "+name" and "-name"; see overlap.
+const member = `echo "+$1" >> "$(dirname "$0")/log"; sleep 0.2; echo "-$1" >> "$(dirname "$0")/log"`
+
+// overlap returns the most member scripts of dir that ran at once, among
+// those named name, or among all of them for "".
+func overlap(t *testing.T, dir, name string) int {
+	t.Helper()
+	n, most := 0, 0
+	for _, e := range recorded(t, dir) {
+		if name != "" && e[1:] != name {
+			continue
+		}
+		if e[0] == '+' {
+			n++
+		} else {
+			n--
+		}
+		most = max(most, n)
+	}
+	return most
+}
+
+func TestGroupMembersNeverOverlap(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"member.sh": member})
+	res := run(t, dir, Instructions{Commands: []Command{
+		{Path: "member.sh", Tag: "db1", Args: []string{"db"}, Group: "db"},
+		{Path: "member.sh", Tag: "db2", Args: []string{"db"}, Group: "db"},
+		{Path: "member.sh", Tag: "db3", Args: []string{"db"}, Group: "db"},
+		{Path: "member.sh", Tag: "lint", Args: []string{"lint"}},
+	}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	if n := overlap(t, dir, "db"); n != 1 {
+		t.Errorf("%d db commands ran at once, want 1", n)
+	}
+	// while commands outside the group still run alongside them
+	if n := overlap(t, dir, ""); n != 2 {
+		t.Errorf("%d commands ran at once, want 2", n)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"member.sh": member})
+	var cmds []Command
+	for _, group := range []string{"db", "db", "db", "cache", "cache", "cache"} {
+		cmds = append(cmds, Command{Path: "member.sh", Tag: fmt.Sprint(group, len(cmds)), Args: []string{group}, Group: group})
+	}
+	res := run(t, dir, Instructions{Commands: cmds, GroupLimits: map[string]int{"db": 2, "cache": 0}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	if n := overlap(t, dir, "db"); n != 2 {
+		t.Errorf("%d db commands ran at once, want group_limits' 2", n)
+	}
+	if n := overlap(t, dir, "cache"); n != 3 {
+		t.Errorf("%d cache commands ran at once, want all 3 with no cap", n)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package multirun
+
+// setNice does nothing: nice is only supported on Unix.
+func setNice(tag string, pid, nice int) {
+	if nice != 0 {
+		debugf("%s: nice is not supported on this platform, ignored", tag)
+	}
+}
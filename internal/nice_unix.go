@@ -0,0 +1,22 @@
+//go:build unix
+
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// setNice sets the scheduling priority of a just-started process to nice;
+// processes it starts afterwards inherit it. Failures are only warned about.
+func setNice(tag string, pid, nice int) {
+	if nice == 0 {
+		return
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %s: cannot set nice %d: %v\n", tag, nice, err)
+		return
+	}
+	debugf("%s: nice %d", tag, nice)
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestSetNice(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	setNice("sleep", cmd.Process.Pid, 7)
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		prio = 20 - prio // the raw syscall value, which libc translates
+	}
+	if prio != 7 {
+		t.Errorf("nice %d, want 7", prio)
+	}
+}
@@ -0,0 +1,713 @@
+package multirun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// -----------------------------------------------------------------------------
+// Output capture
+// -----------------------------------------------------------------------------
+
+// outputModeSummary is the output_mode that replaces the output of
+// commands that succeed with a status line.
+const outputModeSummary = "summary"
+
+// lockedWriter serializes writes from a command's stdout and stderr copiers.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// commandIO describes where a command's output goes: the console or a
+// capture buffer, plus an optional log file and a per-line tap.
+type commandIO struct {
+	capture   io.Writer // combined stdout and stderr; nil means the console
+	log       *os.File
+	outFile   *os.File // gets stdout alone (--output-dir)
+	errFile   *os.File // gets stderr alone (--output-dir)
+	onLine    func(stream, line string)
+	pipeStdin bool
+	prefix    string              // written before every console line when set
+	consoleMu *sync.Mutex         // serializes prefixed console lines across commands
+	pty       bool                // run the command on a pseudo-terminal
+	format    outputFormatter     // adapts console lines; nil leaves them as is
+	idle      *idleTimer          // sees all output when idle_timeout_seconds is set
+	sink      io.WriteCloser      // takes the combined output instead of the console
+	rate      *rateLimiter        // paces console lines when set
+	collapse  bool                // collapse repeated console lines (--collapse-repeats)
+	jsonLogs  bool                // write console lines as JSON objects (--json-logs)
+	tag       string              // the command's tag, for jsonLogs
+	mark      func(string) string // flags --highlight matches in console lines
+	fds       []*os.File          // passed on as fd 3 onwards (inherit_fds)
+	trans     *transcript         // also gets every line when set (transcript_file)
+	maxLine   int                 // truncates longer lines when set (--max-line-length)
+	secrets   *secretSource       // resolves @secret: env values at launch
+
+	lines       []*lineWriter
+	ptyClose    func()   // releases the pty; set by attachPty
+	stdinFile   *os.File // the command's stdin_file, once opened
+	cgroupClose func()   // removes the command's cgroup; set by joinCgroup
+}
+
+// writers returns the stdout and stderr writers for the command.
+func (c *commandIO) writers() (io.Writer, io.Writer) {
+	stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	switch {
+	case c.sink != nil:
+		sink := &lockedWriter{w: c.sink}
+		stdout, stderr = sink, sink
+	case c.jsonLogs:
+		outLines := &lineWriter{emit: c.jsonLine("stdout"), collapse: c.collapse, max: c.maxLine}
+		errLines := &lineWriter{emit: c.jsonLine("stderr"), collapse: c.collapse, max: c.maxLine}
+		c.lines = append(c.lines, outLines, errLines)
+		stdout, stderr = outLines, errLines
+	case c.capture != nil:
+		stdout, stderr = c.capture, c.capture
+	case c.prefix != "" || c.format != nil || c.rate != nil || c.collapse || c.mark != nil:
+		// Prefixed lines are written whole so commands never interleave
+		// within a line.
+		outBatch, errBatch := newConsoleBatch(os.Stdout, c.consoleMu), newConsoleBatch(os.Stderr, c.consoleMu)
+		outLines := &lineWriter{emit: c.consoleLine(outBatch), collapse: c.collapse, flush: outBatch.flush, max: c.maxLine}
+		errLines := &lineWriter{emit: c.consoleLine(errBatch), collapse: c.collapse, flush: errBatch.flush, max: c.maxLine}
+		c.lines = append(c.lines, outLines, errLines)
+		stdout, stderr = outLines, errLines
+	}
+
+	var outTaps, errTaps []io.Writer
+	if c.idle != nil {
+		outTaps = append(outTaps, c.idle)
+		errTaps = append(errTaps, c.idle)
+	}
+	if c.log != nil {
+		log := &lockedWriter{w: c.log}
+		outTaps = append(outTaps, log)
+		errTaps = append(errTaps, log)
+	}
+	if c.outFile != nil {
+		outTaps = append(outTaps, c.outFile)
+		errTaps = append(errTaps, c.errFile)
+	}
+	if c.trans != nil {
+		outLines := &lineWriter{emit: c.trans.line(c.tag), max: c.maxLine}
+		errLines := &lineWriter{emit: c.trans.line(c.tag), max: c.maxLine}
+		c.lines = append(c.lines, outLines, errLines)
+		outTaps = append(outTaps, outLines)
+		errTaps = append(errTaps, errLines)
+	}
+	if c.onLine != nil {
+		outLines := &lineWriter{emit: func(l string) { c.onLine("stdout", l) }, max: c.maxLine}
+		errLines := &lineWriter{emit: func(l string) { c.onLine("stderr", l) }, max: c.maxLine}
+		c.lines = append(c.lines, outLines, errLines)
+		outTaps = append(outTaps, outLines)
+		errTaps = append(errTaps, errLines)
+	}
+
+	if c.capture != nil && c.onLine == nil && c.outFile == nil {
+		// Nothing needs to tell the streams apart: the same writer for
+		// both makes exec copy them through a single pipe, keeping their
+		// relative order.
+		w := io.MultiWriter(append([]io.Writer{c.capture}, outTaps...)...)
+		return w, w
+	}
+	if len(outTaps) == 0 {
+		return stdout, stderr
+	}
+	return io.MultiWriter(append([]io.Writer{stdout}, outTaps...)...),
+		io.MultiWriter(append([]io.Writer{stderr}, errTaps...)...)
+}
+
+func (c *commandIO) consoleLine(b *consoleBatch) func(string) {
+	return func(line string) {
+		if c.mark != nil {
+			line = c.mark(line)
+		}
+		line = c.prefix + line
+		if c.format != nil {
+			line = c.format.Line(line)
+		}
+		if c.rate != nil {
+			c.rate.println(b.out, line)
+			return
+		}
+		b.add(line)
+	}
+}
+
+// consoleBatchSize is how much console output a command may gather before
+// it is written out.
+const consoleBatchSize = 64 << 10
+
+// consoleBatch gathers the console lines of a command's stream and writes
+// them out together under the console mutex when flushed, once per chunk
+// the command writes rather than once per line: chatty commands cost far
+// fewer write calls, and lines still never interleave.
+type consoleBatch struct {
+	out io.Writer
+	mu  *sync.Mutex
+	w   *bufio.Writer
+}
+
+func newConsoleBatch(out io.Writer, mu *sync.Mutex) *consoleBatch {
+	return &consoleBatch{out: out, mu: mu, w: bufio.NewWriterSize(out, consoleBatchSize)}
+}
+
+// add gathers line. The buffer is flushed, under the mutex, before it
+// would fill up, since bufio would otherwise flush it on its own.
+func (b *consoleBatch) add(line string) {
+	if len(line) >= b.w.Available() {
+		b.flush()
+	}
+	if len(line) >= b.w.Size() {
+		// Too long to gather: bufio would write it straight through
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		fmt.Fprintln(b.out, line)
+		return
+	}
+	b.w.WriteString(line)
+	b.w.WriteByte('\n')
+}
+
+// flush writes out the gathered lines.
+func (b *consoleBatch) flush() {
+	if b.w.Buffered() == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.w.Flush()
+}
+
+// jsonLogLine is a line of command output under --json-logs.
+type jsonLogLine struct {
+	TS      string `json:"ts"`
+	Tag     string `json:"tag"`
+	Stream  string `json:"stream"`
+	Message string `json:"message"`
+}
+
+// jsonLine returns the emit function writing lines of stream ("stdout" or
+// "stderr") to multirun's stdout as jsonLogLine objects, one per line.
+func (c *commandIO) jsonLine(stream string) func(string) {
+	return func(line string) {
+		data, err := json.Marshal(jsonLogLine{
+			TS:      time.Now().UTC().Format(time.RFC3339Nano),
+			Tag:     c.tag,
+			Stream:  stream,
+			Message: line,
+		})
+		if err != nil {
+			return
+		}
+		if c.rate != nil {
+			c.rate.println(os.Stdout, string(data))
+			return
+		}
+		c.consoleMu.Lock()
+		defer c.consoleMu.Unlock()
+		os.Stdout.Write(append(data, '\n'))
+	}
+}
+
+// close flushes unterminated lines and closes the log once the command has
+// exited. It is safe to call more than once.
+func (c *commandIO) close() {
+	// Drain the pty first: its output still has to reach the line writers
+	if c.ptyClose != nil {
+		c.ptyClose()
+		c.ptyClose = nil
+	}
+	for _, l := range c.lines {
+		l.close()
+	}
+	c.lines = nil
+	if c.idle != nil {
+		c.idle.stop()
+	}
+	if c.sink != nil {
+		c.sink.Close()
+		c.sink = nil
+	}
+	if c.stdinFile != nil {
+		c.stdinFile.Close()
+		c.stdinFile = nil
+	}
+	if c.cgroupClose != nil {
+		c.cgroupClose()
+		c.cgroupClose = nil
+	}
+	if c.log != nil {
+		c.log.Close()
+		c.log = nil
+	}
+	if c.outFile != nil {
+		c.outFile.Close()
+		c.errFile.Close()
+		c.outFile, c.errFile = nil, nil
+	}
+}
+
+// lineWriter splits what is written to it into lines and hands each one,
+// without its line ending, to emit.
+type lineWriter struct {
+	emit func(line string)
+	buf  []byte
+	// max, when set, truncates lines longer than max bytes; dropped counts
+	// the bytes cut off the line being written, whose head buf keeps
+	max     int
+	dropped int
+	// flush, when set, is called once the lines of a Write, or the last
+	// ones at close, have been emitted
+	flush func()
+
+	// collapse holds back runs of identical lines and emits each run as
+	// one "<line> (xN)" line once a different line follows or the stream
+	// ends (--collapse-repeats)
+	collapse bool
+	last     string
+	repeats  int
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.dropped > 0 {
+		// Within a truncated line: skip to its end
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			w.dropped += len(p)
+			return n, nil
+		}
+		w.dropped += end
+		w.line(w.truncated())
+		p = p[end+1:]
+	}
+	w.buf = append(w.buf, p...)
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(w.buf[:end], []byte("\r"))
+		if w.max > 0 && len(line) > w.max {
+			w.dropped = len(line) - w.max
+			w.line(w.clip(line[:w.max]))
+		} else {
+			w.line(string(line))
+		}
+		w.buf = w.buf[end+1:]
+	}
+	if w.max > 0 && len(w.buf) > w.max {
+		// A line this long may never end: keep only its head
+		w.dropped = len(w.buf) - w.max
+		w.buf = bytes.Clone(w.buf[:w.max])
+	}
+	if w.flush != nil {
+		w.flush()
+	}
+	return n, nil
+}
+
+// truncated returns the head of the truncated line kept in buf, with a
+// note of how much was cut off, and moves on to the next line.
+func (w *lineWriter) truncated() string {
+	line := w.clip(w.buf)
+	w.buf = nil
+	return line
+}
+
+// clip returns head, the part of a line within max, cut back to whole runes
+// and followed by a note of the dropped bytes, and resets dropped.
+func (w *lineWriter) clip(head []byte) string {
+	k := len(head)
+	if j := k - 1; j >= 0 {
+		for j > 0 && !utf8.RuneStart(head[j]) {
+			j--
+		}
+		if !utf8.FullRune(head[j:]) {
+			k = j
+		}
+	}
+	dropped := w.dropped + len(head) - k
+	w.dropped = 0
+	return fmt.Sprintf("%s …[truncated %d bytes]", head[:k], dropped)
+}
+
+func (w *lineWriter) line(l string) {
+	if !w.collapse {
+		w.emit(l)
+		return
+	}
+	if w.repeats > 0 && l == w.last {
+		w.repeats++
+		return
+	}
+	w.flushRepeats()
+	w.last, w.repeats = l, 1
+}
+
+// flushRepeats emits the run of identical lines held back, if any.
+func (w *lineWriter) flushRepeats() {
+	switch {
+	case w.repeats == 1:
+		w.emit(w.last)
+	case w.repeats > 1:
+		w.emit(fmt.Sprintf("%s (x%d)", w.last, w.repeats))
+	}
+	w.repeats = 0
+}
+
+// close emits a final line that had no trailing newline, and the lines
+// held back by collapse.
+func (w *lineWriter) close() {
+	switch {
+	case w.dropped > 0:
+		w.line(w.truncated())
+	case len(w.buf) > 0:
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+	w.flushRepeats()
+	if w.flush != nil {
+		w.flush()
+	}
+}
+
+// collapseRepeats collapses the runs of identical lines in text, as
+// lineWriter does with collapse set.
+func collapseRepeats(text string) string {
+	var out []string
+	w := &lineWriter{emit: func(l string) { out = append(out, l) }, collapse: true}
+	w.Write([]byte(text))
+	w.close()
+	return strings.Join(out, "\n")
+}
+
+// prefixLines writes prefix in front of every line of text.
+func prefixLines(text, prefix string) string {
+	if prefix == "" {
+		return text
+	}
+	return prefix + strings.ReplaceAll(text, "\n", "\n"+prefix)
+}
+
+// prefixWidth resolves --output-prefix-width: a tag width, "auto" for the
+// longest tag, or "" (and 0) for no alignment.
+func prefixWidth(value string, cmds []Command) (int, error) {
+	switch value {
+	case "", "0":
+		return 0, nil
+	case "auto":
+		w := 0
+		for _, c := range cmds {
+			w = max(w, utf8.RuneCountInString(c.Tag))
+		}
+		return w, nil
+	}
+	w, err := strconv.Atoi(value)
+	if err != nil || w < 0 {
+		return 0, fmt.Errorf("want a width or auto, got %q", value)
+	}
+	return w, nil
+}
+
+// fitWidth pads tag with spaces to width runes, cutting it short with an
+// ellipsis when it is longer. It returns the tag and the padding separately
+// so the padding can stay outside the label's colors.
+func fitWidth(tag string, width int) (string, string) {
+	n := utf8.RuneCountInString(tag)
+	if n > width {
+		runes := []rune(tag)
+		return string(runes[:max(width-1, 0)]) + "…", ""
+	}
+	return tag, strings.Repeat(" ", width-n)
+}
+
+// -----------------------------------------------------------------------------
+// Colors
+// -----------------------------------------------------------------------------
+
+// tagColors is the ANSI foreground palette cycled through for tag labels.
+var tagColors = []string{"36", "33", "32", "35", "34", "31", "96", "93", "92", "95", "94", "91"}
+
+func colorize(i int, s string) string {
+	return "\x1b[" + tagColors[i%len(tagColors)] + "m" + s + "\x1b[0m"
+}
+
+// useColor resolves a --color mode. "auto" colors only when out is a
+// terminal and NO_COLOR is unset.
+func useColor(mode string, out *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto", "":
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		fi, err := out.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("unknown mode %q (want always, never or auto)", mode)
+}
+
+// fileNameReplacer maps characters that are path separators or otherwise
+// invalid in file names on some platform to '_'.
+var fileNameReplacer = strings.NewReplacer(
+	"/", "_", `\`, "_", ":", "_", "*", "_", "?", "_",
+	`"`, "_", "<", "_", ">", "_", "|", "_",
+)
+
+// logFileName returns the file name used for a command's output files. Tags
+// are sanitized so they stay inside the target directory; commands without a
+// tag are named after their position.
+func logFileName(index int, tag, ext string) string {
+	name := fileNameReplacer.Replace(tag)
+	if name == "" || name == "." || name == ".." {
+		name = fmt.Sprintf("command-%d", index)
+	}
+	return name + ext
+}
+
+// openStreamFiles creates (or truncates) <dir>/<tag>.out and <dir>/<tag>.err
+// for --output-dir, returning nils when dir is empty.
+func openStreamFiles(dir string, index int, tag string) (*os.File, *os.File, error) {
+	if dir == "" {
+		return nil, nil, nil
+	}
+	out, err := os.Create(filepath.Join(dir, logFileName(index, tag, ".out")))
+	if err != nil {
+		return nil, nil, err
+	}
+	errFile, err := os.Create(filepath.Join(dir, logFileName(index, tag, ".err")))
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, errFile, nil
+}
+
+// openLog opens <dir>/<tag>.log for the given attempt of a command,
+// returning nil when dir is empty. The first attempt creates (or truncates)
+// it; retries append to it after a header, keeping every attempt's output.
+func openLog(dir string, index int, tag string, attempt int) (*os.File, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	path := filepath.Join(dir, logFileName(index, tag, ".log"))
+	if attempt == 0 {
+		return os.Create(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "--- retry %d ---\n", attempt); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// outputBuffer accumulates a buffered command's combined output and tracks
+// how much of it has already been printed. The printed part is kept too, for
+// the failure summary, so once more than max bytes would be held in memory
+// the output not printed yet and all that follows go to a temporary file.
+type outputBuffer struct {
+	mu      sync.Mutex
+	data    []byte
+	flushed int
+	max     int      // 0 means no limit
+	spill   *os.File // set once max was exceeded
+	spilled int64
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spill == nil && b.max > 0 && len(b.data)+len(p) > b.max {
+		f, err := os.CreateTemp("", "multirun-*.out")
+		if err != nil {
+			return 0, err
+		}
+		b.spill = f
+		// What has not been printed yet moves to the file
+		n, err := f.Write(b.data[b.flushed:])
+		b.spilled += int64(n)
+		b.data, b.flushed = nil, 0
+		if err != nil {
+			return 0, err
+		}
+	}
+	if b.spill != nil {
+		n, err := b.spill.Write(p)
+		b.spilled += int64(n)
+		return n, err
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// String returns everything captured so far, printed or not.
+func (b *outputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spill != nil {
+		return fmt.Sprintf("(%d bytes of output, too large to repeat)", b.spilled)
+	}
+	return string(b.data)
+}
+
+// drainSpill copies the output spilled to disk, if any, to w and removes
+// the file. It returns the number of bytes and the file's name.
+func (b *outputBuffer) drainSpill(w io.Writer) (int64, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spill == nil {
+		return 0, "", nil
+	}
+	name := b.spill.Name()
+	defer os.Remove(name)
+	defer b.spill.Close()
+	if _, err := b.spill.Seek(0, io.SeekStart); err != nil {
+		return 0, name, err
+	}
+	_, err := io.Copy(w, b.spill)
+	return b.spilled, name, err
+}
+
+// take returns the output not printed yet and marks it printed. Unless final
+// is set, only complete lines are taken so a flush never splits a line.
+func (b *outputBuffer) take(final bool) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	chunk := b.data[b.flushed:]
+	if !final {
+		end := bytes.LastIndexByte(chunk, '\n')
+		if end < 0 {
+			return ""
+		}
+		chunk = chunk[:end+1]
+	}
+	b.flushed += len(chunk)
+	return string(chunk)
+}
+
+// tailBuffer captures a buffered command's output for --tail: the last n
+// lines are kept in a ring for the success case, and the full output is
+// spooled to a temporary file in case the command fails, so memory use does
+// not grow with the output.
+type tailBuffer struct {
+	mu      sync.Mutex
+	n       int
+	ring    []string // the last len(ring) complete lines, oldest at next
+	next    int
+	total   int // complete lines seen
+	partial []byte
+	spool   *os.File
+}
+
+func newTailBuffer(n int) (*tailBuffer, error) {
+	spool, err := os.CreateTemp("", "multirun-*.out")
+	if err != nil {
+		return nil, err
+	}
+	return &tailBuffer{n: n, spool: spool}, nil
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.spool.Write(p); err != nil {
+		return 0, err
+	}
+	b.partial = append(b.partial, p...)
+	for {
+		end := bytes.IndexByte(b.partial, '\n')
+		if end < 0 {
+			break
+		}
+		b.push(string(b.partial[:end]))
+		b.partial = b.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) push(line string) {
+	b.total++
+	if b.n == 0 {
+		return
+	}
+	if len(b.ring) < b.n {
+		b.ring = append(b.ring, line)
+		return
+	}
+	b.ring[b.next] = line
+	b.next = (b.next + 1) % b.n
+}
+
+// text returns the full output when the command failed and only its last n
+// lines when it succeeded, plus the number of lines left out.
+func (b *tailBuffer) text(succeeded bool) (string, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !succeeded {
+		data, err := os.ReadFile(b.spool.Name())
+		return string(data), 0, err
+	}
+	if len(b.partial) > 0 {
+		b.push(string(b.partial))
+		b.partial = nil
+	}
+	lines := append(append([]string{}, b.ring[b.next:]...), b.ring[:b.next]...)
+	return strings.Join(lines, "\n"), b.total - len(lines), nil
+}
+
+// String returns everything captured so far.
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(b.spool.Name())
+	if err != nil {
+		return fmt.Sprintf("(output unavailable: %v)", err)
+	}
+	return string(data)
+}
+
+// peekOutput writes to stderr, for SIGUSR1, the output so far of the
+// buffered commands of set that are still running.
+func peekOutput(set *procSet) {
+	for _, p := range set.snapshot() {
+		if p.output == nil || p.exited.Load() {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "----- multirun: %s, output so far -----\n", p.blob.Tag)
+		if text := strings.TrimSpace(p.output.String()); text != "" {
+			fmt.Fprintln(os.Stderr, text)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "-----")
+}
+
+// close removes the spool file.
+func (b *tailBuffer) close() {
+	b.spool.Close()
+	os.Remove(b.spool.Name())
+}
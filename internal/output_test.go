@@ -0,0 +1,422 @@
+package multirun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutputBufferSpillsAfterFlushes(t *testing.T) {
+	b := &outputBuffer{max: 10}
+	b.Write([]byte("abcde\n"))
+	if got := b.take(false); got != "abcde\n" {
+		t.Fatalf("take = %q", got)
+	}
+	// Printed output still counts: it is kept for the failure summary
+	b.Write([]byte("fghij\n"))
+	if b.spill == nil {
+		t.Fatal("12 bytes held with max 10 did not spill")
+	}
+	if len(b.data) != 0 {
+		t.Errorf("%d bytes left in memory after spilling", len(b.data))
+	}
+	if got := b.take(true); got != "" {
+		t.Errorf("take after spilling = %q, want nothing", got)
+	}
+	var out bytes.Buffer
+	n, name, err := b.drainSpill(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == "" || n != 6 || out.String() != "fghij\n" {
+		t.Errorf("drainSpill = %d, %q, %q; want the 6 unprinted bytes", n, name, out.String())
+	}
+}
+
+func TestOutputBufferNoLimit(t *testing.T) {
+	b := &outputBuffer{}
+	big := strings.Repeat("x", 1<<16) + "\n"
+	for range 4 {
+		b.Write([]byte(big))
+		b.take(false)
+	}
+	if b.spill != nil {
+		t.Error("spilled without max_buffer_bytes")
+	}
+	if got := b.String(); got != strings.Repeat(big, 4) {
+		t.Errorf("String() has %d bytes, want %d", len(got), 4*len(big))
+	}
+}
+
+func TestOutputBufferTakeCompleteLines(t *testing.T) {
+	b := &outputBuffer{}
+	b.Write([]byte("one\ntw"))
+	if got := b.take(false); got != "one\n" {
+		t.Errorf("take(false) = %q, want the complete line", got)
+	}
+	b.Write([]byte("o"))
+	if got := b.take(true); got != "two" {
+		t.Errorf("take(true) = %q, want the rest", got)
+	}
+}
+
+// countingWriter counts the write calls that reach it, as a terminal would
+// count syscalls.
+type countingWriter struct {
+	writes atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+	return len(p), nil
+}
+
+// BenchmarkParallelChattyOutput has 16 commands write prefixed output in
+// 100-line chunks, batched per chunk as multirun does and one write per
+// line as it used to; writes/op counts the writes reaching the console.
+func BenchmarkParallelChattyOutput(b *testing.B) {
+	const commands, chunks = 16, 10
+	chunk := bytes.Repeat([]byte("some chatty output line from a command\n"), 100)
+	for _, bc := range []struct {
+		name      string
+		newWriter func(out io.Writer, mu *sync.Mutex) *lineWriter
+	}{
+		{"batched", func(out io.Writer, mu *sync.Mutex) *lineWriter {
+			batch := newConsoleBatch(out, mu)
+			return &lineWriter{emit: func(l string) { batch.add("[tag] " + l) }, flush: batch.flush}
+		}},
+		{"per-line", func(out io.Writer, mu *sync.Mutex) *lineWriter {
+			return &lineWriter{emit: func(l string) {
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Fprintln(out, "[tag] "+l)
+			}}
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			out := &countingWriter{}
+			var mu sync.Mutex
+			b.SetBytes(int64(commands * chunks * len(chunk)))
+			b.ReportAllocs()
+			for range b.N {
+				var wg sync.WaitGroup
+				for range commands {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						w := bc.newWriter(out, &mu)
+						for range chunks {
+							w.Write(chunk)
+						}
+						w.close()
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(out.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, tt := range []struct {
+		mode string
+		want bool
+	}{{"always", true}, {"never", false}, {"auto", false}, {"", false}} {
+		got, err := useColor(tt.mode, f)
+		if err != nil || got != tt.want {
+			t.Errorf("useColor(%q, file) = %t, %v; want %t", tt.mode, got, err, tt.want)
+		}
+	}
+	if _, err := useColor("sometimes", f); err == nil {
+		t.Error("useColor(\"sometimes\"): expected an error")
+	}
+}
+
+func TestColorizeCyclesColors(t *testing.T) {
+	if got := colorize(0, "[a]"); got != "\x1b[36m[a]\x1b[0m" {
+		t.Errorf("colorize(0) = %q", got)
+	}
+	if colorize(0, "x") != colorize(len(tagColors), "x") || colorize(0, "x") == colorize(1, "x") {
+		t.Error("colors do not cycle through tagColors")
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b, err := newTailBuffer(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	io.WriteString(b, "one\ntwo\nthr")
+	io.WriteString(b, "ee\nfour")
+	text, omitted, err := b.text(false)
+	if err != nil || text != "one\ntwo\nthree\nfour" || omitted != 0 {
+		t.Errorf("failure text = %q, %d, %v, want all the output", text, omitted, err)
+	}
+	text, omitted, err = b.text(true)
+	if err != nil || text != "three\nfour" || omitted != 2 {
+		t.Errorf("success text = %q, %d, %v, want the last 2 lines and 2 omitted", text, omitted, err)
+	}
+}
+
+func TestPrefixWidth(t *testing.T) {
+	cmds := []Command{{Tag: "api"}, {Tag: "frontend"}, {Tag: "db"}}
+	for value, want := range map[string]int{"": 0, "0": 0, "auto": 8, "5": 5} {
+		if got, err := prefixWidth(value, cmds); err != nil || got != want {
+			t.Errorf("prefixWidth(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "wide"} {
+		if _, err := prefixWidth(value, cmds); err == nil {
+			t.Errorf("prefixWidth(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestFitWidth(t *testing.T) {
+	tests := []struct {
+		tag    string
+		width  int
+		tagOut string
+		padOut string
+	}{
+		{"api", 5, "api", "  "},
+		{"frontend", 5, "fron…", ""},
+		{"héllo", 5, "héllo", ""},
+		{"api", 1, "…", ""},
+	}
+	for _, tt := range tests {
+		tag, pad := fitWidth(tt.tag, tt.width)
+		if tag != tt.tagOut || pad != tt.padOut {
+			t.Errorf("fitWidth(%q, %d) = %q, %q, want %q, %q", tt.tag, tt.width, tag, pad, tt.tagOut, tt.padOut)
+		}
+	}
+}
+
+func TestCollapseRepeats(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"a\na\na\nb\na\n", "a (x3)\nb\na"},
+		{"a\nb\nb", "a\nb (x2)"},
+		{"", ""},
+	} {
+		if got := collapseRepeats(tt.in); got != tt.want {
+			t.Errorf("collapseRepeats(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLineWriterMaxLength(t *testing.T) {
+	var got []string
+	w := &lineWriter{emit: func(l string) { got = append(got, l) }, max: 5}
+	for _, p := range []string{"short\n", "abcdefghij\n", "abcdefg", "hij\nnext\n", "aaaaéb\n", "endless"} {
+		io.WriteString(w, p)
+	}
+	w.Write([]byte(strings.Repeat("x", 1000)))
+	w.close()
+	want := []string{
+		"short",
+		"abcde …[truncated 5 bytes]",
+		"abcde …[truncated 5 bytes]",
+		"next",
+		"aaaa …[truncated 3 bytes]",
+		"endle …[truncated 1002 bytes]",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"hello.sh": `echo "out \"quoted\""; echo err >&2`})
+	code, stdout, stderr := mainRun(t, dir, `{"commands": [{"path": "hello.sh", "tag": "hello"}], "jobs": 0}`, "--json-logs")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	var got []jsonLogLine
+	for _, l := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var line jsonLogLine
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("%q is not a JSON object: %v", l, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, line.TS); err != nil {
+			t.Errorf("ts: %v", err)
+		}
+		line.TS = ""
+		got = append(got, line)
+	}
+	slices.SortFunc(got, func(a, b jsonLogLine) int { return strings.Compare(a.Stream, b.Stream) })
+	want := []jsonLogLine{
+		{Tag: "hello", Stream: "stderr", Message: "err"},
+		{Tag: "hello", Stream: "stdout", Message: `out "quoted"`},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("lines = %+v, want %+v", got, want)
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"hello.sh": "echo out; echo err >&2"})
+	outDir := filepath.Join(t.TempDir(), "out")
+	code, _, stderr := mainRun(t, dir, `{"commands": [
+  {"path": "hello.sh", "tag": "web/api"},
+  {"path": "hello.sh"}
+], "jobs": 0}`, "--output-dir="+outDir)
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	for name, want := range map[string]string{
+		"web_api.out": "out\n", "web_api.err": "err\n",
+		"command-1.out": "out\n", "command-1.err": "err\n",
+	} {
+		if data, err := os.ReadFile(filepath.Join(outDir, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestLogDir(t *testing.T) {
+	for _, jobs := range []int{1, 0} {
+		t.Run(fmt.Sprint("jobs=", jobs), func(t *testing.T) {
+			dir := scriptDir(t, map[string]string{
+				"hello.sh": "echo hello",
+				"flaky.sh": `n=$(($(cat "$0.count" 2>/dev/null || echo 0) + 1)); echo $n > "$0.count"; echo "run $n"; [ $n -ge 2 ]`,
+			})
+			logs := filepath.Join(t.TempDir(), "logs")
+			code, _, stderr := mainRun(t, dir, fmt.Sprintf(`{"commands": [
+  {"path": "hello.sh", "tag": "web/api"},
+  {"path": "flaky.sh", "tag": "flaky", "retries": 1}
+], "jobs": %d, "log_dir": %q}`, jobs, logs))
+			if code != 0 {
+				t.Fatalf("exit code %d:\n%s", code, stderr)
+			}
+			// Tags are sanitized into file names, and retries keep the
+			// output of earlier attempts
+			for name, want := range map[string]string{
+				"web_api.log": "hello\n",
+				"flaky.log":   "run 1\n--- retry 1 ---\nrun 2\n",
+			} {
+				if data, err := os.ReadFile(filepath.Join(logs, name)); err != nil || string(data) != want {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlushIntervalPrintsEarly(t *testing.T) {
+	// The command only goes on once its first line has been printed
+	dir := scriptDir(t, map[string]string{
+		"chat.sh": `echo first; for i in $(seq 50); do [ -e "$(dirname "$0")/go" ] && echo second && exit 0; sleep 0.1; done; exit 1`,
+	})
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	seen := make(chan []string)
+	go func() {
+		var lines []string
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			lines = append(lines, s.Text())
+			if s.Text() == "first" {
+				os.WriteFile(filepath.Join(dir, "go"), nil, 0o644)
+			}
+		}
+		seen <- lines
+	}()
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{BufferOutput: true, FlushIntervalMs: 100, Commands: []Command{{Path: "chat.sh", Tag: "chat"}}})
+	})
+	w.Close()
+	lines := <-seen
+	if res.ExitCode != 0 {
+		t.Errorf("the command never saw its first line printed; stdout: %q", lines)
+	}
+	if want := []string{"first", "second"}; !slices.Equal(lines, want) {
+		t.Errorf("stdout = %q, want %q", lines, want)
+	}
+}
+
+func TestSummaryOutputMode(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"ok.sh":   "echo noise",
+		"fail.sh": "echo details; exit 2",
+	})
+	instr := Instructions{
+		Commands:     []Command{{Path: "ok.sh", Tag: "ok"}, {Path: "fail.sh", Tag: "fail"}},
+		BufferOutput: true,
+		KeepGoing:    true,
+		OutputMode:   outputModeSummary,
+	}
+	var stdout string
+	capture(t, &os.Stderr, func() {
+		stdout = capture(t, &os.Stdout, func() { run(t, dir, instr) })
+	})
+	// Only the failed command's output is shown
+	for _, want := range []string{"✓ ok (", "details\n", "✗ fail (code 2)\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout %q lacks %q", stdout, want)
+		}
+	}
+	if strings.Contains(stdout, "noise") {
+		t.Errorf("stdout %q shows the output of a successful command", stdout)
+	}
+
+	instr.Jobs = 1
+	stderr := capture(t, &os.Stderr, func() {
+		capture(t, &os.Stdout, func() { run(t, dir, instr) })
+	})
+	if !strings.Contains(stderr, "output_mode summary only applies to parallel runs") {
+		t.Errorf("serial run: stderr %q does not warn that summary is ignored", stderr)
+	}
+}
+
+// stringer is a fmt.Stringer for a fixed string.
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestPeekOutput(t *testing.T) {
+	set := &procSet{}
+	exited := &runningProc{blob: Command{Tag: "done"}, output: stringer("old\n")}
+	exited.exited.Store(true)
+	for _, p := range []*runningProc{
+		{blob: Command{Tag: "build"}, output: stringer("compiling\nlinking\n")},
+		{blob: Command{Tag: "quiet"}, output: stringer("")},
+		{blob: Command{Tag: "streamed"}},
+		exited,
+	} {
+		set.add(p)
+	}
+	got := capture(t, &os.Stderr, func() { peekOutput(set) })
+	// Only the buffered commands still running are shown
+	want := `----- multirun: build, output so far -----
+compiling
+linking
+----- multirun: quiet, output so far -----
+-----
+`
+	if got != want {
+		t.Errorf("peek:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package multirun
+
+// onPeekSignal does nothing: there is no SIGUSR1 outside Unix.
+func onPeekSignal(peek func()) (stop func()) {
+	return func() {}
+}
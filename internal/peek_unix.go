@@ -0,0 +1,31 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onPeekSignal calls peek every time multirun receives SIGUSR1, until the
+// returned stop is called.
+func onPeekSignal(peek func()) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				peek()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPeekSignal(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"slow.sh": `echo halfway; touch "$(dirname "$0")/started"; sleep 1; echo finished`,
+	})
+	go func() {
+		// Only once the run is handling SIGUSR1, which would otherwise
+		// kill the test
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+				syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+				return
+			}
+		}
+	}()
+	var stdout string
+	stderr := capture(t, &os.Stderr, func() {
+		stdout = capture(t, &os.Stdout, func() {
+			run(t, dir, Instructions{Commands: []Command{{Path: "slow.sh", Tag: "slow"}}, BufferOutput: true})
+		})
+	})
+	if want := "----- multirun: slow, output so far -----\nhalfway\n-----\n"; !strings.Contains(stderr, want) {
+		t.Errorf("stderr %q lacks the output so far %q", stderr, want)
+	}
+	// The buffered output is still printed in full at the end
+	if !strings.Contains(stdout, "halfway\nfinished\n") {
+		t.Errorf("stdout %q lacks the full output", stdout)
+	}
+}
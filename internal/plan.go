@@ -0,0 +1,71 @@
+package multirun
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Execution plan
+// -----------------------------------------------------------------------------
+
+// printPlan prints, for --plan, the waves the commands would run in: a
+// command starts once every command it needs, in earlier waves, has
+// succeeded. Each wave notes the jobs and group limits that keep its
+// commands from all running at once. The command lines follow, quoted to
+// be pasted into a shell.
+func (rn *runner) printPlan() {
+	instr := rn.instr
+	jobs := "unlimited"
+	if instr.Jobs > 0 {
+		jobs = fmt.Sprint(instr.Jobs)
+	}
+	fmt.Printf("plan: %d commands, jobs=%s\n", len(instr.Commands), jobs)
+	for n, wave := range rn.graph.waves() {
+		tags := make([]string, len(wave))
+		for j, i := range wave {
+			tags[j] = instr.Commands[i].Tag
+		}
+		line := fmt.Sprintf("wave %d: [%s]", n+1, strings.Join(tags, ", "))
+		if notes := rn.waveLimits(wave); len(notes) > 0 {
+			line += " (" + strings.Join(notes, "; ") + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Println("commands:")
+	for _, c := range instr.Commands {
+		fmt.Printf("  %s: %s\n", c.Tag, commandLine(c, slices.Concat(c.Args, rn.extraArgs.forTag(c.Tag))))
+	}
+}
+
+// waveLimits describes the limits that hold back some commands of wave.
+func (rn *runner) waveLimits(wave []int) []string {
+	instr := rn.instr
+	var notes []string
+	if instr.Jobs > 0 && len(wave) > instr.Jobs {
+		if instr.Jobs == 1 {
+			notes = append(notes, "serial: one at a time, in this order")
+		} else {
+			notes = append(notes, fmt.Sprintf("jobs: at most %d at a time", instr.Jobs))
+		}
+	}
+	inGroup := map[string]int{}
+	for _, i := range wave {
+		if g := instr.Commands[i].Group; g != "" {
+			inGroup[g]++
+		}
+	}
+	groups := make([]string, 0, len(inGroup))
+	for g := range inGroup {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		if limit := instr.groupLimit(g); limit > 0 && inGroup[g] > limit {
+			notes = append(notes, fmt.Sprintf("group %s: at most %d at a time", g, limit))
+		}
+	}
+	return notes
+}
@@ -0,0 +1,56 @@
+package multirun
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPrintPlan(t *testing.T) {
+	instr := &Instructions{
+		Commands: []Command{
+			{Path: "fetch.sh", Tag: "fetch"},
+			{Path: "gen.sh", Tag: "gen"},
+			{Path: "lint.sh", Tag: "lint", Group: "db"},
+			{Path: "test.sh", Tag: "test", Group: "db", Needs: []string{"gen"}},
+			{Path: "migrate.sh", Tag: "migrate", Group: "db", Needs: []string{"gen"}, Args: []string{"--to", "head"}},
+			{Path: "deploy.sh", Tag: "deploy", Needs: []string{"test", "migrate"}, Env: map[string]string{"STAGE": "prod env"}},
+		},
+		Jobs: 2,
+	}
+	graph, err := newDepGraph(instr.Commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := &runner{instr: instr, graph: graph, extraArgs: commandArgs{
+		global: []string{"-v"},
+		byTag:  map[string][]string{"deploy": {"--dry-run"}},
+	}}
+	got := capture(t, &os.Stdout, rn.printPlan)
+	want := `plan: 6 commands, jobs=2
+wave 1: [fetch, gen, lint] (jobs: at most 2 at a time)
+wave 2: [test, migrate] (group db: at most 1 at a time)
+wave 3: [deploy]
+commands:
+  fetch: fetch.sh -v
+  gen: gen.sh -v
+  lint: lint.sh -v
+  test: test.sh -v
+  migrate: migrate.sh --to head -v
+  deploy: STAGE='prod env' deploy.sh -v --dry-run
+`
+	if got != want {
+		t.Errorf("plan:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Serial runs go one at a time, and unlimited jobs hold nothing back
+	for jobs, want := range map[int]string{
+		1: "wave 1: [fetch, gen, lint] (serial: one at a time, in this order)\n",
+		0: "wave 1: [fetch, gen, lint]\n",
+	} {
+		instr.Jobs = jobs
+		if got := capture(t, &os.Stdout, rn.printPlan); !strings.Contains(got, want) {
+			t.Errorf("jobs %d: plan %q lacks %q", jobs, got, want)
+		}
+	}
+}
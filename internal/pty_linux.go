@@ -0,0 +1,84 @@
+//go:build linux
+
+package multirun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// -----------------------------------------------------------------------------
+// Pseudo-terminals
+// -----------------------------------------------------------------------------
+
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty allocates a pseudo-terminal, returning its master and tty ends.
+// The tty gets multirun's own terminal size, or 24x80 without one.
+func openPty() (master, tty *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	var unlock int32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}
+	if err == nil {
+		tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("allocating a pty: %w", err)
+	}
+
+	ws := winsize{rows: 24, cols: 80}
+	if ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))) != nil || ws.rows == 0 {
+		ws = winsize{rows: 24, cols: 80}
+	}
+	_ = ioctl(tty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	return master, tty, nil
+}
+
+// attachPty runs cmd on a new pseudo-terminal, as the session leader with
+// the pty as its controlling terminal, and copies what it writes to out.
+// c.close releases the pty once everything written has been copied.
+func (c *commandIO) attachPty(cmd *exec.Cmd, out io.Writer) error {
+	master, tty, err := openPty()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Reading the master fails with EIO once every tty end is closed
+		_, err := io.Copy(out, master)
+		if err != nil && !errors.Is(err, syscall.EIO) {
+			fmt.Fprintln(os.Stderr, "multirun: pty:", err)
+		}
+	}()
+	c.ptyClose = func() {
+		tty.Close()
+		<-done
+		master.Close()
+	}
+	return nil
+}
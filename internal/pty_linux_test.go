@@ -0,0 +1,30 @@
+//go:build linux
+
+package multirun
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPtyGivesCommandsATerminal(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	dir := scriptDir(t, map[string]string{
+		"tty.sh": `for fd in 0 1 2; do [ -t $fd ] && echo "fd $fd: tty" || echo "fd $fd: not a tty"; done`,
+	})
+	instr := `{"commands": [{"path": "tty.sh", "tag": "tty"}], "jobs": 1, "pty": true}`
+	code, stdout, stderr := mainRun(t, dir, instr)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	// The tty turns the script's newlines into CRLF
+	stdout = strings.ReplaceAll(stdout, "\r\n", "\n")
+	for _, want := range []string{"fd 0: tty\n", "fd 1: tty\n", "fd 2: tty\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout %q lacks %q", stdout, want)
+		}
+	}
+}
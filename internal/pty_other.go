@@ -0,0 +1,13 @@
+//go:build !linux
+
+package multirun
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+func (c *commandIO) attachPty(cmd *exec.Cmd, out io.Writer) error {
+	return errors.New("pty is only supported on Linux")
+}
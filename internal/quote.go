@@ -0,0 +1,63 @@
+package multirun
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Shell quoting
+// -----------------------------------------------------------------------------
+
+// shellSafe matches arguments a POSIX shell takes literally.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s as a single word for a POSIX shell, in single quotes
+// unless it needs none. This also covers Windows, where commands run through bash.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cmdQuote quotes s for cmd.exe, in double quotes when it has spaces or
+// characters cmd treats specially. cmd has no escape for % within quotes.
+func cmdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"&|<>^()") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// commandLine returns blob run with args as a line that can be pasted into
+// a shell to run it again: its own env as FOO=bar assignments (*** for
+// secrets), then the resolved path, or the shell of an inline command, and
+// every argument, quoted. Inline commands falling back to cmd /c on
+// Windows get cmd's quoting and set commands.
+func commandLine(blob Command, args []string) string {
+	name, argv := blob.Path, args
+	if blob.Command != "" {
+		name, argv = shellCommand(blob, args)
+	}
+	quote := shellQuote
+	var words []string
+	if name == "cmd" {
+		quote = cmdQuote
+		for _, kv := range flattenEnv(blob.Env) {
+			k, v, _ := strings.Cut(kv, "=")
+			words = append(words, fmt.Sprintf("set %s &&", cmdQuote(k+"="+redactSecret(v))))
+		}
+	} else {
+		for _, kv := range flattenEnv(blob.Env) {
+			k, v, _ := strings.Cut(kv, "=")
+			words = append(words, k+"="+shellQuote(redactSecret(v)))
+		}
+	}
+	for _, w := range slices.Concat([]string{name}, argv) {
+		words = append(words, quote(w))
+	}
+	return strings.Join(words, " ")
+}
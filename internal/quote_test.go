@@ -0,0 +1,38 @@
+package multirun
+
+import (
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+	args := []string{"plain", "", "two words", "it's", `"$HOME"`, "a\nb", "--flag=x,y", "*"}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	out, err := exec.Command("sh", "-c", `printf '%s\0' `+strings.Join(quoted, " ")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"); !slices.Equal(got, args) {
+		t.Errorf("the shell read %q, want %q", got, args)
+	}
+	if shellQuote("--jobs=2") != "--jobs=2" {
+		t.Error("a safe argument was quoted")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	blob := Command{Path: "/bin/tool", Env: map[string]string{"TOKEN": secretPrefix + "vault/api", "MODE": "a b"}}
+	got := commandLine(blob, []string{"--name", "it's"})
+	if want := `MODE='a b' TOKEN='***' /bin/tool --name 'it'\''s'`; got != want {
+		t.Errorf("commandLine = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package multirun
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Output rate limit
+// -----------------------------------------------------------------------------
+
+const (
+	// rateBacklogSeconds is how many seconds of output at the
+	// --max-output-rate pace wait to be written before lines are dropped.
+	rateBacklogSeconds = 5
+	// maxRateBacklog caps the backlog for high rates.
+	maxRateBacklog = 100000
+)
+
+// rateLimiter writes console lines at no more than rate per second, for
+// --max-output-rate. Lines beyond the pace wait in a bounded backlog; once
+// it is full they are dropped, and a "[... N lines suppressed ...]" notice
+// stands in for them. Queueing never blocks, so commands' pipes keep being
+// read however far behind the console is.
+type rateLimiter struct {
+	rate    int
+	queue   chan queuedLine
+	dropped atomic.Int64
+	done    chan struct{}
+}
+
+type queuedLine struct {
+	w    io.Writer
+	line string
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	l := &rateLimiter{
+		rate:  rate,
+		queue: make(chan queuedLine, min(rate, maxRateBacklog/rateBacklogSeconds)*rateBacklogSeconds),
+		done:  make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+// println queues every line of text for w, or counts it as dropped when
+// the backlog is full.
+func (l *rateLimiter) println(w io.Writer, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		select {
+		case l.queue <- queuedLine{w: w, line: line}:
+		default:
+			l.dropped.Add(1)
+		}
+	}
+}
+
+func (l *rateLimiter) loop() {
+	defer close(l.done)
+	// Past a billion lines a second the interval would round down to 0
+	tick := time.NewTicker(max(time.Second/time.Duration(l.rate), time.Nanosecond))
+	defer tick.Stop()
+	for q := range l.queue {
+		l.suppressed()
+		fmt.Fprintln(q.w, q.line)
+		<-tick.C
+	}
+	l.suppressed()
+}
+
+// suppressed writes the notice for the lines dropped since the last one.
+func (l *rateLimiter) suppressed() {
+	if n := l.dropped.Swap(0); n > 0 {
+		fmt.Fprintf(os.Stdout, "[... %d lines suppressed ...]\n", n)
+	}
+}
+
+// close writes out the backlog, still at the limited pace, and stops the
+// limiter. Nothing may be queued once it is called.
+func (l *rateLimiter) close() {
+	close(l.queue)
+	<-l.done
+}
@@ -0,0 +1,64 @@
+package multirun
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterHighRates(t *testing.T) {
+	for _, rate := range []int{1_000_000_000, 2_000_000_000, math.MaxInt} {
+		var buf bytes.Buffer
+		l := newRateLimiter(rate)
+		l.println(&buf, "a\nb")
+		l.close()
+		if got := buf.String(); got != "a\nb\n" {
+			t.Errorf("rate %d: wrote %q", rate, got)
+		}
+	}
+}
+
+func TestRateLimiterPace(t *testing.T) {
+	var buf bytes.Buffer
+	begin := time.Now()
+	l := newRateLimiter(20)
+	l.println(&buf, "1\n2\n3\n4\n5")
+	l.close()
+	// A line every 50ms
+	if d := time.Since(begin); d < 200*time.Millisecond {
+		t.Errorf("5 lines at 20 a second took %s", d)
+	}
+	if got := buf.String(); got != "1\n2\n3\n4\n5\n" {
+		t.Errorf("wrote %q", got)
+	}
+}
+
+func TestRateLimiterBacklog(t *testing.T) {
+	for rate, want := range map[int]int{10: 50, 1000: 5000, 1_000_000: maxRateBacklog} {
+		l := newRateLimiter(rate)
+		if got := cap(l.queue); got != want {
+			t.Errorf("rate %d: backlog of %d lines, want %d", rate, got, want)
+		}
+		l.close()
+	}
+
+	// Lines past a full backlog are dropped, and a notice says how many
+	var buf bytes.Buffer
+	l := &rateLimiter{rate: 100, queue: make(chan queuedLine, 3), done: make(chan struct{})}
+	for i := range 10 {
+		l.println(&buf, fmt.Sprint(i))
+	}
+	stdout := capture(t, &os.Stdout, func() {
+		go l.loop()
+		l.close()
+	})
+	if got := buf.String(); got != "0\n1\n2\n" {
+		t.Errorf("wrote %q, want the backlog", got)
+	}
+	if want := "[... 7 lines suppressed ...]\n"; stdout != want {
+		t.Errorf("notice %q, want %q", stdout, want)
+	}
+}
@@ -0,0 +1,137 @@
+package multirun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Ready checks
+// -----------------------------------------------------------------------------
+
+const (
+	defaultReadyIntervalMs     = 500
+	defaultReadyTimeoutSeconds = 30
+)
+
+// ReadyCheck probes a long-running command, such as a server, until it is
+// ready: from then on it satisfies the commands that need it although it
+// keeps running, until the run stops it once none of them is left. Exactly
+// one of Command, TCP and HTTP is set.
+type ReadyCheck struct {
+	// Command is a shell snippet, run with the command's environment,
+	// that exits 0 once the command is ready.
+	Command string `json:"command,omitempty"`
+	// TCP is a host:port that accepts connections once it is ready.
+	TCP string `json:"tcp,omitempty"`
+	// HTTP is a URL that answers with a 2xx status once it is ready.
+	HTTP string `json:"http,omitempty"`
+	// IntervalMs is the time between probes, 500 by default.
+	IntervalMs int `json:"interval_ms,omitempty"`
+	// TimeoutSeconds fails the command, stopping it, when it is not ready
+	// this long after it started. 30 by default.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// validate checks the probe of the command tagged tag.
+func (c *ReadyCheck) validate(tag string) error {
+	set := 0
+	for _, s := range []string{c.Command, c.TCP, c.HTTP} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("%s: ready_check needs exactly one of command, tcp and http", tag)
+	}
+	if c.IntervalMs < 0 || c.TimeoutSeconds < 0 {
+		return fmt.Errorf("%s: ready_check interval_ms and timeout_seconds cannot be negative", tag)
+	}
+	return nil
+}
+
+func (c *ReadyCheck) interval() time.Duration {
+	if c.IntervalMs == 0 {
+		return defaultReadyIntervalMs * time.Millisecond
+	}
+	return time.Duration(c.IntervalMs) * time.Millisecond
+}
+
+func (c *ReadyCheck) timeout() time.Duration {
+	if c.TimeoutSeconds == 0 {
+		return defaultReadyTimeoutSeconds * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// errProbeAbandoned is returned by waitReady when the command exited, or
+// the run stopped, before it was ready.
+var errProbeAbandoned = errors.New("ready_check abandoned")
+
+// waitReady probes blob's ready_check every interval until it passes,
+// returning nil, or until its timeout. Probe commands run with env, the
+// environment the command was started with, secrets included. It gives up
+// as soon as exited reports that the command is gone.
+func waitReady(ctx context.Context, blob Command, env []string, exited func() bool) error {
+	check := blob.ReadyCheck
+	interval := check.interval()
+	deadline := time.Now().Add(check.timeout())
+	for {
+		if exited() || ctx.Err() != nil {
+			return errProbeAbandoned
+		}
+		err := probe(ctx, blob, env, interval)
+		if err == nil {
+			return nil
+		}
+		debugf("%s: not ready: %v", blob.Tag, err)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready after %s: %w", check.timeout(), err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// probe checks once whether blob is ready, waiting no longer than wait for
+// an answer.
+func probe(ctx context.Context, blob Command, env []string, wait time.Duration) error {
+	check := blob.ReadyCheck
+	ctx, cancel := context.WithTimeout(ctx, max(wait, time.Second))
+	defer cancel()
+	switch {
+	case check.TCP != "":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", check.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case check.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	default:
+		name, args := shellCommand(Command{Tag: blob.Tag, Command: check.Command}, nil)
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = env
+		return cmd.Run()
+	}
+}
@@ -0,0 +1,85 @@
+package multirun
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyCheckSeesSecrets(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"secret.sh": "read name; [ \"$name\" = token ] && echo s3cret",
+		"server.sh": "sleep 1",
+		"client.sh": "exit 0",
+	})
+	instr := `{
+  "commands": [
+    {"path": "server.sh", "tag": "server", "args": [], "env": {"TOKEN": "@secret:token"},
+     "ready_check": {"command": "[ \"$TOKEN\" = s3cret ]", "interval_ms": 50, "timeout_seconds": 5}},
+    {"path": "client.sh", "tag": "client", "args": [], "env": {}, "needs": ["server"]}
+  ],
+  "jobs": 0
+}`
+	path := filepath.Join(dir, "instr.json")
+	if err := os.WriteFile(path, []byte(instr), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer verbose.Store(false)
+	var code int
+	stderr := capture(t, &os.Stderr, func() {
+		code = Main([]string{path, "-v", "--runfiles-root=" + dir, "--secret-command=" + filepath.Join(dir, "secret.sh"), "--"})
+	})
+	if code != 0 || !strings.Contains(stderr, "server: ready") {
+		t.Errorf("exit code %d, want 0 and the server to be ready:\n%s", code, stderr)
+	}
+}
+
+func TestReadyCheckGatesDependents(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"server.sh": "exec sleep 30",
+		"rec.sh":    recorder,
+	})
+	// The fake server only listens once it has logged doing so
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		if err := os.WriteFile(filepath.Join(dir, "log"), []byte("listening\n"), 0o644); err != nil {
+			t.Error(err)
+			return
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+	}()
+
+	begin := time.Now()
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: []Command{
+			{Path: "server.sh", Tag: "server", ReadyCheck: &ReadyCheck{TCP: addr, IntervalMs: 50, TimeoutSeconds: 10}},
+			{Path: "rec.sh", Tag: "client", Args: []string{"client"}, Needs: []string{"server"}},
+		}})
+	})
+	if got, want := recorded(t, dir), []string{"listening", "client"}; !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q: client started before the server was ready", got, want)
+	}
+	// The server is stopped once the client is done, as a success
+	if got := statuses(res); got["server"] != "succeeded" || got["client"] != "succeeded" {
+		t.Errorf("statuses = %v, want both succeeded", got)
+	}
+	if d := time.Since(begin); d > 10*time.Second {
+		t.Errorf("run took %s, the server was not stopped", d)
+	}
+}
@@ -0,0 +1,60 @@
+package multirun
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Repeated runs
+// -----------------------------------------------------------------------------
+
+// repeat runs the whole command set, for soak testing, --repeat times or,
+// with --repeat-until-failure, until an iteration fails (with no --repeat,
+// however many times that takes). Every iteration is a full execute, with
+// its own --report and --exit-code-file; a summary of how many iterations
+// passed closes the run. It returns the exit code of the last failed
+// iteration, or 0 when they all passed.
+func (rn *runner) repeat(ctx context.Context) (int, error) {
+	opts := rn.opts
+	report, exitCodes := opts.report, opts.exitCodeFile
+	code, passed, ran := 0, 0, 0
+	for n := 1; opts.repeat <= 0 || n <= opts.repeat; n++ {
+		total := "?"
+		if opts.repeat > 0 {
+			total = fmt.Sprint(opts.repeat)
+		}
+		fmt.Printf("--- iteration %d/%s ---\n", n, total)
+		if report != "" {
+			opts.report = iterationPath(report, n)
+		}
+		if exitCodes != "" {
+			opts.exitCodeFile = iterationPath(exitCodes, n)
+		}
+		c, res, err := rn.execute(ctx)
+		if err != nil {
+			return 1, fmt.Errorf("iteration %d: %w", n, err)
+		}
+		ran++
+		if c == 0 {
+			passed++
+		} else {
+			code = c
+		}
+		if res.interrupted || c != 0 && opts.repeatUntilFailure {
+			break
+		}
+	}
+	fmt.Fprintf(os.Stderr, "multirun: %d of %d iterations passed\n", passed, ran)
+	return code, nil
+}
+
+// iterationPath numbers path for iteration n, before its extension:
+// report.json becomes report.3.json.
+func iterationPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
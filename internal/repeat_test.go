@@ -0,0 +1,81 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepeatFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"--"}, 1},
+		{[]string{"--repeat=3", "--"}, 3},
+		{[]string{"--repeat-until-failure", "--"}, 0},
+		{[]string{"--repeat=5", "--repeat-until-failure", "--"}, 5},
+	} {
+		opts, _, err := parseArgs(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.repeat != tt.want {
+			t.Errorf("parseArgs(%q): repeat = %d, want %d", tt.args, opts.repeat, tt.want)
+		}
+	}
+}
+
+// repeatRun runs, through Main with flags, a command that fails on its
+// failOn-th run (never for 0). It returns the exit code and the iteration
+// summary line.
+func repeatRun(t *testing.T, failOn int, flags ...string) (int, string) {
+	t.Helper()
+	dir := scriptDir(t, map[string]string{
+		"count.sh": fmt.Sprintf(`n=$(($(cat "$0.count" 2>/dev/null || echo 0) + 1)); echo $n > "$0.count"; [ $n -ne %d ]`, failOn),
+	})
+	instr := filepath.Join(dir, "instr.json")
+	if err := os.WriteFile(instr, []byte(`{"commands": [{"path": "count.sh", "tag": "count", "args": [], "env": {}}], "jobs": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{instr, "--runfiles-root=" + dir}, flags...)
+	var code int
+	var stderr string
+	capture(t, &os.Stdout, func() {
+		stderr = capture(t, &os.Stderr, func() { code = Main(append(args, "--")) })
+	})
+	for _, l := range strings.Split(stderr, "\n") {
+		if strings.Contains(l, "iterations passed") {
+			return code, l
+		}
+	}
+	t.Fatalf("no iteration summary in:\n%s", stderr)
+	return 0, ""
+}
+
+func TestRepeatCount(t *testing.T) {
+	code, summary := repeatRun(t, 0, "--repeat=3")
+	if code != 0 || summary != "multirun: 3 of 3 iterations passed" {
+		t.Errorf("got code %d, %q", code, summary)
+	}
+}
+
+func TestRepeatUntilFailure(t *testing.T) {
+	code, summary := repeatRun(t, 4, "--repeat-until-failure")
+	if code == 0 || summary != "multirun: 3 of 4 iterations passed" {
+		t.Errorf("got code %d, %q", code, summary)
+	}
+}
+
+func TestRepeatCountUntilFailure(t *testing.T) {
+	code, summary := repeatRun(t, 2, "--repeat=5", "--repeat-until-failure")
+	if code == 0 || summary != "multirun: 1 of 2 iterations passed" {
+		t.Errorf("got code %d, %q", code, summary)
+	}
+	code, summary = repeatRun(t, 9, "--repeat=3", "--repeat-until-failure")
+	if code != 0 || summary != "multirun: 3 of 3 iterations passed" {
+		t.Errorf("got code %d, %q", code, summary)
+	}
+}
@@ -0,0 +1,120 @@
+package multirun
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Run report
+// -----------------------------------------------------------------------------
+
+// resourceUsage is what a command's process consumed, where the platform
+// reports it.
+type resourceUsage struct {
+	MaxRSSKb  int64 `json:"max_rss_kb"`
+	UserCPUMs int64 `json:"user_cpu_ms"`
+	SysCPUMs  int64 `json:"sys_cpu_ms"`
+}
+
+// commandReport is one command's entry in the --report file.
+type commandReport struct {
+	Tag        string `json:"tag"`
+	Status     string `json:"status"`
+	Launch     string `json:"launch"`
+	ExitCode   *int   `json:"exit_code,omitempty"` // nil for commands not started
+	DurationMs int64  `json:"duration_ms"`
+	Retries    int    `json:"retries,omitempty"`
+	Signal     string `json:"signal,omitempty"` // the signal that killed it, Unix only
+	Reason     string `json:"reason,omitempty"` // why it was skipped
+	*resourceUsage
+}
+
+// runReport is the --report file: the outcome of the run and of every
+// command, in instructions order.
+type runReport struct {
+	ExitCode   int             `json:"exit_code"`
+	DurationMs int64           `json:"duration_ms"`
+	Commands   []commandReport `json:"commands"`
+}
+
+var stateNames = map[cmdState]string{
+	statePending:   "not_run",
+	stateRunning:   "running",
+	stateSucceeded: "succeeded",
+	stateFailed:    "failed",
+	stateSkipped:   "skipped",
+}
+
+var launchNames = map[launchState]string{
+	notStarted:   "not_started",
+	launched:     "launched",
+	launchFailed: "launch_failed",
+}
+
+// failedTags returns the tags of the commands a --report file records as
+// failed, in report order.
+func failedTags(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the fields needed here: commandReport's embedded usage cannot
+	// be decoded
+	var report struct {
+		Commands []struct {
+			Tag    string `json:"tag"`
+			Status string `json:"status"`
+		} `json:"commands"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var tags []string
+	for _, c := range report.Commands {
+		if c.Status == stateNames[stateFailed] {
+			tags = append(tags, c.Tag)
+		}
+	}
+	return tags, nil
+}
+
+// writeReport writes the JSON run report to path.
+func writeReport(path string, cmds []Command, res *runResult, code int, elapsed time.Duration) error {
+	report := runReport{ExitCode: code, DurationMs: elapsed.Milliseconds()}
+	for i, c := range cmds {
+		var code *int
+		if res.state[i] != stateSkipped && res.state[i] != statePending {
+			code = &res.codes[i]
+		}
+		report.Commands = append(report.Commands, commandReport{
+			Tag:           c.Tag,
+			Status:        stateNames[res.state[i]],
+			Launch:        launchNames[res.launch[i]],
+			ExitCode:      code,
+			DurationMs:    res.durations[i].Milliseconds(),
+			Retries:       res.retries[i],
+			Signal:        res.signals[i],
+			Reason:        res.reasons[i],
+			resourceUsage: res.usage[i],
+		})
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// writeExitCodes writes one "<tag> <exit code>" line per command to path,
+// -1 standing for commands that never produced an exit code.
+func writeExitCodes(path string, cmds []Command, res *runResult) error {
+	var b strings.Builder
+	for i, c := range cmds {
+		fmt.Fprintf(&b, "%s %d\n", c.Tag, res.codes[i])
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
@@ -0,0 +1,26 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCodeFile(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0", "fail.sh": "exit 3"})
+	path := filepath.Join(dir, "codes.txt")
+	instr := `{"commands": [
+  {"path": "ok.sh", "tag": "ok"},
+  {"path": "fail.sh", "tag": "fail"},
+  {"path": "ok.sh", "tag": "after", "needs": ["fail"]}
+], "jobs": 0}`
+	mainRun(t, dir, instr, "--exit-code-file="+path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after never ran, so it has no exit code of its own
+	if want := "ok 0\nfail 3\nafter -1\n"; string(data) != want {
+		t.Errorf("--exit-code-file holds %q, want %q", data, want)
+	}
+}
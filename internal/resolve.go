@@ -0,0 +1,84 @@
+package multirun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	// this is only resolved by bazel
+	"github.com/bazelbuild/rules_go/go/runfiles"
+)
+
+// -----------------------------------------------------------------------------
+// Runfiles resolution
+// -----------------------------------------------------------------------------
+
+// resolver maps a runfiles path ("workspace/pkg/file") to a real path.
+// *runfiles.Runfiles implements it.
+type resolver interface {
+	Rlocation(path string) (string, error)
+}
+
+// dirResolver resolves runfiles paths relative to a plain directory laid out
+// like a runfiles tree, for running outside Bazel. Like Bazel's directory
+// based runfiles it does not check that the file exists.
+type dirResolver struct {
+	root string
+}
+
+func (d dirResolver) Rlocation(path string) (string, error) {
+	return filepath.Join(d.root, filepath.FromSlash(path)), nil
+}
+
+// newResolver returns the Bazel runfiles resolver, or a dirResolver for
+// root (from --runfiles-root) or, failing that, $RUNFILES_DIR when Bazel's
+// runfiles cannot be found.
+func newResolver(root string) (resolver, error) {
+	if root != "" {
+		debugf("resolving runfiles under --runfiles-root=%s", root)
+		return dirResolver{root: root}, nil
+	}
+	r, err := runfiles.New()
+	if err == nil {
+		return r, nil
+	}
+	if dir := os.Getenv("RUNFILES_DIR"); dir != "" {
+		debugf("runfiles: %v; resolving under RUNFILES_DIR=%s", err, dir)
+		return dirResolver{root: dir}, nil
+	}
+	return nil, fmt.Errorf("%w; run multirun with bazel run, or point --runfiles-root "+
+		"(or RUNFILES_DIR) at a runfiles tree such as bazel-bin/<target>.runfiles", err)
+}
+
+// failedResolver stands in for runfiles that could not be found, failing
+// every lookup with the reason.
+type failedResolver struct {
+	err error
+}
+
+func (f failedResolver) Rlocation(string) (string, error) {
+	return "", f.err
+}
+
+// literalResolver takes runfiles paths as plain file paths, relative ones
+// against the working directory, for --no-runfiles.
+type literalResolver struct{}
+
+func (literalResolver) Rlocation(path string) (string, error) {
+	return filepath.Abs(filepath.FromSlash(path))
+}
+
+// newLiteralResolver returns the resolver for --no-runfiles. The flag is
+// meant for exercising multirun with plain scripts in tests, so it is
+// refused whenever runfiles are there to be used.
+func newLiteralResolver(root string) (resolver, error) {
+	if root != "" {
+		return nil, errors.New("--no-runfiles cannot be combined with --runfiles-root")
+	}
+	if _, err := runfiles.New(); err == nil {
+		return nil, errors.New("--no-runfiles is only for testing without runfiles, but runfiles were found")
+	}
+	debugf("--no-runfiles: taking command paths as plain paths")
+	return literalResolver{}, nil
+}
@@ -0,0 +1,33 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/runfiles"
+)
+
+func TestNoRunfiles(t *testing.T) {
+	if _, err := runfiles.New(); err == nil {
+		t.Skip("--no-runfiles is refused where runfiles are available")
+	}
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	instr := filepath.Join(dir, "instr.json")
+	script := filepath.ToSlash(filepath.Join(dir, "rec.sh"))
+	err := os.WriteFile(instr, []byte(`{"commands": [{"path": "`+script+`", "tag": "a", "args": ["a"]}], "jobs": 1, "workspace_name": "_main"}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	stderr := capture(t, &os.Stderr, func() { code = Main([]string{instr, "--no-runfiles", "--"}) })
+	if code != 0 || len(recorded(t, dir)) != 1 {
+		t.Errorf("exit %d, stderr %q, want the path run as written", code, stderr)
+	}
+
+	stderr = capture(t, &os.Stderr, func() { code = Main([]string{instr, "--no-runfiles", "--runfiles-root=" + dir, "--"}) })
+	if code == 0 || !strings.Contains(stderr, "cannot be combined with --runfiles-root") {
+		t.Errorf("exit %d, stderr %q, want --runfiles-root refused", code, stderr)
+	}
+}
@@ -0,0 +1,320 @@
+package multirun
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Run results
+// -----------------------------------------------------------------------------
+
+// runResult records how every command of a run finished.
+type runResult struct {
+	state     []cmdState
+	codes     []int // exit code per command; -1 if it never produced one
+	failed    []int // indices of failed commands, in the order they failed
+	retries   []int // retries made per command
+	durations []time.Duration
+	usage     []*resourceUsage // nil where not reported
+	signals   []string         // name of the signal that killed each command, if any
+	reasons   []string         // why each skipped command was skipped
+	launch    []launchState    // whether each command's process was started
+	ready     []bool           // whose ready_check passed while running
+	// interrupted is set when a signal stopped the run
+	interrupted bool
+}
+
+func newRunResult(n int) *runResult {
+	res := &runResult{
+		state:     make([]cmdState, n),
+		codes:     make([]int, n),
+		retries:   make([]int, n),
+		durations: make([]time.Duration, n),
+		usage:     make([]*resourceUsage, n),
+		signals:   make([]string, n),
+		reasons:   make([]string, n),
+		launch:    make([]launchState, n),
+		ready:     make([]bool, n),
+	}
+	for i := range res.codes {
+		res.codes[i] = -1
+	}
+	return res
+}
+
+// succeeded reports whether a launch or Wait error counts as success for
+// blob: no error, or an exit code listed in allow_exit_codes.
+func succeeded(blob Command, err error) bool {
+	code := exitCodeOf(err)
+	return err == nil || (code > 0 && slices.Contains(blob.AllowExitCodes, code))
+}
+
+// finish records the outcome of command i from its launch or Wait error.
+// Exit codes listed in allow count as success.
+func (res *runResult) finish(i int, err error, allow []int) {
+	if err == nil {
+		res.state[i] = stateSucceeded
+		res.codes[i] = 0
+		return
+	}
+	res.codes[i] = exitCodeOf(err)
+	if res.codes[i] > 0 && slices.Contains(allow, res.codes[i]) {
+		res.state[i] = stateSucceeded
+		return
+	}
+	res.state[i] = stateFailed
+	res.failed = append(res.failed, i)
+}
+
+// exitCodeOf returns the exit code carried by a launch or Wait error: 0 for
+// nil, 128+signum for a process killed by a signal (as shells report it) and
+// -1 when the process never produced one.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if sig, _, ok := terminationSignal(exitErr.ProcessState); ok {
+			return 128 + int(sig)
+		}
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// launchState tells whether a command's process was started, so that a
+// command the run never got to is not mistaken for one that could not be
+// started.
+type launchState int
+
+const (
+	notStarted launchState = iota
+	launched
+	launchFailed
+)
+
+// noteLaunchFailure records that command i could not be started, unless an
+// earlier attempt was.
+func (res *runResult) noteLaunchFailure(i int) {
+	if res.launch[i] != launched {
+		res.launch[i] = launchFailed
+	}
+}
+
+// record notes that command i was started, how long its last run took,
+// what its process used and the signal that killed it, if any.
+func (res *runResult) record(i int, ps *os.ProcessState, d time.Duration) {
+	res.launch[i] = launched
+	res.durations[i] = d
+	res.usage[i] = usageOf(ps)
+	_, res.signals[i], _ = terminationSignal(ps)
+}
+
+// retryable reports whether a command that failed with err on its given
+// retry (0 for the first run) should be run again: allowed exit codes are
+// successes, and with retry_on_exit_codes only the listed codes retry.
+func retryable(blob Command, err error, retry int) bool {
+	if err == nil || retry >= blob.Retries {
+		return false
+	}
+	code := exitCodeOf(err)
+	if code > 0 && slices.Contains(blob.AllowExitCodes, code) {
+		return false
+	}
+	if len(blob.RetryOnExitCodes) > 0 {
+		return slices.Contains(blob.RetryOnExitCodes, code)
+	}
+	return true
+}
+
+// noteRetry records another retry of command i after it failed with err.
+func (res *runResult) noteRetry(blob Command, i int, err error) {
+	res.retries[i]++
+	fmt.Fprintf(os.Stderr, "multirun: %s failed with exit code %d, retrying (%d/%d)\n",
+		blob.Tag, exitCodeOf(err), res.retries[i], blob.Retries)
+}
+
+// skip marks command i as skipped for reason.
+func (res *runResult) skip(i int, reason string) {
+	res.state[i] = stateSkipped
+	res.reasons[i] = reason
+}
+
+// skipForDep skips command i because its dependency dep failed or was
+// skipped, and says so. A skipped dependency passes on its own reason, so
+// every command downstream of a failure names the command that failed.
+func (res *runResult) skipForDep(cmds []Command, i, dep int) {
+	reason := fmt.Sprintf("dependency %q failed", cmds[dep].Tag)
+	if res.state[dep] == stateSkipped {
+		reason = res.reasons[dep]
+	}
+	fmt.Fprintf(os.Stderr, "multirun: skipping %s (%s)\n", cmds[i].Tag, reason)
+	res.skip(i, reason)
+}
+
+// stopReason is the reason given for commands skipped once ctx is done or
+// the run is stopping.
+func stopReason(ctx context.Context) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "max_runtime_seconds exceeded"
+	}
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return cause.Error()
+	}
+	return "run stopped"
+}
+
+// ok reports whether no command failed or was skipped.
+func (res *runResult) ok() bool {
+	for _, s := range res.state {
+		if s == stateFailed || s == stateSkipped {
+			return false
+		}
+	}
+	return true
+}
+
+// tooManyFailures reports whether at least limit commands have failed; a
+// limit of 0 never is.
+func (res *runResult) tooManyFailures(limit int) bool {
+	return limit > 0 && len(res.failed) >= limit
+}
+
+// reportRetries prints, for every command that was retried, how many times
+// and the exit code it finally ended with.
+func (res *runResult) reportRetries(cmds []Command) {
+	for i, n := range res.retries {
+		if n > 0 {
+			fmt.Fprintf(os.Stderr, "multirun: %s: %d retries, final exit code %d\n", cmds[i].Tag, n, res.codes[i])
+		}
+	}
+}
+
+// failureSummary repeats, after a buffered run, the tag, exit code and
+// output of every failed command in one delimited section, so the failures
+// can be read together however far apart their output was. Skipped
+// commands follow, with the reason they did not run. It is empty when
+// every command succeeded.
+func failureSummary(cmds []Command, res *runResult, output map[int]string) string {
+	var skipped []int
+	for i, s := range res.state {
+		if s == stateSkipped {
+			skipped = append(skipped, i)
+		}
+	}
+	if len(res.failed) == 0 && len(skipped) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n===== multirun: %d of %d commands failed", len(res.failed), len(cmds))
+	if n := countLaunches(res, launchFailed); n > 0 {
+		fmt.Fprintf(&b, " (%d failed to start)", n)
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&b, ", %d not started", len(skipped))
+	}
+	b.WriteString(" =====\n")
+	for _, i := range res.failed {
+		if res.launch[i] == launchFailed {
+			fmt.Fprintf(&b, "----- %s (failed to start) -----\n", cmds[i].Tag)
+			continue
+		}
+		fmt.Fprintf(&b, "----- %s (exit code %d) -----\n", cmds[i].Tag, res.codes[i])
+		if text := strings.TrimSpace(output[i]); text != "" {
+			b.WriteString(text + "\n")
+		}
+	}
+	for _, i := range skipped {
+		fmt.Fprintf(&b, "----- %s (not started: %s) -----\n", cmds[i].Tag, res.reasons[i])
+	}
+	b.WriteString("=====")
+	return b.String()
+}
+
+// countLaunches counts the failed commands in launch state l.
+func countLaunches(res *runResult, l launchState) int {
+	n := 0
+	for _, i := range res.failed {
+		if res.launch[i] == l {
+			n++
+		}
+	}
+	return n
+}
+
+// progress summarizes the run so far, e.g.
+// "3/10 done, running: [build, test, lint]".
+func (res *runResult) progress(cmds []Command) string {
+	done := 0
+	var running []string
+	for i, s := range res.state {
+		switch s {
+		case stateSucceeded, stateFailed, stateSkipped:
+			done++
+		case stateRunning:
+			running = append(running, cmds[i].Tag)
+		}
+	}
+	return fmt.Sprintf("%d/%d done, running: [%s]", done, len(res.state), strings.Join(running, ", "))
+}
+
+// -----------------------------------------------------------------------------
+// Exit policy
+// -----------------------------------------------------------------------------
+
+// exitInterrupted is multirun's exit code when a signal stopped the run,
+// as shells report an interrupted command.
+const exitInterrupted = 130
+
+const (
+	exitPolicyAny   = "any"   // non-zero if any command failed
+	exitPolicyAll   = "all"   // non-zero only if every command failed
+	exitPolicyFirst = "first" // exit code of the first command that failed
+)
+
+func validateExitPolicy(policy string) error {
+	switch policy {
+	case "", exitPolicyAny, exitPolicyAll, exitPolicyFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown exit_policy %q (want %q, %q or %q)", policy, exitPolicyAny, exitPolicyAll, exitPolicyFirst)
+}
+
+// exitCode maps a run result to the process exit code under policy.
+func exitCode(policy string, res *runResult) int {
+	switch policy {
+	case exitPolicyAll:
+		for _, s := range res.state {
+			if s == stateSucceeded {
+				return 0
+			}
+		}
+		if len(res.state) == 0 {
+			return 0
+		}
+		return 1
+	case exitPolicyFirst:
+		if len(res.failed) > 0 {
+			// Launch failures have no usable exit code (-1)
+			if code := res.codes[res.failed[0]]; code > 0 {
+				return code
+			}
+			return 1
+		}
+		if !res.ok() {
+			return 1
+		}
+		return 0
+	default:
+		if res.ok() {
+			return 0
+		}
+		return 1
+	}
+}
@@ -0,0 +1,168 @@
+package multirun
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resultOf builds a runResult from states and exit codes, failures in
+// index order.
+func resultOf(states []cmdState, codes []int) *runResult {
+	res := newRunResult(len(states))
+	copy(res.state, states)
+	copy(res.codes, codes)
+	for i, s := range states {
+		if s == stateFailed {
+			res.failed = append(res.failed, i)
+		}
+	}
+	return res
+}
+
+func TestExitCodePolicies(t *testing.T) {
+	ok, fail, skip := stateSucceeded, stateFailed, stateSkipped
+	for _, tt := range []struct {
+		policy string
+		states []cmdState
+		codes  []int
+		want   int
+	}{
+		{"", []cmdState{ok, ok}, []int{0, 0}, 0},
+		{"any", []cmdState{ok, fail}, []int{0, 3}, 1},
+		{"any", []cmdState{ok, skip}, []int{0, -1}, 1},
+		{"all", []cmdState{ok, fail}, []int{0, 3}, 0},
+		{"all", []cmdState{fail, fail}, []int{2, 3}, 1},
+		{"all", nil, nil, 0},
+		{"first", []cmdState{ok, fail, fail}, []int{0, 7, 3}, 7},
+		{"first", []cmdState{fail}, []int{-1}, 1},
+		{"first", []cmdState{ok, skip}, []int{0, -1}, 1},
+		{"first", []cmdState{ok, ok}, []int{0, 0}, 0},
+	} {
+		if got := exitCode(tt.policy, resultOf(tt.states, tt.codes)); got != tt.want {
+			t.Errorf("exitCode(%q, %v %v) = %d, want %d", tt.policy, tt.states, tt.codes, got, tt.want)
+		}
+	}
+}
+
+func TestExitCodeFirstFollowsFailureOrder(t *testing.T) {
+	res := resultOf([]cmdState{stateFailed, stateFailed}, []int{4, 9})
+	res.failed = []int{1, 0}
+	if got := exitCode(exitPolicyFirst, res); got != 9 {
+		t.Errorf("exitCode = %d, want 9 from the command that failed first", got)
+	}
+}
+
+func TestValidateExitPolicy(t *testing.T) {
+	for _, p := range []string{"", "any", "all", "first"} {
+		if err := validateExitPolicy(p); err != nil {
+			t.Errorf("validateExitPolicy(%q): %v", p, err)
+		}
+	}
+	if err := validateExitPolicy("most"); err == nil {
+		t.Error("validateExitPolicy(\"most\"): expected an error")
+	}
+}
+
+// exitError returns the error of a process that exited with code.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	if exitCodeOf(err) != code {
+		t.Fatalf("sh exited with %v, want %d", err, code)
+	}
+	return err
+}
+
+func TestAllowExitCodes(t *testing.T) {
+	blob := Command{Tag: "lint", AllowExitCodes: []int{2}}
+	res := newRunResult(3)
+	res.finish(0, exitError(t, 2), blob.AllowExitCodes)
+	res.finish(1, exitError(t, 3), blob.AllowExitCodes)
+	res.finish(2, errors.New("exec: not found"), blob.AllowExitCodes)
+	if got := []cmdState{res.state[0], res.state[1], res.state[2]}; !slices.Equal(got, []cmdState{stateSucceeded, stateFailed, stateFailed}) {
+		t.Errorf("states = %v, want exit 2 allowed, exit 3 and the launch error failed", got)
+	}
+	if res.codes[0] != 2 {
+		t.Errorf("allowed exit code recorded as %d, want 2", res.codes[0])
+	}
+	if !slices.Equal(res.failed, []int{1, 2}) {
+		t.Errorf("failed = %v, want [1 2]", res.failed)
+	}
+	if !succeeded(blob, exitError(t, 2)) || succeeded(blob, exitError(t, 1)) {
+		t.Error("succeeded disagrees with allow_exit_codes")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	blob := Command{Retries: 2}
+	if retryable(blob, nil, 0) {
+		t.Error("a success was retried")
+	}
+	if !retryable(blob, exitError(t, 1), 1) || retryable(blob, exitError(t, 1), 2) {
+		t.Error("retries not bounded by retries")
+	}
+	blob.AllowExitCodes = []int{3}
+	if retryable(blob, exitError(t, 3), 0) {
+		t.Error("an allowed exit code was retried")
+	}
+	blob.RetryOnExitCodes = []int{75}
+	if !retryable(blob, exitError(t, 75), 0) || retryable(blob, exitError(t, 1), 0) {
+		t.Error("retry_on_exit_codes did not limit retries to the listed codes")
+	}
+}
+
+func TestFailureSummaryCountsSkipped(t *testing.T) {
+	cmds := tagged(nil, "migrate", "seed", "serve", "lint")
+	res := resultOf([]cmdState{stateFailed, stateSkipped, stateSkipped, stateSucceeded}, []int{3, -1, -1, 0})
+	res.launch[0] = launched
+	res.reasons[1] = "needs migrate, which failed"
+	res.reasons[2] = "needs migrate, which failed"
+	got := failureSummary(cmds, res, map[int]string{0: "relation exists\n"})
+	for _, want := range []string{
+		"1 of 4 commands failed, 2 not started =====",
+		"----- migrate (exit code 3) -----\nrelation exists\n",
+		"----- seed (not started: needs migrate, which failed) -----",
+		"----- serve (not started: needs migrate, which failed) -----",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("summary lacks %q:\n%s", want, got)
+		}
+	}
+	if failureSummary(cmds, resultOf(make([]cmdState, 4), nil), nil) != "" {
+		t.Error("summary printed with nothing failed or skipped")
+	}
+}
+
+func TestLaunchStates(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	if err := os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("not a program"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: []Command{
+			{Path: "ok.sh", Tag: "ok"},
+			{Path: "plain.txt", Tag: "plain"},
+			{Path: "ok.sh", Tag: "after"},
+		}, Jobs: 1})
+	})
+	got := map[string]string{}
+	for _, c := range res.Commands {
+		got[c.Tag] = c.Launch
+	}
+	want := map[string]string{"ok": "launched", "plain": "launch_failed", "after": "not_started"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("launch states = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package multirun
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Library API
+// -----------------------------------------------------------------------------
+
+// Runner runs Instructions from Go, as the multirun binary does for an
+// instructions file. The zero value resolves runfiles like the binary does.
+// Commands write to the process's stdout and stderr.
+type Runner struct {
+	// RunfilesRoot resolves command paths under this directory instead of
+	// Bazel's runfiles, like --runfiles-root. Commands with runfiles set to
+	// false need no runfiles at all.
+	RunfilesRoot string
+	// Only runs just the commands whose tag matches one of these patterns,
+	// like --only.
+	Only []string
+	// Prefix prefixes every output line with the command's [tag], like
+	// --prefix.
+	Prefix bool
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	// ExitCode is the exit code the multirun binary would exit with.
+	ExitCode int
+	// Commands holds the outcome of every command, in instructions order.
+	Commands []CommandResult
+}
+
+// CommandResult is the outcome of one command.
+type CommandResult struct {
+	Tag string
+	// Status is "succeeded", "failed", "skipped" or "not_run".
+	Status string
+	// Launch is "launched", "launch_failed" or "not_started", for
+	// commands the run never got to.
+	Launch string
+	// ExitCode is -1 if the command never produced one.
+	ExitCode int
+	Retries  int
+	Duration time.Duration
+	// Signal names the signal that killed the command, Unix only.
+	Signal string
+	// Reason says why a skipped command was skipped.
+	Reason string
+}
+
+// Run runs the commands of instr. extraArgs are appended to every command,
+// replacing default_extra_args when not empty. Includes are resolved like
+// the runfiles paths of commands. instr is not modified, and several Runs
+// may be in flight at once. The error is set only when the run could not
+// start, for instance because instr is invalid; failed commands show in the
+// Result.
+func (r *Runner) Run(ctx context.Context, instr Instructions, extraArgs []string) (Result, error) {
+	opts, _, err := parseArgs(nil)
+	if err != nil {
+		return Result{}, err
+	}
+	opts.runfilesRoot = r.RunfilesRoot
+	opts.only = r.Only
+	opts.prefix = r.Prefix
+
+	rf, err := newResolver(opts.runfilesRoot)
+	if err != nil {
+		// Only runfiles paths need the resolver: report it once one does
+		rf = failedResolver{err}
+	}
+
+	// Resolution rewrites the instructions in place: keep the caller's
+	// untouched, so that they can be run again
+	instr = cloneInstructions(instr)
+	if err := expandIncludes(rf, &instr, nil, false); err != nil {
+		return Result{}, err
+	}
+
+	args := commandArgs{global: extraArgs, byTag: opts.argsFor}
+	if err := prepare(rf, &instr, opts, &args); err != nil {
+		return Result{}, err
+	}
+	rn, err := newRunner(rf, &instr, opts, args)
+	if err != nil {
+		return Result{}, err
+	}
+	defer rn.transcript.close()
+	if err := rn.confirm(); err != nil {
+		return Result{}, err
+	}
+	code, run, err := rn.execute(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	out := Result{ExitCode: code}
+	for i, c := range instr.Commands {
+		out.Commands = append(out.Commands, CommandResult{
+			Tag:      c.Tag,
+			Status:   stateNames[run.state[i]],
+			Launch:   launchNames[run.launch[i]],
+			ExitCode: run.codes[i],
+			Retries:  run.retries[i],
+			Duration: run.durations[i],
+			Signal:   run.signals[i],
+			Reason:   run.reasons[i],
+		})
+	}
+	return out, nil
+}
+
+// cloneInstructions returns a deep copy of instr, sharing nothing that
+// running it may modify.
+func cloneInstructions(instr Instructions) Instructions {
+	instr.Commands = slices.Clone(instr.Commands)
+	for i := range instr.Commands {
+		instr.Commands[i] = cloneCommand(instr.Commands[i])
+	}
+	instr.Includes = slices.Clone(instr.Includes)
+	instr.Finalizer = clonePtr(instr.Finalizer, cloneCommand)
+	instr.BeforeAll = clonePtr(instr.BeforeAll, cloneCommand)
+	instr.DefaultExtraArgs = slices.Clone(instr.DefaultExtraArgs)
+	instr.GroupLimits = maps.Clone(instr.GroupLimits)
+	instr.InheritEnv = clonePtr(instr.InheritEnv, nil)
+	instr.InheritEnvKeys = slices.Clone(instr.InheritEnvKeys)
+	instr.InheritFds = slices.Clone(instr.InheritFds)
+	return instr
+}
+
+// cloneCommand returns a deep copy of c.
+func cloneCommand(c Command) Command {
+	c.Args = slices.Clone(c.Args)
+	c.Env = maps.Clone(c.Env)
+	c.Needs = slices.Clone(c.Needs)
+	c.AllowExitCodes = slices.Clone(c.AllowExitCodes)
+	c.RetryOnExitCodes = slices.Clone(c.RetryOnExitCodes)
+	c.OnFailure = clonePtr(c.OnFailure, cloneCommand)
+	c.Runfiles = clonePtr(c.Runfiles, nil)
+	c.InheritEnv = clonePtr(c.InheritEnv, nil)
+	c.InheritEnvKeys = slices.Clone(c.InheritEnvKeys)
+	c.Umask = clonePtr(c.Umask, nil)
+	c.ReadyCheck = clonePtr(c.ReadyCheck, nil)
+	c.CpuAffinity = slices.Clone(c.CpuAffinity)
+	return c
+}
+
+// clonePtr returns a pointer to a copy of *p, deep when clone is not nil,
+// or nil for a nil p.
+func clonePtr[T any](p *T, clone func(T) T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	if clone != nil {
+		v = clone(v)
+	}
+	return &v
+}
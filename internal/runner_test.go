@@ -0,0 +1,116 @@
+package multirun
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunnerRun(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"echo.sh": `echo "$MR_NAME: $*"`,
+		"fail.sh": "exit 3",
+	})
+	instr := Instructions{
+		Commands: []Command{
+			{Path: "echo.sh", Tag: "a", Args: []string{"x"}, Env: map[string]string{"MR_NAME": "first"}},
+			{Path: "fail.sh", Tag: "b"},
+		},
+		Jobs:      1,
+		KeepGoing: true,
+	}
+	var res Result
+	out := capture(t, &os.Stdout, func() { res = run(t, dir, instr, "y") })
+	if !strings.Contains(out, "first: x y") {
+		t.Errorf("output lacks the command's line:\n%s", out)
+	}
+	if res.ExitCode == 0 {
+		t.Error("exit code 0 despite a failing command")
+	}
+	want := []CommandResult{
+		{Tag: "a", Status: "succeeded", Launch: "launched", ExitCode: 0},
+		{Tag: "b", Status: "failed", Launch: "launched", ExitCode: 3},
+	}
+	for i := range res.Commands {
+		res.Commands[i].Duration = 0
+	}
+	if !reflect.DeepEqual(res.Commands, want) {
+		t.Errorf("Commands = %+v, want %+v", res.Commands, want)
+	}
+}
+
+func TestRunnerRunTwice(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"echo.sh": `echo "$*"`,
+		"ok.sh":   "exit 0",
+	})
+	fail := false
+	instr := Instructions{
+		Commands: []Command{
+			{Path: "echo.sh", Tag: "a", Args: []string{"{{tag}}-{{index}}"}, Env: map[string]string{}, OnFailure: &Command{Path: "ok.sh", Tag: "cleanup"}},
+			{Path: "echo.sh", Tag: "b", Needs: []string{"a"}, Runfiles: nil, InheritEnv: &fail, InheritEnvKeys: []string{"PATH"}},
+		},
+		Jobs:             1,
+		DefaultExtraArgs: []string{"d"},
+		Finalizer:        &Command{Path: "ok.sh", Tag: "fin"},
+		BeforeAll:        &Command{Path: "ok.sh", Tag: "setup"},
+		GroupLimits:      map[string]int{},
+	}
+	before := cloneInstructions(instr)
+	for n := range 2 {
+		var res Result
+		out := capture(t, &os.Stdout, func() {
+			res = run(t, dir, instr)
+		})
+		if res.ExitCode != 0 {
+			t.Fatalf("run %d failed: %+v", n+1, res)
+		}
+		if !strings.Contains(out, "a-0 d") {
+			t.Errorf("run %d: output lacks the expanded args:\n%s", n+1, out)
+		}
+		if !reflect.DeepEqual(instr, before) {
+			t.Fatalf("run %d modified the instructions:\n%+v\nwant\n%+v", n+1, instr, before)
+		}
+	}
+}
+
+func TestRunnerIncludes(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	inc := `{"commands": [{"path": "ok.sh", "tag": "included"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "inc.json"), []byte(inc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res := run(t, dir, Instructions{
+		Commands: []Command{{Path: "ok.sh", Tag: "root"}},
+		Includes: []string{"inc.json"},
+		Jobs:     1,
+	})
+	if got := statuses(res); got["root"] != "succeeded" || got["included"] != "succeeded" {
+		t.Errorf("statuses = %v, want root and included to succeed", got)
+	}
+}
+
+func TestRunnerConcurrent(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"ok.sh": "exit 0"})
+	instr := Instructions{Commands: []Command{{Path: "ok.sh", Tag: "a"}, {Path: "ok.sh", Tag: "b"}}}
+	results := make(chan Result)
+	capture(t, &os.Stdout, func() {
+		for range 4 {
+			go func() {
+				res, err := (&Runner{RunfilesRoot: dir}).Run(context.Background(), instr, nil)
+				if err != nil {
+					t.Error(err)
+				}
+				results <- res
+			}()
+		}
+		for range 4 {
+			if res := <-results; res.ExitCode != 0 {
+				t.Errorf("run failed: %+v", res)
+			}
+		}
+	})
+}
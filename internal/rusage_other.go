@@ -0,0 +1,10 @@
+//go:build !unix
+
+package multirun
+
+import "os"
+
+// usageOf returns nil: resource usage is only reported on Unix.
+func usageOf(ps *os.ProcessState) *resourceUsage {
+	return nil
+}
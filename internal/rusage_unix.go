@@ -0,0 +1,29 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// usageOf returns the resource usage of an exited process, or nil.
+func usageOf(ps *os.ProcessState) *resourceUsage {
+	if ps == nil {
+		return nil
+	}
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return nil
+	}
+	maxRSS := int64(ru.Maxrss)
+	if runtime.GOOS == "darwin" {
+		maxRSS /= 1024 // bytes there, kilobytes elsewhere
+	}
+	return &resourceUsage{
+		MaxRSSKb:  maxRSS,
+		UserCPUMs: ps.UserTime().Milliseconds(),
+		SysCPUMs:  ps.SystemTime().Milliseconds(),
+	}
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package multirun
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportResourceUsage(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"busy.sh": `i=0; while [ $i -lt 100000 ]; do i=$((i + 1)); done`,
+		"fail.sh": "exit 1",
+	})
+	report := filepath.Join(dir, "report.json")
+	instr := `{"commands": [
+  {"path": "busy.sh", "tag": "busy"},
+  {"path": "fail.sh", "tag": "fail"},
+  {"path": "busy.sh", "tag": "skipped"}
+], "jobs": 1}`
+	mainRun(t, dir, instr, "--report="+report)
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Commands []struct {
+			Tag       string `json:"tag"`
+			MaxRSSKb  *int64 `json:"max_rss_kb"`
+			UserCPUMs *int64 `json:"user_cpu_ms"`
+			SysCPUMs  *int64 `json:"sys_cpu_ms"`
+		} `json:"commands"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	busy := got.Commands[0]
+	if busy.MaxRSSKb == nil || *busy.MaxRSSKb <= 0 {
+		t.Errorf("busy: max_rss_kb %v, want the peak memory", busy.MaxRSSKb)
+	}
+	if busy.UserCPUMs == nil || busy.SysCPUMs == nil || *busy.UserCPUMs+*busy.SysCPUMs <= 0 {
+		t.Errorf("busy: user_cpu_ms %v, sys_cpu_ms %v, want the CPU time spent", busy.UserCPUMs, busy.SysCPUMs)
+	}
+	// A failed command reports its usage too, one that never ran has none
+	if got.Commands[1].MaxRSSKb == nil {
+		t.Error("fail: no resource usage")
+	}
+	if c := got.Commands[2]; c.MaxRSSKb != nil || c.UserCPUMs != nil {
+		t.Error("skipped: resource usage reported for a command that never ran")
+	}
+}
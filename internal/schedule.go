@@ -0,0 +1,220 @@
+package multirun
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Dependency graph
+// -----------------------------------------------------------------------------
+
+// cmdState tracks a command through the scheduler.
+type cmdState int
+
+const (
+	statePending cmdState = iota
+	stateRunning
+	stateSucceeded
+	stateFailed
+	stateSkipped
+)
+
+// depGraph holds the command indices each command waits for, as declared by
+// the tags in its `needs` field.
+type depGraph struct {
+	needs [][]int
+}
+
+func newDepGraph(cmds []Command) (*depGraph, error) {
+	byTag := map[string][]int{}
+	for i, c := range cmds {
+		if c.Tag != "" {
+			byTag[c.Tag] = append(byTag[c.Tag], i)
+		}
+	}
+
+	g := &depGraph{needs: make([][]int, len(cmds))}
+	for i, c := range cmds {
+		for _, tag := range c.Needs {
+			deps, ok := byTag[tag]
+			if !ok {
+				return nil, fmt.Errorf("command %q needs unknown tag %q", c.Tag, tag)
+			}
+			g.needs[i] = append(g.needs[i], deps...)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		tags := make([]string, len(cycle))
+		for i, idx := range cycle {
+			tags[i] = fmt.Sprintf("%q", cmds[idx].Tag)
+		}
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(tags, " -> "))
+	}
+	return g, nil
+}
+
+// findCycle returns the command indices forming a dependency cycle, with the
+// first index repeated at the end, or nil if the graph is acyclic.
+func (g *depGraph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	color := make([]int, len(g.needs))
+	var stack []int
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		color[i] = visiting
+		stack = append(stack, i)
+		for _, d := range g.needs[i] {
+			switch color[d] {
+			case visiting:
+				for j, s := range stack {
+					if s == d {
+						return append(append([]int{}, stack[j:]...), d)
+					}
+				}
+			case unvisited:
+				if c := visit(d); c != nil {
+					return c
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[i] = visited
+		return nil
+	}
+
+	for i := range g.needs {
+		if color[i] == unvisited {
+			if c := visit(i); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// order returns a topological order of the commands that keeps the original
+// order wherever dependencies allow it.
+func (g *depGraph) order() []int {
+	done := make([]bool, len(g.needs))
+	out := make([]int, 0, len(g.needs))
+	for len(out) < len(g.needs) {
+		for i := range g.needs {
+			if !done[i] && g.allDone(i, done) {
+				done[i] = true
+				out = append(out, i)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (g *depGraph) allDone(i int, done []bool) bool {
+	for _, d := range g.needs[i] {
+		if !done[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// readiness reports whether command i can start given the current states:
+// it returns the index of a failed or skipped dependency (or -1) and whether
+// all dependencies have succeeded, or are running and passed their
+// ready_check (as recorded in passed).
+func (g *depGraph) readiness(i int, state []cmdState, passed []bool) (failedDep int, ready bool) {
+	ready = true
+	for _, d := range g.needs[i] {
+		switch state[d] {
+		case stateFailed, stateSkipped:
+			return d, false
+		case stateSucceeded:
+		case stateRunning:
+			ready = ready && passed[d]
+		default:
+			ready = false
+		}
+	}
+	return -1, ready
+}
+
+// needed reports whether a command that needs command i is still pending
+// or running.
+func (g *depGraph) needed(i int, state []cmdState) bool {
+	for j, deps := range g.needs {
+		if (state[j] == statePending || state[j] == stateRunning) && slices.Contains(deps, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// waves groups the commands by how deep they sit in the dependency graph:
+// wave 0 needs nothing, and every other command is in the wave after its
+// latest dependency. Each wave keeps the commands in instructions order.
+func (g *depGraph) waves() [][]int {
+	wave := make([]int, len(g.needs))
+	var out [][]int
+	for _, i := range g.order() {
+		for _, d := range g.needs[i] {
+			wave[i] = max(wave[i], wave[d]+1)
+		}
+		if wave[i] == len(out) {
+			out = append(out, nil)
+		}
+	}
+	for i, w := range wave {
+		out[w] = append(out[w], i)
+	}
+	return out
+}
+
+// groupLimit returns how many commands of group may run at once; 0 means
+// no cap.
+func (instr *Instructions) groupLimit(group string) int {
+	limit, ok := instr.GroupLimits[group]
+	if !ok {
+		return 1
+	}
+	return limit
+}
+
+// shuffleCommands permutes cmds in place; the same seed always yields the
+// same order.
+func shuffleCommands(cmds []Command, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(cmds), func(i, j int) {
+		cmds[i], cmds[j] = cmds[j], cmds[i]
+	})
+}
+
+// parseJobsSpec computes a concurrency limit from a jobs_spec value: "auto"
+// for one job per CPU, "<factor>x" for a multiple of the CPU count (rounded
+// down, at least 1), or a plain integer.
+func parseJobsSpec(spec string, cpus int) (int, error) {
+	if spec == "auto" {
+		return cpus, nil
+	}
+	if factor, ok := strings.CutSuffix(spec, "x"); ok {
+		f, err := strconv.ParseFloat(factor, 64)
+		if err != nil || f <= 0 {
+			return 0, fmt.Errorf("bad CPU factor %q", spec)
+		}
+		return max(int(f*float64(cpus)), 1), nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("want auto, <factor>x or a number of jobs, got %q", spec)
+	}
+	return n, nil
+}
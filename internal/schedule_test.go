@@ -0,0 +1,153 @@
+package multirun
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseJobsSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want int
+	}{
+		{"auto", 8},
+		{"2x", 16},
+		{"0.5x", 4},
+		{"0.01x", 1},
+		{"3", 3},
+		{"0", 0},
+	} {
+		got, err := parseJobsSpec(tt.spec, 8)
+		if err != nil {
+			t.Errorf("parseJobsSpec(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseJobsSpec(%q) = %d, want %d", tt.spec, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"", "x", "-1", "0x", "many"} {
+		if _, err := parseJobsSpec(spec, 8); err == nil {
+			t.Errorf("parseJobsSpec(%q): expected an error", spec)
+		}
+	}
+}
+
+func tagged(needs map[string][]string, tags ...string) []Command {
+	cmds := make([]Command, len(tags))
+	for i, tag := range tags {
+		cmds[i] = Command{Tag: tag, Needs: needs[tag]}
+	}
+	return cmds
+}
+
+func TestDepGraphChain(t *testing.T) {
+	g, err := newDepGraph(tagged(map[string][]string{"serve": {"seed"}, "seed": {"migrate"}}, "serve", "seed", "migrate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.order(), []int{2, 1, 0}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	if got := len(g.waves()); got != 3 {
+		t.Errorf("%d waves, want 3", got)
+	}
+}
+
+func TestDepGraphDiamond(t *testing.T) {
+	g, err := newDepGraph(tagged(map[string][]string{"b": {"a"}, "c": {"a"}, "d": {"b", "c"}}, "a", "b", "c", "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.waves(), [][]int{{0}, {1, 2}, {3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("waves = %v, want %v", got, want)
+	}
+	state := []cmdState{stateSucceeded, stateFailed, stateRunning, statePending}
+	if dep, ready := g.readiness(3, state, make([]bool, 4)); dep != 1 || ready {
+		t.Errorf("readiness of d with b failed = %d, %t; want 1, false", dep, ready)
+	}
+	state[1] = stateSucceeded
+	if dep, ready := g.readiness(3, state, make([]bool, 4)); dep != -1 || ready {
+		t.Errorf("readiness of d with c running = %d, %t; want -1, false", dep, ready)
+	}
+	if _, ready := g.readiness(3, state, []bool{false, false, true, false}); !ready {
+		t.Error("d not ready once c passed its ready_check")
+	}
+}
+
+func TestDepGraphMissingTag(t *testing.T) {
+	_, err := newDepGraph(tagged(map[string][]string{"a": {"nope"}}, "a"))
+	if err == nil || !strings.Contains(err.Error(), `unknown tag "nope"`) {
+		t.Errorf("err = %v, want an unknown tag error", err)
+	}
+}
+
+func TestDepGraphCycle(t *testing.T) {
+	_, err := newDepGraph(tagged(map[string][]string{"a": {"c"}, "b": {"a"}, "c": {"b"}}, "a", "b", "c"))
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("err = %v, want a cycle error", err)
+	}
+}
+
+func TestShuffleCommandsIsSeeded(t *testing.T) {
+	tags := func(cmds []Command) []string {
+		var out []string
+		for _, c := range cmds {
+			out = append(out, c.Tag)
+		}
+		return out
+	}
+	orig := tagged(nil, "a", "b", "c", "d", "e", "f", "g", "h")
+	a, b := slices.Clone(orig), slices.Clone(orig)
+	shuffleCommands(a, 42)
+	shuffleCommands(b, 42)
+	if !slices.Equal(tags(a), tags(b)) {
+		t.Errorf("seed 42 gave %v and %v", tags(a), tags(b))
+	}
+	sorted := tags(a)
+	slices.Sort(sorted)
+	if !slices.Equal(sorted, tags(orig)) {
+		t.Errorf("shuffle lost or duplicated commands: %v", tags(a))
+	}
+	differs := false
+	for seed := range int64(10) {
+		c := slices.Clone(orig)
+		shuffleCommands(c, seed)
+		differs = differs || !slices.Equal(tags(c), tags(a))
+	}
+	if !differs {
+		t.Error("every seed gave the same order")
+	}
+}
+
+func TestGroupLimit(t *testing.T) {
+	instr := Instructions{GroupLimits: map[string]int{"db": 2, "cache": 0}}
+	for group, want := range map[string]int{"db": 2, "cache": 0, "other": 1} {
+		if got := instr.groupLimit(group); got != want {
+			t.Errorf("groupLimit(%q) = %d, want %d", group, got, want)
+		}
+	}
+}
+
+func TestWaveLimits(t *testing.T) {
+	cmds := []Command{{Group: "db"}, {Group: "db"}, {Group: "db"}, {Group: "cache"}, {Group: "cache"}, {Group: "lock"}}
+	wave := []int{0, 1, 2, 3, 4, 5}
+	for _, tt := range []struct {
+		jobs   int
+		limits map[string]int
+		want   []string
+	}{
+		{0, nil, []string{"group cache: at most 1 at a time", "group db: at most 1 at a time"}},
+		{0, map[string]int{"db": 2, "cache": 0}, []string{"group db: at most 2 at a time"}},
+		{0, map[string]int{"db": 3, "cache": 2}, nil},
+		{4, map[string]int{"db": 3, "cache": 2}, []string{"jobs: at most 4 at a time"}},
+		{1, map[string]int{"db": 3, "cache": 2}, []string{"serial: one at a time, in this order"}},
+	} {
+		rn := &runner{instr: &Instructions{Commands: cmds, Jobs: tt.jobs, GroupLimits: tt.limits}}
+		if got := rn.waveLimits(wave); !slices.Equal(got, tt.want) {
+			t.Errorf("jobs %d, group_limits %v: notes %q, want %q", tt.jobs, tt.limits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package multirun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+// Secrets
+// -----------------------------------------------------------------------------
+
+// secretPrefix marks an env value, "@secret:NAME", fetched from the
+// --secret-command when the command is launched.
+const secretPrefix = "@secret:"
+
+// secretSource runs the --secret-command, which reads a secret's name on
+// stdin and writes its value to stdout. Values are fetched once per name
+// and are never logged.
+type secretSource struct {
+	command string
+	mu      sync.Mutex
+	values  map[string]string
+}
+
+func newSecretSource(command string) *secretSource {
+	return &secretSource{command: command, values: map[string]string{}}
+}
+
+// resolve returns a copy of env, a command's own env entries, with its
+// @secret: values replaced by the secrets they name. Inherited variables
+// are never resolved. It works on a nil source too, failing only when env
+// has such values.
+func (s *secretSource) resolve(env map[string]string) (map[string]string, error) {
+	resolved := maps.Clone(env)
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		name, ok := strings.CutPrefix(env[k], secretPrefix)
+		if !ok {
+			continue
+		}
+		if s == nil {
+			return nil, fmt.Errorf("env %s needs a secret, but no --secret-command is given", k)
+		}
+		value, err := s.fetch(name)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: secret %s: %w", k, name, err)
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
+func (s *secretSource) fetch(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[name]; ok {
+		return v, nil
+	}
+	cmd := exec.Command(s.command)
+	cmd.Stdin = strings.NewReader(name + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("--secret-command: %w", err)
+	}
+	if bytes.IndexByte(out, 0) >= 0 {
+		return "", errors.New("--secret-command: the value holds a NUL byte")
+	}
+	v := strings.TrimSuffix(strings.TrimSuffix(string(out), "\n"), "\r")
+	s.values[name] = v
+	debugf("secret %s: fetched", name)
+	return v, nil
+}
+
+// redactSecret returns "***" in place of an @secret: env value, and any
+// other value unchanged.
+func redactSecret(v string) string {
+	if strings.HasPrefix(v, secretPrefix) {
+		return "***"
+	}
+	return v
+}
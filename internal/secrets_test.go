@@ -0,0 +1,66 @@
+package multirun
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secretRun runs a command that prints $TOKEN, set to @secret:token, and
+// $INHERITED through Main with a fake --secret-command that only knows
+// token.
+func secretRun(t *testing.T, flags ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	dir := scriptDir(t, map[string]string{
+		"secret.sh": `read name; [ "$name" = token ] && echo s3cret`,
+		"show.sh":   `echo "token=$TOKEN inherited=$INHERITED"`,
+	})
+	t.Setenv("INHERITED", secretPrefix+"unknown")
+	instr := `{"commands": [{"path": "show.sh", "tag": "show", "env": {"TOKEN": "@secret:token"}}], "jobs": 1}`
+	flags = append([]string{"--secret-command=" + filepath.Join(dir, "secret.sh")}, flags...)
+	return mainRun(t, dir, instr, flags...)
+}
+
+func TestSecretSubstitution(t *testing.T) {
+	code, stdout, stderr := secretRun(t, "-v")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	// Only the command's own env is resolved, not what it inherits
+	if want := "token=s3cret inherited=" + secretPrefix + "unknown"; !strings.Contains(stdout, want) {
+		t.Errorf("stdout %q lacks %q", stdout, want)
+	}
+	if strings.Contains(stderr, "s3cret") {
+		t.Errorf("verbose log leaks the secret: %s", stderr)
+	}
+	if !strings.Contains(stderr, "TOKEN='***'") {
+		t.Errorf("verbose log %q does not show the redacted TOKEN", stderr)
+	}
+}
+
+func TestPrintEnvRedactsSecrets(t *testing.T) {
+	code, stdout, stderr := secretRun(t, "--print-env=show")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	for _, want := range []string{"TOKEN=***\n", "INHERITED=" + secretPrefix + "unknown\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("--print-env output %q lacks %q", stdout, want)
+		}
+	}
+	if strings.Contains(stdout, "s3cret") {
+		t.Errorf("--print-env leaks the secret: %s", stdout)
+	}
+}
+
+func TestSecretCommandFailure(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"secret.sh": "exit 1",
+		"show.sh":   "echo ran",
+	})
+	instr := `{"commands": [{"path": "show.sh", "tag": "show", "env": {"TOKEN": "@secret:token"}}], "jobs": 1}`
+	code, stdout, _ := mainRun(t, dir, instr, "--secret-command="+filepath.Join(dir, "secret.sh"))
+	if code == 0 || strings.Contains(stdout, "ran") {
+		t.Errorf("exit code %d, stdout %q: want the command to fail without running", code, stdout)
+	}
+}
@@ -0,0 +1,199 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Tag selection
+// -----------------------------------------------------------------------------
+
+// tagSelector matches command tags. Plain values match exactly, values
+// containing '*' or '?' are shell globs, and values wrapped in slashes
+// ("/^db_/") are regular expressions.
+type tagSelector struct {
+	raw   string
+	glob  bool
+	regex *regexp.Regexp
+}
+
+func parseTagSelector(s string) (tagSelector, error) {
+	sel := tagSelector{raw: s}
+	switch {
+	case len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return sel, fmt.Errorf("bad regex selector %q: %w", s, err)
+		}
+		sel.regex = re
+	case strings.ContainsAny(s, "*?"):
+		if _, err := path.Match(s, ""); err != nil {
+			return sel, fmt.Errorf("bad glob selector %q: %w", s, err)
+		}
+		sel.glob = true
+	}
+	return sel, nil
+}
+
+func (sel tagSelector) match(tag string) bool {
+	switch {
+	case sel.regex != nil:
+		return sel.regex.MatchString(tag)
+	case sel.glob:
+		ok, _ := path.Match(sel.raw, tag)
+		return ok
+	}
+	return sel.raw == tag
+}
+
+// selectCommands keeps the commands matching any of the selectors, warning
+// about selectors that match nothing.
+func selectCommands(cmds []Command, raw []string) ([]Command, error) {
+	sels := make([]tagSelector, 0, len(raw))
+	for _, r := range raw {
+		sel, err := parseTagSelector(r)
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	out, matched := filterCommands(cmds, sels)
+	for j, sel := range sels {
+		if !matched[j] {
+			fmt.Fprintf(os.Stderr, "multirun: warning: --only selector %q matched no commands\n", sel.raw)
+		}
+	}
+	return out, nil
+}
+
+// filterCommands keeps the commands matching any of sels and reports which
+// selectors matched something. Dependencies on commands that were filtered
+// out are dropped: the caller asked for exactly this set.
+func filterCommands(cmds []Command, sels []tagSelector) ([]Command, []bool) {
+	matched := make([]bool, len(sels))
+	var out []Command
+	for _, c := range cmds {
+		keep := false
+		for j, sel := range sels {
+			if sel.match(c.Tag) {
+				matched[j] = true
+				keep = true
+			}
+		}
+		if keep {
+			out = append(out, c)
+		}
+	}
+	pruneNeeds(out)
+	return out, matched
+}
+
+// pruneNeeds drops needs naming commands that are not in cmds.
+func pruneNeeds(cmds []Command) {
+	kept := map[string]bool{}
+	for _, c := range cmds {
+		kept[c.Tag] = true
+	}
+	for i := range cmds {
+		var needs []string
+		for _, tag := range cmds[i].Needs {
+			if kept[tag] {
+				needs = append(needs, tag)
+			}
+		}
+		cmds[i].Needs = needs
+	}
+}
+
+// dropDisabled removes the disabled commands from cmds.
+func dropDisabled(cmds []Command) []Command {
+	var out []Command
+	for _, c := range cmds {
+		if c.Disabled {
+			debugf("skipping %s (disabled)", c.Tag)
+			continue
+		}
+		out = append(out, c)
+	}
+	pruneNeeds(out)
+	return out
+}
+
+// selectFailed keeps the commands that failed in the --report file at
+// reportPath, warning about failed tags no longer in cmds.
+func selectFailed(cmds []Command, reportPath string) ([]Command, error) {
+	tags, err := failedTags(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	sels := make([]tagSelector, len(tags))
+	for j, tag := range tags {
+		// Tags are matched exactly, even when they look like globs
+		sels[j] = tagSelector{raw: tag}
+	}
+	out, matched := filterCommands(cmds, sels)
+	for j, tag := range tags {
+		if !matched[j] {
+			fmt.Fprintf(os.Stderr, "multirun: warning: --rerun-failed: %q is no longer in the instructions, skipping it\n", tag)
+		}
+	}
+	return out, nil
+}
+
+// completionTags returns the tags of cmds as one space-separated line, for
+// shell completion of --only. A bash completion function to pair it with:
+//
+//	_multirun() {
+//	  if [[ ${COMP_WORDS[COMP_CWORD-1]} == --only ]]; then
+//	    COMPREPLY=($(compgen -W "$(multirun "${COMP_WORDS[1]}" --complete-tags --)" -- "${COMP_WORDS[COMP_CWORD]}"))
+//	  fi
+//	}
+//	complete -F _multirun multirun
+//
+// In zsh, load it with `autoload -U bashcompinit && bashcompinit` first.
+func completionTags(cmds []Command) string {
+	tags := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		if c.Tag != "" {
+			tags = append(tags, c.Tag)
+		}
+	}
+	return strings.Join(tags, " ")
+}
+
+// applyLabels renames commands for --label: each OLD=NEW value renames the
+// command tagged OLD or, failing that, the command at index OLD. Needs
+// referring to a renamed tag follow it.
+func applyLabels(cmds []Command, labels []string) error {
+	renamed := map[string]string{}
+	for _, l := range labels {
+		old, tag, ok := strings.Cut(l, "=")
+		if !ok || old == "" || tag == "" {
+			return fmt.Errorf("expected TAG=NEWTAG or INDEX=NEWTAG, got %q", l)
+		}
+		i := slices.IndexFunc(cmds, func(c Command) bool { return c.Tag == old })
+		if i < 0 {
+			n, err := strconv.Atoi(old)
+			if err != nil || n < 0 || n >= len(cmds) {
+				return fmt.Errorf("no command tagged %q", old)
+			}
+			i = n
+		}
+		renamed[cmds[i].Tag] = tag
+		cmds[i].Tag = tag
+	}
+	for i := range cmds {
+		for j, need := range cmds[i].Needs {
+			if tag, ok := renamed[need]; ok {
+				cmds[i].Needs[j] = tag
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func tagsOf(cmds []Command) []string {
+	out := []string{}
+	for _, c := range cmds {
+		out = append(out, c.Tag)
+	}
+	return out
+}
+
+func TestSelectCommands(t *testing.T) {
+	cmds := tagged(map[string][]string{"test-unit": {"db_up"}}, "db_up", "db_down", "test-unit", "test-e2e", "lint")
+	for _, tt := range []struct {
+		sels []string
+		want []string
+	}{
+		{[]string{"lint"}, []string{"lint"}},
+		{[]string{"test-*"}, []string{"test-unit", "test-e2e"}},
+		{[]string{"/^db_/"}, []string{"db_up", "db_down"}},
+		{[]string{"lint", "test-?2e"}, []string{"test-e2e", "lint"}},
+		{[]string{"nope"}, []string{}},
+	} {
+		var got []Command
+		var err error
+		capture(t, &os.Stderr, func() { got, err = selectCommands(cmds, tt.sels) })
+		if err != nil {
+			t.Fatalf("selectCommands(%q): %v", tt.sels, err)
+		}
+		if !slices.Equal(tagsOf(got), tt.want) {
+			t.Errorf("selectCommands(%q) = %v, want %v", tt.sels, tagsOf(got), tt.want)
+		}
+	}
+	for _, bad := range []string{"/(/", "[x*"} {
+		if _, err := selectCommands(cmds, []string{bad}); err == nil {
+			t.Errorf("selectCommands(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestSelectCommandsPrunesNeeds(t *testing.T) {
+	cmds := tagged(map[string][]string{"test": {"build", "db"}}, "build", "db", "test")
+	got, err := selectCommands(cmds, []string{"build", "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needs := got[1].Needs; !slices.Equal(needs, []string{"build"}) {
+		t.Errorf("test needs %v, want only the selected build", needs)
+	}
+}
+
+func TestCompleteTags(t *testing.T) {
+	if got := completionTags([]Command{{Tag: "api"}, {Path: "untagged"}, {Tag: "db"}}); got != "api db" {
+		t.Errorf("completionTags = %q, want %q", got, "api db")
+	}
+	dir := scriptDir(t, map[string]string{"x.sh": "exit 0"})
+	code, stdout, _ := mainRun(t, dir, `{"commands": [{"path": "x.sh", "tag": "x"}, {"path": "x.sh", "tag": "y"}], "jobs": 1}`, "--complete-tags")
+	if code != 0 || stdout != "x y\n" {
+		t.Errorf("exit %d, stdout %q, want the tags", code, stdout)
+	}
+}
+
+func TestSelectFailed(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.json")
+	err := os.WriteFile(report, []byte(`{"exit_code": 1, "commands": [
+		{"tag": "api", "status": "succeeded"},
+		{"tag": "db", "status": "failed"},
+		{"tag": "gone", "status": "failed"},
+		{"tag": "lint*", "status": "failed"}
+	]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := tagged(nil, "api", "db", "lint-go", "lint*")
+	var got []Command
+	stderr := capture(t, &os.Stderr, func() {
+		got, err = selectFailed(cmds, report)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := tagsOf(got); !slices.Equal(tags, []string{"db", "lint*"}) {
+		t.Errorf("selected %v, want the failed tags matched exactly", tags)
+	}
+	if !strings.Contains(stderr, `"gone" is no longer in the instructions`) {
+		t.Errorf("stderr = %q, want a warning about gone", stderr)
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	cmds := tagged(map[string][]string{"api": {"db"}}, "db", "api", "")
+	if err := applyLabels(cmds, []string{"db=postgres", "2=worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if tags := tagsOf(cmds); !slices.Equal(tags, []string{"postgres", "api", "worker"}) {
+		t.Errorf("tags = %v, want db and index 2 renamed", tags)
+	}
+	if !slices.Equal(cmds[1].Needs, []string{"postgres"}) {
+		t.Errorf("api needs %v, want the renamed tag", cmds[1].Needs)
+	}
+	for _, l := range []string{"nope=x", "7=x", "db", "api="} {
+		if err := applyLabels(cmds, []string{l}); err == nil {
+			t.Errorf("--label=%s accepted", l)
+		}
+	}
+}
+
+func TestDropDisabled(t *testing.T) {
+	cmds := tagged(map[string][]string{"api": {"db", "cache"}}, "db", "cache", "api")
+	cmds[1].Disabled = true
+	out := dropDisabled(cmds)
+	if tags := tagsOf(out); !slices.Equal(tags, []string{"db", "api"}) {
+		t.Errorf("kept %v, want cache dropped", tags)
+	}
+	if !slices.Equal(out[1].Needs, []string{"db"}) {
+		t.Errorf("api needs %v, want the disabled command pruned", out[1].Needs)
+	}
+}
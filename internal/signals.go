@@ -0,0 +1,118 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Signals
+// -----------------------------------------------------------------------------
+
+// signalsByName lists the signals that can be named in the instructions.
+// They exist in the syscall package on every platform multirun supports.
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// parseSignal parses a signal name such as "SIGTERM" or "term"; an empty
+// name yields def.
+func parseSignal(name string, def syscall.Signal) (syscall.Signal, error) {
+	if name == "" {
+		return def, nil
+	}
+	key := strings.ToUpper(name)
+	if !strings.HasPrefix(key, "SIG") {
+		key = "SIG" + key
+	}
+	sig, ok := signalsByName[key]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q (want SIGHUP, SIGINT, SIGQUIT, SIGKILL or SIGTERM)", name)
+	}
+	return sig, nil
+}
+
+// signalProcess sends sig to p. Windows cannot deliver most signals, so
+// there the process is killed instead. A process that never started (nil p)
+// is left alone.
+func signalProcess(p *os.Process, sig syscall.Signal) error {
+	if p == nil {
+		return nil
+	}
+	err := p.Signal(sig)
+	if err != nil && runtime.GOOS == "windows" {
+		return p.Kill()
+	}
+	return err
+}
+
+// forwardSignals calls onSignal when multirun is interrupted, terminated
+// or hung up, instead of letting the signal kill it, so that the caller can
+// pass child_kill_signal on to its commands and stop the run. Any further
+// signal calls it again with again set, for the caller to kill what is
+// still running: a second Ctrl-C always ends the run. The returned stop
+// ends the handling.
+func forwardSignals(onSignal func(again bool)) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for again := false; ; again = true {
+			select {
+			case <-signals:
+				if again {
+					fmt.Fprintln(os.Stderr, "multirun: signaled again, killing the running commands")
+				}
+				onSignal(again)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// interruptSignal is the signal forwardSignals' callers send their commands:
+// sig the first time and SIGKILL once signaled again.
+func interruptSignal(sig syscall.Signal, again bool) syscall.Signal {
+	if again {
+		return syscall.SIGKILL
+	}
+	return sig
+}
+
+// defaultKillGrace is how long a command that ran out of time gets to exit
+// after timeout_kill_signal before it is killed.
+const defaultKillGrace = 5 * time.Second
+
+// timeoutKill returns the signal sent to c when it runs out of time and how
+// long it then has before being killed. The signal was validated at startup.
+func (c Command) timeoutKill() (syscall.Signal, time.Duration) {
+	sig, _ := parseSignal(c.TimeoutKillSignal, syscall.SIGKILL)
+	grace := defaultKillGrace
+	if c.TimeoutKillGraceMs > 0 {
+		grace = time.Duration(c.TimeoutKillGraceMs) * time.Millisecond
+	}
+	return sig, grace
+}
+
+// terminate sends sig to p and, unless that was SIGKILL, kills p if it is
+// still running after grace.
+func terminate(p *os.Process, sig syscall.Signal, grace time.Duration) {
+	_ = signalProcess(p, sig)
+	if sig != syscall.SIGKILL {
+		time.AfterFunc(grace, func() { p.Kill() })
+	}
+}
@@ -0,0 +1,44 @@
+package multirun
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want syscall.Signal
+	}{
+		{"", syscall.SIGINT},
+		{"SIGTERM", syscall.SIGTERM},
+		{"term", syscall.SIGTERM},
+		{"Kill", syscall.SIGKILL},
+		{"sighup", syscall.SIGHUP},
+		{"SIGQUIT", syscall.SIGQUIT},
+	} {
+		got, err := parseSignal(tt.name, syscall.SIGINT)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSignal(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	// Only names are accepted; numbers differ between platforms
+	for _, name := range []string{"9", "15", "SIGUSR1", "SIG", "bogus"} {
+		if _, err := parseSignal(name, syscall.SIGINT); err == nil || !strings.Contains(err.Error(), "unknown signal") {
+			t.Errorf("parseSignal(%q): err = %v, want an unknown signal", name, err)
+		}
+	}
+}
+
+func TestInvalidChildKillSignalRefused(t *testing.T) {
+	r := &Runner{RunfilesRoot: t.TempDir()}
+	_, err := r.Run(context.Background(), Instructions{
+		Commands:        []Command{{Path: "ok.sh", Tag: "ok"}},
+		ChildKillSignal: "SIGBOGUS",
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "child_kill_signal") {
+		t.Errorf("err = %v, want child_kill_signal refused before running", err)
+	}
+}
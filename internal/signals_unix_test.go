@@ -0,0 +1,96 @@
+//go:build unix
+
+package multirun
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestForwardSignalsEscalates(t *testing.T) {
+	calls := make(chan bool, 3)
+	capture(t, &os.Stderr, func() {
+		stop := forwardSignals(func(again bool) { calls <- again })
+		defer stop()
+		for _, want := range []bool{false, true, true} {
+			if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case again := <-calls:
+				if again != want {
+					t.Errorf("onSignal(again=%t), want again=%t", again, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("signal not handled")
+			}
+		}
+	})
+}
+
+func TestInterruptSignal(t *testing.T) {
+	if got := interruptSignal(syscall.SIGTERM, false); got != syscall.SIGTERM {
+		t.Errorf("first signal sends %v, want SIGTERM", got)
+	}
+	if got := interruptSignal(syscall.SIGTERM, true); got != syscall.SIGKILL {
+		t.Errorf("second signal sends %v, want SIGKILL", got)
+	}
+}
+
+// interruptRun runs n commands that each sleep for 30 seconds, jobs at a
+// time, and interrupts multirun once started of them are running.
+func interruptRun(t *testing.T, n, jobs, started int) Result {
+	t.Helper()
+	dir := scriptDir(t, map[string]string{"slow.sh": "echo started >> \"$(dirname \"$0\")/log\"; exec sleep 30"})
+	var cmds []Command
+	for i := range n {
+		cmds = append(cmds, Command{Path: "slow.sh", Tag: fmt.Sprint("slow", i)})
+	}
+	go func() {
+		for {
+			data, _ := os.ReadFile(filepath.Join(dir, "log"))
+			if bytes.Count(data, []byte("\n")) >= started {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	start := time.Now()
+	var res Result
+	capture(t, &os.Stderr, func() {
+		res = run(t, dir, Instructions{Commands: cmds, Jobs: jobs})
+	})
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("run took %v, the interrupt did not stop the commands", elapsed)
+	}
+	if res.ExitCode == 0 {
+		t.Error("an interrupted run succeeded")
+	}
+	return res
+}
+
+// TestInterruptParallelRun interrupts a run while it is still launching
+// commands, which the race detector checks against the interrupt handler.
+func TestInterruptParallelRun(t *testing.T) {
+	res := interruptRun(t, 12, 4, 4)
+	for _, c := range res.Commands {
+		if c.Status == "succeeded" || c.Status == "running" {
+			t.Errorf("%s: status %s after the interrupt", c.Tag, c.Status)
+		}
+	}
+}
+
+func TestInterruptSerialRun(t *testing.T) {
+	got := statuses(interruptRun(t, 3, 1, 1))
+	want := map[string]string{"slow0": "failed", "slow1": "skipped", "slow2": "skipped"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want the running command stopped and the rest skipped", got)
+	}
+}
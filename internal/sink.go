@@ -0,0 +1,27 @@
+package multirun
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// -----------------------------------------------------------------------------
+// Output sinks
+// -----------------------------------------------------------------------------
+
+// openSink opens a command's output_sink: "unix://path" dials a Unix
+// socket, "pipe://path" opens a named pipe that must already have a reader.
+func openSink(spec string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(spec, "unix://"):
+		return net.Dial("unix", strings.TrimPrefix(spec, "unix://"))
+	case strings.HasPrefix(spec, "pipe://"):
+		// Non-blocking, so a pipe nobody reads fails instead of hanging
+		return os.OpenFile(strings.TrimPrefix(spec, "pipe://"), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	}
+	return nil, fmt.Errorf("unsupported output_sink %q (want unix://path or pipe://path)", spec)
+}
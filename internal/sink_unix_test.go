@@ -0,0 +1,74 @@
+//go:build unix
+
+package multirun
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocketSink(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"talk.sh": "echo to stdout; echo to stderr >&2"})
+	// Socket paths are short-lived and length-limited, hence not t.TempDir
+	sockDir, err := os.MkdirTemp("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sockDir)
+	sock := filepath.Join(sockDir, "s")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	var res Result
+	stdout := capture(t, &os.Stdout, func() {
+		res = run(t, dir, Instructions{Commands: []Command{{Path: "talk.sh", Tag: "talk", OutputSink: "unix://" + sock}}, Jobs: 1})
+	})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	got := <-received
+	for _, want := range []string{"to stdout\n", "to stderr\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sink received %q, lacking %q", got, want)
+		}
+	}
+	if strings.Contains(stdout, "to stdout") {
+		t.Errorf("output also went to stdout: %q", stdout)
+	}
+}
+
+func TestOpenSinkErrors(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{
+		"pipe://" + fifo, // nobody reads it
+		"unix://" + filepath.Join(t.TempDir(), "none"),
+		"tcp://localhost:1",
+	} {
+		if w, err := openSink(spec); err == nil {
+			w.Close()
+			t.Errorf("openSink(%q) succeeded", spec)
+		}
+	}
+}
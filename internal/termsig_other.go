@@ -0,0 +1,13 @@
+//go:build !unix
+
+package multirun
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminationSignal reports no signal: processes only end by signal on Unix.
+func terminationSignal(ps *os.ProcessState) (syscall.Signal, string, bool) {
+	return 0, "", false
+}
@@ -0,0 +1,45 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalNames names the signals a command is commonly killed by.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// terminationSignal returns the signal that killed an exited process, its
+// name, and whether there was one.
+func terminationSignal(ps *os.ProcessState) (syscall.Signal, string, bool) {
+	if ps == nil {
+		return 0, "", false
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, "", false
+	}
+	sig := ws.Signal()
+	name, ok := signalNames[sig]
+	if !ok {
+		name = sig.String()
+	}
+	return sig, name, true
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalExitCode(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"die.sh": `kill -TERM $$`})
+	res := run(t, dir, Instructions{Commands: []Command{{Path: "die.sh", Tag: "die"}}, Jobs: 1})
+	c := res.Commands[0]
+	if c.ExitCode != 143 || c.Signal != "SIGTERM" {
+		t.Errorf("exit code %d, signal %q, want 143 and SIGTERM", c.ExitCode, c.Signal)
+	}
+	if res.ExitCode == 0 {
+		t.Error("a command killed by a signal did not fail the run")
+	}
+}
+
+func TestTimeoutKillEscalates(t *testing.T) {
+	stubborn := Command{Path: "stubborn.sh", Tag: "stubborn", TimeoutKillSignal: "SIGTERM", TimeoutKillGraceMs: 300}
+	idle := stubborn
+	idle.IdleTimeoutSeconds = 1
+	for _, tt := range []struct {
+		name  string
+		instr Instructions
+	}{
+		{"max_runtime_seconds", Instructions{Commands: []Command{stubborn}, MaxRuntimeSeconds: 1}},
+		{"idle_timeout_seconds", Instructions{Commands: []Command{idle}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// It notes the SIGTERM, but keeps running
+			dir := scriptDir(t, map[string]string{
+				"stubborn.sh": `trap 'echo term >> "$(dirname "$0")/log"' TERM; while :; do sleep 0.1; done`,
+			})
+			for _, jobs := range []int{1, 0} {
+				os.Remove(filepath.Join(dir, "log"))
+				tt.instr.Jobs = jobs
+				var res Result
+				capture(t, &os.Stderr, func() { res = run(t, dir, tt.instr) })
+				c := res.Commands[0]
+				if got := recorded(t, dir); !slices.Equal(got, []string{"term"}) {
+					t.Errorf("jobs %d: the command saw %q, want one SIGTERM", jobs, got)
+				}
+				if c.Signal != "SIGKILL" || c.Duration > 3*time.Second {
+					t.Errorf("jobs %d: killed by %q after %s, want SIGKILL once the grace period is over", jobs, c.Signal, c.Duration)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeoutKill(t *testing.T) {
+	for _, tt := range []struct {
+		c     Command
+		sig   syscall.Signal
+		grace time.Duration
+	}{
+		{Command{}, syscall.SIGKILL, defaultKillGrace},
+		{Command{TimeoutKillSignal: "term"}, syscall.SIGTERM, defaultKillGrace},
+		{Command{TimeoutKillSignal: "SIGINT", TimeoutKillGraceMs: 250}, syscall.SIGINT, 250 * time.Millisecond},
+	} {
+		sig, grace := tt.c.timeoutKill()
+		if sig != tt.sig || grace != tt.grace {
+			t.Errorf("%+v: timeoutKill() = %v, %s, want %v, %s", tt.c, sig, grace, tt.sig, tt.grace)
+		}
+	}
+}
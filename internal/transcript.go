@@ -0,0 +1,44 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Transcript
+// -----------------------------------------------------------------------------
+
+// transcript is the transcript_file: every line of output from every
+// command, whatever the console shows, written in the order it arrives as
+// "<timestamp> [tag] line". Its methods do nothing on a nil transcript.
+type transcript struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openTranscript(path string) (*transcript, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &transcript{f: f}, nil
+}
+
+// line returns the emit function for the lines of the command tagged tag.
+func (t *transcript) line(tag string) func(string) {
+	return func(line string) {
+		ts := time.Now().UTC().Format(time.RFC3339Nano)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fmt.Fprintf(t.f, "%s [%s] %s\n", ts, tag, line)
+	}
+}
+
+func (t *transcript) close() {
+	if t != nil {
+		t.f.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscript(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"a.sh": "echo a1; sleep 0.4; echo a2 >&2",
+		"b.sh": "sleep 0.2; echo b1",
+	})
+	path := filepath.Join(dir, "transcript.log")
+	var stdout string
+	capture(t, &os.Stderr, func() {
+		stdout = capture(t, &os.Stdout, func() {
+			run(t, dir, Instructions{
+				Commands:       []Command{{Path: "a.sh", Tag: "a"}, {Path: "b.sh", Tag: "b"}},
+				BufferOutput:   true,
+				TranscriptFile: path,
+			})
+		})
+	})
+	// The console shows each command's output in one piece
+	if !strings.Contains(stdout, "a1\na2\n") {
+		t.Errorf("stdout %q does not keep a's output together", stdout)
+	}
+
+	// while the transcript has every line as it came, stderr included
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	var last time.Time
+	for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		stamp, rest, _ := strings.Cut(l, " ")
+		ts, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil {
+			t.Fatalf("line %q: %v", l, err)
+		}
+		if ts.Before(last) {
+			t.Errorf("line %q is stamped before the one above it", l)
+		}
+		last = ts
+		lines = append(lines, rest)
+	}
+	if want := []string{"[a] a1", "[b] b1", "[a] a2"}; !slices.Equal(lines, want) {
+		t.Errorf("transcript lines %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,22 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Output trip
+// -----------------------------------------------------------------------------
+
+// checkTrip stops the whole run, for --stop-on-output, once a line written
+// by the command tagged tag matches: the run's context is cancelled, which
+// kills the running commands and keeps the rest from starting. Only the
+// first match is reported.
+func (rn *runner) checkTrip(tag, line string) {
+	if rn.stopOnOutput == nil || !rn.stopOnOutput.MatchString(line) || !rn.tripped.CompareAndSwap(false, true) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "multirun: %s printed a line matching --stop-on-output, stopping: %s\n", tag, line)
+	rn.stopRun(fmt.Errorf("--stop-on-output tripped by %s", tag))
+}
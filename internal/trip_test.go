@@ -0,0 +1,36 @@
+package multirun
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStopOnOutput(t *testing.T) {
+	dir := scriptDir(t, map[string]string{
+		"leak.sh": "echo ok; echo 'PANIC: token leaked'; exec sleep 30",
+		"slow.sh": "exec sleep 30",
+	})
+	start := time.Now()
+	code, _, stderr := mainRun(t, dir, `{"commands": [
+  {"path": "leak.sh", "tag": "leak"},
+  {"path": "slow.sh", "tag": "slow"}
+], "jobs": 0}`, "--stop-on-output=^PANIC")
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("run took %v, the trip did not stop it", elapsed)
+	}
+	if code == 0 {
+		t.Error("a tripped run succeeded")
+	}
+	if want := "leak printed a line matching --stop-on-output, stopping: PANIC: token leaked"; strings.Count(stderr, "matching --stop-on-output") != 1 || !strings.Contains(stderr, want) {
+		t.Errorf("stderr = %q, want the trip reported once", stderr)
+	}
+}
+
+func TestStopOnOutputBadRegexp(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"x.sh": "exit 0"})
+	code, _, stderr := mainRun(t, dir, `{"commands": [{"path": "x.sh", "tag": "x"}], "jobs": 1}`, "--stop-on-output=(")
+	if code == 0 || !strings.Contains(stderr, "--stop-on-output") {
+		t.Errorf("exit %d, stderr %q, want the regexp refused", code, stderr)
+	}
+}
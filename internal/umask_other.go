@@ -0,0 +1,12 @@
+//go:build !unix
+
+package multirun
+
+// withUmask returns name and args unchanged: umask is only supported on
+// Unix.
+func withUmask(blob Command, name string, args []string) (string, []string) {
+	if blob.Umask != nil {
+		debugf("%s: umask is not supported on this platform, ignored", blob.Tag)
+	}
+	return name, args
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package multirun
+
+import "fmt"
+
+// withUmask wraps the program name with args in a shell that sets blob's
+// umask and then execs it, so the umask applies to that command alone and
+// multirun's own stays untouched.
+func withUmask(blob Command, name string, args []string) (string, []string) {
+	if blob.Umask == nil {
+		return name, args
+	}
+	debugf("%s: umask %04o", blob.Tag, *blob.Umask)
+	script := fmt.Sprintf(`umask %04o && exec "$0" "$@"`, *blob.Umask)
+	return "/bin/sh", append([]string{"-c", script, name}, args...)
+}
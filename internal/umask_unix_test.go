@@ -0,0 +1,37 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUmask(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"touch.sh": `touch "$(dirname "$0")/$1"`})
+	// multirun's own umask, which commands without umask keep
+	old := syscall.Umask(0o022)
+	defer syscall.Umask(old)
+	umask := 0o077
+	res := run(t, dir, Instructions{Jobs: 1, Commands: []Command{
+		{Path: "touch.sh", Tag: "private", Args: []string{"private file"}, Umask: &umask},
+		{Path: "touch.sh", Tag: "shared", Args: []string{"shared file"}},
+	}})
+	if res.ExitCode != 0 {
+		t.Fatalf("run failed: %+v", res)
+	}
+	if got := syscall.Umask(0o022); got != 0o022 {
+		t.Errorf("multirun's umask changed to %04o", got)
+	}
+	for name, want := range map[string]os.FileMode{"private file": 0o600, "shared file": 0o644} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s: mode %04o, want %04o", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package multirun
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Warmup
+// -----------------------------------------------------------------------------
+
+// warmupLabel prefixes the output of warmup runs.
+const warmupLabel = "[warmup] "
+
+// warmup runs the commands --warmup-count times before the real run, to
+// prime caches for benchmarks. execute calls it under lock_file, after
+// before_all and within max_runtime_seconds, and only once for all --repeat
+// iterations. Nothing about these runs counts: their output is labeled
+// warmupLabel, their results are dropped, and they send no --events-fd
+// events and leave no log_dir, --output-dir or transcript_file output,
+// checkpoint, fingerprint or --highlight count behind. It reports false
+// when a signal interrupted them.
+func (rn *runner) warmup(ctx context.Context) bool {
+	n := rn.opts.warmupCount
+	if n == 0 || rn.warmedUp {
+		return true
+	}
+	rn.warmedUp = true
+
+	// A --stop-on-output trip ends the warmup, not the run around it
+	stopRun, events := rn.stopRun, rn.events
+	ctx, rn.stopRun = context.WithCancelCause(ctx)
+	rn.events, rn.warming = nil, true
+	defer func() {
+		rn.stopRun(nil)
+		rn.stopRun, rn.events, rn.warming = stopRun, events, false
+	}()
+
+	for w := 1; w <= n; w++ {
+		fmt.Fprintf(os.Stderr, "multirun: warmup %d/%d\n", w, n)
+		res := rn.run(ctx)
+		if res.interrupted {
+			return false
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	for i := range rn.matches {
+		rn.matches[i].Store(0)
+	}
+	rn.tripped.Store(false)
+	return true
+}
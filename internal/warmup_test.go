@@ -0,0 +1,63 @@
+package multirun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWarmupDoesNotCount(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		failOn int
+		want   int
+	}{
+		{"failing warmup", 1, 0},
+		{"failing run", 2, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := scriptDir(t, map[string]string{
+				"count.sh": fmt.Sprintf(`n=$(($(cat "$0.count" 2>/dev/null || echo 0) + 1)); echo $n > "$0.count"; echo "run $n"; [ $n -ne %d ]`, tt.failOn),
+			})
+			logs := filepath.Join(dir, "logs")
+			instr := fmt.Sprintf(`{"commands": [{"path": "count.sh", "tag": "count"}], "jobs": 1, "log_dir": %q}`, logs)
+			code, stdout, _ := mainRun(t, dir, instr, "--warmup")
+			if code != tt.want {
+				t.Errorf("exit code %d, want %d", code, tt.want)
+			}
+			if !strings.Contains(stdout, warmupLabel+"run 1") {
+				t.Errorf("stdout %q lacks the labeled warmup output", stdout)
+			}
+			count, err := os.ReadFile(filepath.Join(dir, "count.sh.count"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(count)); got != "2" {
+				t.Errorf("command ran %s times, want 2", got)
+			}
+			log, err := os.ReadFile(filepath.Join(logs, "count.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(log) != "run 2\n" {
+				t.Errorf("log_dir holds %q, want only the real run", log)
+			}
+		})
+	}
+}
+
+func TestWarmupRunsAfterBeforeAll(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	instr := `{"commands": [{"path": "rec.sh", "tag": "cmd", "args": ["cmd"]}], "jobs": 1,
+		"before_all": {"path": "rec.sh", "tag": "setup", "args": ["setup"]}}`
+	if code, _, stderr := mainRun(t, dir, instr, "--warmup", "--repeat=2"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	want := []string{"setup", "cmd", "cmd", "setup", "cmd"}
+	if got := recorded(t, dir); !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
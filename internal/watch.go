@@ -0,0 +1,119 @@
+package multirun
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Watch mode
+// -----------------------------------------------------------------------------
+
+const (
+	watchPollInterval = 500 * time.Millisecond
+	// watchDebounce is how long the files must stay unchanged before a
+	// rerun, so a burst of writes triggers a single one.
+	watchDebounce = 300 * time.Millisecond
+)
+
+// watchPaths returns the --watch paths, relative ones resolved against the
+// directory `bazel run` was invoked from.
+func watchPaths(list []string) []string {
+	var paths []string
+	for _, item := range list {
+		for _, p := range strings.Split(item, ",") {
+			if p == "" {
+				continue
+			}
+			if wd := os.Getenv("BUILD_WORKING_DIRECTORY"); wd != "" && !filepath.IsAbs(p) {
+				p = filepath.Join(wd, p)
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// modTimes stats every path; missing files map to the zero time.
+func modTimes(paths []string) map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			times[p] = fi.ModTime()
+		} else {
+			times[p] = time.Time{}
+		}
+	}
+	return times
+}
+
+// changedPath returns a path whose modification time differs, or "".
+func changedPath(before, after map[string]time.Time) string {
+	for p, t := range after {
+		if !t.Equal(before[p]) {
+			return p
+		}
+	}
+	return ""
+}
+
+// watch runs the commands, then reruns them whenever one of paths changes,
+// until multirun is interrupted or ctx is done. A change during a run stops
+// that run first. It returns the result of the last run.
+func (rn *runner) watch(ctx context.Context, paths []string) *runResult {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	seen := modTimes(paths)
+	var last *runResult
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan *runResult, 1)
+		go func() { done <- rn.run(runCtx) }()
+		running := true
+
+		changed, stop := "", false
+		ticker := time.NewTicker(watchPollInterval)
+		for changed == "" && !stop {
+			select {
+			case <-signals:
+				stop = true
+			case <-ctx.Done():
+				stop = true
+			case last = <-done:
+				running = false
+				done = nil
+			case <-ticker.C:
+				now := modTimes(paths)
+				if p := changedPath(seen, now); p != "" {
+					// Wait for the writes to settle
+					for {
+						time.Sleep(watchDebounce)
+						settled := modTimes(paths)
+						if changedPath(now, settled) == "" {
+							break
+						}
+						now = settled
+					}
+					seen = now
+					changed = p
+				}
+			}
+		}
+		ticker.Stop()
+		cancel()
+		if running {
+			last = <-done
+		}
+		if stop {
+			return last
+		}
+		fmt.Printf("--- rerun (%s changed) ---\n", filepath.Base(changed))
+	}
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package multirun
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitRecorded waits up to five seconds for the recorder scripts of dir to
+// log n lines. Unlike recorded, it may run outside the test's goroutine.
+func waitRecorded(dir string, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		data, _ := os.ReadFile(filepath.Join(dir, "log"))
+		if len(strings.Fields(string(data))) >= n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchReruns(t *testing.T) {
+	dir := scriptDir(t, map[string]string{"rec.sh": recorder})
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		waitRecorded(dir, 1)
+		// A later modification time, however coarse the file system's
+		os.WriteFile(src, []byte("v2"), 0o644)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(src, later, later)
+		waitRecorded(dir, 2)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	instr := `{"commands": [{"path": "rec.sh", "tag": "rec", "args": ["run"]}], "jobs": 1}`
+	_, stdout, _ := mainRun(t, dir, instr, "--watch="+src)
+	if got := recorded(t, dir); !slices.Equal(got, []string{"run", "run"}) {
+		t.Errorf("ran %q, want a run and a rerun", got)
+	}
+	if !strings.Contains(stdout, "--- rerun (src.txt changed) ---") {
+		t.Errorf("stdout %q does not announce the rerun", stdout)
+	}
+}
@@ -48,12 +48,83 @@ _binary_args_env_aspect = aspect(
     implementation = _binary_args_env_aspect_impl,
 )
 
+def _command_entry(command, attr):
+    default_info = command[DefaultInfo]
+    if default_info.files_to_run == None:
+        fail("%s is not executable" % command.label, attr = attr)
+    exe = default_info.files_to_run.executable
+    if exe == None:
+        fail("%s does not have an executable file" % command.label, attr = attr)
+
+    args = []
+    env = {}
+    if _BinaryArgsEnvInfo in command:
+        args = command[_BinaryArgsEnvInfo].args
+        env = command[_BinaryArgsEnvInfo].env
+
+    tag = "Running {}".format(str(command.label))
+    settings = {}
+    if CommandInfo in command:
+        tag = command[CommandInfo].description or tag
+        settings = command[CommandInfo].settings or {}
+
+    entry = struct(
+        tag = tag,
+        path = exe.short_path,
+        args = args,
+        env = env,
+        **settings,
+    )
+    return entry, exe
+
+def _run_settings(ctx):
+    settings = {
+        "checkpoint_file": ctx.attr.checkpoint_file,
+        "child_kill_signal": ctx.attr.child_kill_signal,
+        "default_extra_args": ctx.attr.default_extra_args,
+        "exit_policy": ctx.attr.exit_policy,
+        "flush_interval_ms": ctx.attr.flush_interval_ms,
+        "forward_stdin_to": ctx.attr.forward_stdin_to,
+        "inherit_env_keys": ctx.attr.inherit_env_keys,
+        "inherit_fds": ctx.attr.inherit_fds,
+        "jobs_spec": ctx.attr.jobs_spec,
+        "lock_file": ctx.attr.lock_file,
+        "log_dir": ctx.attr.log_dir,
+        "max_buffer_bytes": ctx.attr.max_buffer_bytes,
+        "max_failures": ctx.attr.max_failures,
+        "max_runtime_seconds": ctx.attr.max_runtime_seconds,
+        "output_format": ctx.attr.output_format,
+        "output_mode": ctx.attr.output_mode,
+        "preflight_check": ctx.attr.preflight_check,
+        "progress_interval_ms": ctx.attr.progress_interval_ms,
+        "pty": ctx.attr.pty,
+        "require_confirm": ctx.attr.require_confirm,
+        "startup_delay_ms": ctx.attr.startup_delay_ms,
+        "state_dir": ctx.attr.state_dir,
+        "timeout_kill_grace_ms": ctx.attr.timeout_kill_grace_ms,
+        "timeout_kill_signal": ctx.attr.timeout_kill_signal,
+        "transcript_file": ctx.attr.transcript_file,
+    }
+    settings = {k: v for k, v in settings.items() if v}
+    if not ctx.attr.inherit_env:
+        settings["inherit_env"] = False
+    if ctx.attr.group_limits:
+        limits = {}
+        for group, limit in ctx.attr.group_limits.items():
+            if not limit.isdigit():
+                fail("group_limits[%r] must be a number, got %r" % (group, limit), attr = "group_limits")
+            limits[group] = int(limit)
+        settings["group_limits"] = limits
+    if ctx.files.includes:
+        settings["includes"] = [f.short_path for f in ctx.files.includes]
+    return settings
+
 def _multirun_impl(ctx):
     instructions_file = ctx.actions.declare_file(ctx.label.name + ".json")
     runner_info = ctx.attr._runner[DefaultInfo]
     runner_exe = runner_info.files_to_run.executable
 
-    runfiles = ctx.runfiles(files = [instructions_file, runner_exe])
+    runfiles = ctx.runfiles(files = [instructions_file, runner_exe] + ctx.files.includes)
     runfiles = runfiles.merge(ctx.attr._bash_runfiles[DefaultInfo].default_runfiles)
     runfiles = runfiles.merge(runner_info.default_runfiles)
 
@@ -63,48 +134,36 @@ def _multirun_impl(ctx):
             runfiles = runfiles.merge(default_runfiles)
 
     commands = []
-    tagged_commands = []
     runfiles_files = []
     for command in ctx.attr.commands:
-        tagged_commands.append(struct(tag = str(command.label), command = command))
-
-    for tag_command in tagged_commands:
-        command = tag_command.command
-
-        default_info = command[DefaultInfo]
-        if default_info.files_to_run == None:
-            fail("%s is not executable" % command.label, attr = "commands")
-        exe = default_info.files_to_run.executable
-        if exe == None:
-            fail("%s does not have an executable file" % command.label, attr = "commands")
+        entry, exe = _command_entry(command, "commands")
+        commands.append(entry)
         runfiles_files.append(exe)
 
-        args = []
-        env = {}
-        if _BinaryArgsEnvInfo in command:
-            args = command[_BinaryArgsEnvInfo].args
-            env = command[_BinaryArgsEnvInfo].env
-
-        default_runfiles = default_info.default_runfiles
+        default_runfiles = command[DefaultInfo].default_runfiles
         if default_runfiles != None:
             runfiles = runfiles.merge(default_runfiles)
 
-        if CommandInfo in command:
-            tag = command[CommandInfo].description
-        else:
-            tag = "Running {}".format(tag_command.tag)
-
-        commands.append(struct(
-            tag = tag,
-            path = exe.short_path,
-            args = args,
-            env = env,
-        ))
+    hooks = {}
+    for name in ["before_all", "finalizer"]:
+        hook = getattr(ctx.attr, name)
+        if not hook:
+            continue
+        hook = hook if type(hook) == "Target" else hook[0]
+        entry, exe = _command_entry(hook, name)
+        hooks[name] = entry
+        runfiles_files.append(exe)
+        default_runfiles = hook[DefaultInfo].default_runfiles
+        if default_runfiles != None:
+            runfiles = runfiles.merge(default_runfiles)
 
     if ctx.attr.jobs < 0:
         fail("'jobs' attribute should be at least 0")
-    elif ctx.attr.jobs > 0 and ctx.attr.forward_stdin:
-        fail("'forward_stdin' can only apply to parallel jobs ('jobs' === 0)")
+    elif ctx.attr.jobs == 1 and not ctx.attr.jobs_spec and ctx.attr.forward_stdin:
+        fail("'forward_stdin' only applies to parallel runs ('jobs' other than 1)")
+
+    settings = _run_settings(ctx)
+    settings.update(hooks)
 
     jobs = ctx.attr.jobs
     instructions = struct(
@@ -115,6 +174,7 @@ def _multirun_impl(ctx):
         buffer_output = ctx.attr.buffer_output,
         forward_stdin = ctx.attr.forward_stdin,
         workspace_name = ctx.workspace_name,
+        **settings,
     )
     ctx.actions.write(
         output = instructions_file,
@@ -172,7 +232,7 @@ def multirun_with_transition(cfg, allowlist = None):
         ),
         "keep_going": attr.bool(
             default = False,
-            doc = "Keep going after a command fails. Only for sequential execution.",
+            doc = "Keep going after a command fails. Without it, sequential runs and runs with a jobs limit above 1 stop at the first failure.",
         ),
         "buffer_output": attr.bool(
             default = False,
@@ -182,6 +242,122 @@ def multirun_with_transition(cfg, allowlist = None):
             default = False,
             doc = "Whether or not to forward stdin",
         ),
+        "forward_stdin_to": attr.string(
+            doc = "Only forward stdin to the command with this tag.",
+        ),
+        "jobs_spec": attr.string(
+            doc = "Overrides `jobs` relative to the CPU count: `auto`, a fraction such as `0.5x`, a multiple such as `2x`, or a plain number.",
+        ),
+        "exit_policy": attr.string(
+            default = "any",
+            values = ["any", "all", "first"],
+            doc = "How failures map to the exit code: `any` fails if any command failed, `all` only if every command failed, and `first` exits with the exit code of the first command to fail.",
+        ),
+        "max_failures": attr.int(
+            default = 0,
+            doc = "Stop the run once this many commands have failed. 0 means no limit.",
+        ),
+        "max_runtime_seconds": attr.int(
+            default = 0,
+            doc = "Bounds the wall-clock time of the whole run. When it runs out, running commands are killed and pending ones skipped.",
+        ),
+        "startup_delay_ms": attr.int(
+            default = 0,
+            doc = "Stagger parallel launches by this many milliseconds.",
+        ),
+        "progress_interval_ms": attr.int(
+            default = 0,
+            doc = "Print a progress line to stderr at this interval during parallel runs.",
+        ),
+        "flush_interval_ms": attr.int(
+            default = 0,
+            doc = "With `buffer_output`, print the complete lines a command has produced so far at this interval instead of only when it exits.",
+        ),
+        "output_format": attr.string(
+            default = "plain",
+            values = ["plain", "github", "gitlab"],
+            doc = "Frame each command's output for a CI log viewer: collapsible groups with `github` or `gitlab`. Commands running in parallel without `buffer_output` are not framed.",
+        ),
+        "output_mode": attr.string(
+            default = "",
+            values = ["", "summary"],
+            doc = "With `summary`, buffered parallel runs print a status line for each command that succeeds instead of its output. Failed commands still print everything.",
+        ),
+        "max_buffer_bytes": attr.int(
+            default = 0,
+            doc = "Bounds how much of a buffered command's output is held in memory. The rest goes to a temporary file. 0 means no limit.",
+        ),
+        "pty": attr.bool(
+            default = False,
+            doc = "Run every command on its own pseudo-terminal, for programs that only color or line-buffer their output on a terminal. Linux only.",
+        ),
+        "default_extra_args": attr.string_list(
+            doc = "Arguments passed to every command when `bazel run` is given none.",
+        ),
+        "group_limits": attr.string_dict(
+            doc = "How many commands of each `group` run at once, as a number. Groups not listed run one at a time, and 0 means no cap.",
+        ),
+        "preflight_check": attr.bool(
+            default = False,
+            doc = "Make sure every command's binary exists before anything is launched.",
+        ),
+        "child_kill_signal": attr.string(
+            doc = "The signal sent to running commands when multirun is interrupted or terminated. SIGINT by default.",
+        ),
+        "timeout_kill_signal": attr.string(
+            doc = "The signal sent to a command that ran out of time through `max_runtime_seconds` or its `idle_timeout_seconds`. SIGKILL by default.",
+        ),
+        "timeout_kill_grace_ms": attr.int(
+            default = 0,
+            doc = "How long a command that ran out of time gets to exit before it is killed, unless `timeout_kill_signal` is SIGKILL. 5000 by default.",
+        ),
+        "inherit_env": attr.bool(
+            default = True,
+            doc = "Start commands from multirun's environment. Without it, commands start from an empty one that only keeps `inherit_env_keys`.",
+        ),
+        "inherit_env_keys": attr.string_list(
+            doc = "The variables, such as PATH or HOME, kept when `inherit_env` is False.",
+        ),
+        "inherit_fds": attr.int_list(
+            doc = "multirun's own file descriptors passed on to every command as fd 3, 4, and so on, in order. Unix only.",
+        ),
+        "require_confirm": attr.bool(
+            default = False,
+            doc = "List the commands and ask for \"yes\" on the terminal before running them.",
+        ),
+        "lock_file": attr.string(
+            doc = "A path locked for the whole run, so that only one multirun using it runs at a time.",
+        ),
+        "log_dir": attr.string(
+            doc = "A directory that receives a `<tag>.log` copy of each command's output.",
+        ),
+        "state_dir": attr.string(
+            doc = "A directory that keeps state between runs, such as the hashes of `fingerprint_file`.",
+        ),
+        "checkpoint_file": attr.string(
+            doc = "In sequential runs, records the commands that succeeded so that the next run skips them and resumes where this one stopped.",
+        ),
+        "transcript_file": attr.string(
+            doc = "A file that receives every line of output from all commands, tagged and timestamped in the order it arrived.",
+        ),
+        "includes": attr.label_list(
+            allow_files = [".json", ".json5"],
+            doc = "Further instructions files whose commands are appended to this multirun's.",
+        ),
+        "before_all": attr.label(
+            executable = True,
+            allow_files = True,
+            aspects = [_binary_args_env_aspect],
+            doc = "Target to run to completion before any command starts. If it fails, no command runs unless `keep_going` is set, and either way the run fails.",
+            cfg = cfg,
+        ),
+        "finalizer": attr.label(
+            executable = True,
+            allow_files = True,
+            aspects = [_binary_args_env_aspect],
+            doc = "Target to run once all commands have finished, whatever their outcome, with MULTIRUN_RESULT set to success or failure.",
+            cfg = cfg,
+        ),
         "_bash_runfiles": attr.label(
             default = Label("@bazel_tools//tools/bash/runfiles"),
         ),
@@ -65,6 +65,16 @@ hello2" ]]; then
   exit 1
 fi
 
+script="$(rlocation rules_multirun/tests/multirun_parallel_needs.bash)"
+needs_output=$($script)
+if [[ "$needs_output" != "first
+hello
+second
+hello2" ]]; then
+  echo "Expected first to run before second, got '$needs_output'"
+  exit 1
+fi
+
 script=$(rlocation rules_multirun/tests/multirun_serial.bash)
 serial_output=$($script | sed 's=@[^/]*/=@/=g')
 if [[ "$serial_output" != "Running @//tests:validate_args_cmd